@@ -15,7 +15,6 @@ require (
 )
 
 require (
-	github.com/alexflint/go-filemutex v1.2.0 // indirect
 	github.com/fsnotify/fsnotify v1.4.9 // indirect
 	github.com/google/go-cmp v0.6.0 // indirect
 	github.com/nxadm/tail v1.4.8 // indirect
@@ -0,0 +1,54 @@
+package dnsname
+
+import (
+	"encoding/json"
+
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/pkg/errors"
+)
+
+// cniVersion110 is the CNI spec version 1.1.0. The vendored CNI library knows
+// results up to 1.0.0 only. The 1.1.0 result keeps the 1.0.0 format, so such
+// results are handled with the 1.0.0 types and only their version differs.
+const cniVersion110 = "1.1.0"
+
+// SupportedVersions are the CNI versions the plugin accepts
+var SupportedVersions = version.PluginSupports(append(version.All.SupportedVersions(), cniVersion110)...)
+
+// parsePrevResult parses the previous result of the configuration and
+// converts it to the current version
+func parsePrevResult(conf *types.NetConf) (*current.Result, error) {
+	if conf.CNIVersion != cniVersion110 {
+		if err := version.ParsePrevResult(conf); err != nil {
+			return nil, err
+		}
+		result, err := current.NewResultFromResult(conf.PrevResult)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not convert result to current version")
+		}
+		return result, nil
+	}
+	data, err := json.Marshal(conf.RawPrevResult)
+	if err != nil {
+		return nil, err
+	}
+	result := &current.Result{}
+	if err := json.Unmarshal(data, result); err != nil {
+		return nil, err
+	}
+	result.CNIVersion = current.ImplementedSpecVersion
+	conf.PrevResult = result
+	return result, nil
+}
+
+// versionedResult converts the result to the requested CNI version
+func versionedResult(result *current.Result, cniVersion string) (types.Result, error) {
+	if cniVersion == cniVersion110 {
+		versioned := *result
+		versioned.CNIVersion = cniVersion110
+		return &versioned, nil
+	}
+	return result.GetAsVersion(cniVersion)
+}
@@ -0,0 +1,182 @@
+package dnsname
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// flushCommand is the maintenance command sending the deferred SIGHUP of
+	// an instance
+	flushCommand = "flush-reload"
+	// flusherLockFileName is the lock file in the directory of the instance
+	// held by its flusher, so there is one flusher per instance
+	flusherLockFileName = "flusher.lock"
+	// pendingReloadFileName is the file in the directory of the instance
+	// counting the changes waiting for the deferred SIGHUP. Its modification
+	// time is the time of the last change.
+	pendingReloadFileName = "reload.pending"
+)
+
+// deferHup records a change waiting for the SIGHUP of the running instance.
+// The flusher sends the SIGHUP once no change came for ReloadWindow, the
+// pending changes are applied right away once ReloadMaxBatch is reached.
+func (d dnsNameFile) deferHup(ctx context.Context) error {
+	path := filepath.Join(d.InstanceDir, pendingReloadFileName)
+	count, err := readCount(path)
+	if err != nil {
+		// a broken count must not keep the changes from being applied
+		logrus.Warnf("unable to read the pending reloads of %s: %v", d.InstanceDir, err)
+		count = 0
+	}
+	count++
+	if d.ReloadMaxBatch > 0 && count >= d.ReloadMaxBatch {
+		return d.flushPending(ctx)
+	}
+	if err := ioutil.WriteFile(path, []byte(strconv.Itoa(count)+"\n"), 0o644); err != nil {
+		return err
+	}
+	if err := d.ensureFlusher(); err != nil {
+		logrus.Warnf("unable to start the flusher of %s, reloading at once: %v", d.InstanceDir, err)
+		return d.flushPending(ctx)
+	}
+	return nil
+}
+
+// flushPending sends the SIGHUP for the pending changes, starting the
+// instance if it died during the window
+func (d dnsNameFile) flushPending(ctx context.Context) error {
+	if err := d.hup(ctx); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(d.InstanceDir, pendingReloadFileName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ensureFlusher spawns the flusher of the instance unless it has one already.
+// Like the watcher, the flusher is a detached process of the plugin binary.
+func (d dnsNameFile) ensureFlusher() error {
+	if lockHeld(filepath.Join(d.InstanceDir, flusherLockFileName)) {
+		return nil
+	}
+	binary, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	env := os.Environ()
+	if d.LockDir != "" {
+		env = append(env, lockDirEnv+"="+d.LockDir)
+	}
+	return d.processes().spawn(binary, []string{flushCommand, filepath.Base(d.InstanceDir),
+		d.ReloadWindow.Duration.String()}, env)
+}
+
+// flushInstance sends the deferred SIGHUP of the instance once the window
+// quiesced. It returns the time to wait before the next check, or true once
+// nothing is pending anymore.
+func flushInstance(ctx context.Context, conf dnsNameFile, window time.Duration, now time.Time) (time.Duration, bool, error) {
+	info, err := os.Stat(filepath.Join(conf.InstanceDir, pendingReloadFileName))
+	if os.IsNotExist(err) {
+		// flushed by a full batch already
+		return 0, true, nil
+	}
+	if err != nil {
+		return window, false, err
+	}
+	if wait := info.ModTime().Add(window).Sub(now); wait > 0 {
+		return wait, false, nil
+	}
+	if err := conf.flushPending(ctx); err != nil {
+		// retried after the window
+		return window, false, err
+	}
+	return 0, true, nil
+}
+
+// flushNetwork runs flushInstance under the network lock, so it doesn't race
+// with ADD and DEL. The flusher lock is released before the network lock once
+// the flusher is done, so a following change spawns a new flusher.
+func flushNetwork(networkName string, window time.Duration, flusherLock *os.File) (time.Duration, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultCommandTimeout)
+	defer cancel()
+	lock, err := lockNetwork(ctx, commandLockDir(), networkName, false, defaultLockPollInterval)
+	if err != nil {
+		return window, false, err
+	}
+	defer func() {
+		if err := lock.release(); err != nil {
+			logrus.Errorf("unable to release lock for %q: %v", networkName, err)
+		}
+	}()
+	var (
+		wait time.Duration
+		done bool
+	)
+	if _, err = os.Stat(makePath(networkName, confFileName)); os.IsNotExist(err) {
+		// the instance is torn down, there is nothing to reload
+		done, err = true, nil
+	} else {
+		var conf dnsNameFile
+		if conf, _, err = loadInstance(networkName); err == nil {
+			wait, done, err = flushInstance(ctx, conf, window, time.Now())
+		}
+	}
+	if done {
+		flusherLock.Close()
+	}
+	return wait, done, err
+}
+
+// cmdFlushReload sends the deferred SIGHUP of the instance of the network
+// once no change came for the window
+func cmdFlushReload(args []string) error {
+	if len(args) != 2 {
+		return errors.New("the network name and the window are required")
+	}
+	networkName := args[0]
+	window, err := time.ParseDuration(args[1])
+	if err != nil || window <= 0 {
+		return errors.Errorf("invalid window %q", args[1])
+	}
+	path := makePath(networkName, flusherLockFileName)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		if err == unix.EWOULDBLOCK {
+			// the instance has a flusher already
+			return nil
+		}
+		return err
+	}
+	wait := window
+	for {
+		time.Sleep(wait)
+		if !ownsLock(f, path) {
+			return nil
+		}
+		var done bool
+		wait, done, err = flushNetwork(networkName, window, f)
+		if err != nil {
+			logrus.Warnf("unable to flush the reload of %s: %v", networkName, err)
+		}
+		if done {
+			return err
+		}
+		if wait <= 0 {
+			wait = window
+		}
+	}
+}
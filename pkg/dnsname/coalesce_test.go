@@ -0,0 +1,79 @@
+package dnsname
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDeferHup(t *testing.T) {
+	d, procs := newTestDNSMasqFile(t)
+	d.ReloadWindow = Duration{time.Second}
+	d.ReloadMaxBatch = 3
+	ctx := context.Background()
+	if err := d.start(ctx); err != nil {
+		t.Fatalf("Can't start: %v", err)
+	}
+	pending := func() int {
+		count, err := readCount(filepath.Join(d.InstanceDir, pendingReloadFileName))
+		if err != nil {
+			t.Fatalf("Can't read pending reloads: %v", err)
+		}
+		return count
+	}
+
+	for i := 1; i <= 2; i++ {
+		if err := d.reload(ctx, false, false); err != nil {
+			t.Fatalf("reload() error = %v", err)
+		}
+		if len(procs.signals) != 0 || pending() != i {
+			t.Fatalf("SIGHUP should be deferred, got signals %v, %d pending", procs.signals, pending())
+		}
+	}
+	if len(procs.spawns) != 2 || procs.spawns[0][1] != flushCommand || procs.spawns[0][3] != "1s" {
+		t.Errorf("reload() should spawn the flusher, got %v", procs.spawns)
+	}
+	// the full batch is applied at once
+	if err := d.reload(ctx, false, false); err != nil {
+		t.Fatalf("reload() error = %v", err)
+	}
+	if len(procs.signals) != 1 || procs.signals[0] != syscall.SIGHUP || pending() != 0 {
+		t.Errorf("Full batch should be applied, got signals %v, %d pending", procs.signals, pending())
+	}
+}
+
+func TestFlushInstance(t *testing.T) {
+	d, procs := newTestDNSMasqFile(t)
+	ctx := context.Background()
+	window := time.Second
+	path := filepath.Join(d.InstanceDir, pendingReloadFileName)
+	if err := ioutil.WriteFile(path, []byte("2\n"), 0o644); err != nil {
+		t.Fatalf("Can't write pending reloads: %v", err)
+	}
+	changed := time.Now()
+	if err := os.Chtimes(path, changed, changed); err != nil {
+		t.Fatalf("Can't set the time of the last change: %v", err)
+	}
+
+	wait, done, err := flushInstance(ctx, d, window, changed.Add(window/4))
+	if err != nil || done || wait != 3*window/4 {
+		t.Fatalf("flushInstance() got = %v %v %v, want the rest of the window", wait, done, err)
+	}
+	// the instance died during the window, so it is started
+	if _, done, err = flushInstance(ctx, d, window, changed.Add(window)); err != nil || !done {
+		t.Fatalf("flushInstance() got = %v %v, want done", done, err)
+	}
+	if procs.runs != 1 {
+		t.Errorf("Dead instance should be started, got %d starts", procs.runs)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Pending reloads should be removed, got %v", err)
+	}
+	if _, done, err = flushInstance(ctx, d, window, changed.Add(window)); err != nil || !done || procs.runs != 1 {
+		t.Errorf("flushInstance() got = %v %v, %d starts, want nothing to flush", done, err, procs.runs)
+	}
+}
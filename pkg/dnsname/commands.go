@@ -0,0 +1,81 @@
+package dnsname
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// command is a maintenance command run when the plugin binary is invoked
+// with arguments. CNI runtimes pass everything through the environment, so
+// the arguments never clash with plugin invocations.
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+// commands are the maintenance commands by name
+var commands = map[string]command{
+	"--version": {
+		usage: "--version",
+		run: func([]string) error {
+			fmt.Println(BuildInfo())
+			return nil
+		},
+	},
+	"gc": {
+		usage: "gc",
+		run:   cmdGC,
+	},
+	"probe": {
+		usage: "probe <network>",
+		run:   cmdProbe,
+	},
+	"list-pods": {
+		usage: "list-pods <network>",
+		run:   cmdListPods,
+	},
+	"remove-pod": {
+		usage: "remove-pod <network> <pod>",
+		run:   cmdRemovePod,
+	},
+	"consistency-check": {
+		usage: "consistency-check <network>",
+		run:   cmdConsistencyCheck,
+	},
+	"metrics": {
+		usage: "metrics [file]",
+		run:   cmdMetrics,
+	},
+	watchCommand: {
+		usage: "watch <network>",
+		run:   cmdWatch,
+	},
+	flushCommand: {
+		usage: "flush-reload <network> <window>",
+		run:   cmdFlushReload,
+	},
+}
+
+// RunCommand runs the maintenance command given by the arguments and returns
+// the process exit code
+func RunCommand(args []string) int {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q, usage:\n", args[0])
+		names := make([]string, 0, len(commands))
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(os.Stderr, "  dnsname %s\n", commands[name].usage)
+		}
+		return 2
+	}
+	if err := cmd.run(args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
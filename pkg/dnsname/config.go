@@ -0,0 +1,1033 @@
+package dnsname
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// confFileName is the name of the dns masq conf file
+	confFileName = "dnsmasq.conf"
+	// hostsFileName is the name of the addnhosts file
+	hostsFileName = "addnhosts"
+	// staticHostsFileName is the name of the addnhosts file with the static host mappings
+	staticHostsFileName = "staticaddnhosts"
+	// pidFileName is the file where the dnsmasq file is stored
+	pidFileName = "pidfile"
+	// localServersConfFileName is the name of the additional dnsmasq config with other servers
+	localServersConfFileName = "localservers.conf"
+	// ownServersConfFileName is the name of the additional dnsmasq config with own servers
+	ownServersConfFileName = "ownservers.conf"
+	// cnamesFileName is the name of the additional dnsmasq config with the aliases as CNAMEs
+	cnamesFileName = "cnames.conf"
+)
+
+// defaultCommandTimeout is the default time limit for external commands
+const defaultCommandTimeout = 30 * time.Second
+
+const (
+	// startCheckTimeout limits the time a started dnsmasq has to show up as running
+	startCheckTimeout = time.Second
+	// startCheckInterval is the interval the started dnsmasq is checked in
+	startCheckInterval = 50 * time.Millisecond
+	// stopCheckTimeout limits the time a killed dnsmasq has to exit
+	stopCheckTimeout = time.Second
+	// stopCheckInterval is the interval the killed dnsmasq is checked in
+	stopCheckInterval = 20 * time.Millisecond
+)
+
+// defaultRunAsUser is the user dnsmasq runs as unless RunAsUser is set
+const defaultRunAsUser = "root"
+
+// defaultDNSPort is the port dnsmasq listens on unless DNSPort is set
+const defaultDNSPort = 53
+
+// maxCPUs is the number of CPUs the CPU affinity can select
+const maxCPUs = 1024
+
+// minMaxOpenFiles is the lowest open files limit dnsmasq is given, it needs
+// some for its sockets and files besides those of the forwarded queries
+const minMaxOpenFiles = 64
+
+// defaultDNSForwardMax is the limit of concurrent forwarded queries with
+// HardenUpstream, the default of dnsmasq
+const defaultDNSForwardMax = 150
+
+const (
+	// logFormatText writes the logs as text lines
+	logFormatText = "text"
+	// logFormatJSON writes the logs as JSON objects
+	logFormatJSON = "json"
+)
+
+const (
+	// aliasRecordsHosts writes the aliases of a pod to the hosts file next to its name
+	aliasRecordsHosts = "hosts"
+	// aliasRecordsCNAME makes the aliases of a pod CNAMEs of its name
+	aliasRecordsCNAME = "cname"
+)
+
+// mdnsDomain is the top-level domain reserved for multicast DNS (RFC 6762),
+// resolved by mDNS responders such as Avahi on the node
+const mdnsDomain = "local"
+
+// clientSubnetAuto passes the client subnet with the defaults of dnsmasq
+const clientSubnetAuto = "auto"
+
+// maxNegTTL is the upper limit in seconds for caching failed lookups, longer
+// values would hide new pods from clients for too long
+const maxNegTTL = 3600
+
+// defaultTrustAnchorsFiles are the locations of the DNSSEC trust anchors
+// shipped with dnsmasq by the distributions
+var defaultTrustAnchorsFiles = []string{
+	"/usr/share/dnsmasq-base/trust-anchors.conf",
+	"/usr/share/dnsmasq/trust-anchors.conf",
+}
+
+const (
+	// ipFamilyV4 selects IPv4 addresses only
+	ipFamilyV4 = "4"
+	// ipFamilyV6 selects IPv6 addresses only
+	ipFamilyV6 = "6"
+	// ipFamilyDual selects addresses of both families
+	ipFamilyDual = "dual"
+)
+
+const dnsMasqTemplate = `## WARNING: THIS IS AN AUTOGENERATED FILE
+## AND SHOULD NOT BE EDITED MANUALLY AS IT
+## LIKELY TO AUTOMATICALLY BE REPLACED.
+all-servers
+strict-order
+{{- if .Group}}
+{{- range .Members}}
+local=/{{.Domain}}/
+{{- end}}
+{{- else if .ForwardOnly}}
+{{- range .ForwardServers}}
+server=/{{$.Domain}}/{{.}}
+{{- end}}
+{{- else}}
+local=/{{.Domain}}/
+domain={{.Domain}}
+expand-hosts
+{{- if .ReverseZone}}
+synth-domain={{.Domain}},{{.ReverseZone}}
+{{- end}}
+{{- end}}
+{{- if .ServiceDomain}}
+local=/{{.ServiceDomain}}/
+{{- end}}
+{{- if .MDNSGuard}}
+local=/local/
+{{- end}}
+{{- if .InterfaceName}}
+interface-name={{.InterfaceName}}.{{.Domain}},{{.NetworkInterface}}{{if .AddressFamily}}/{{.AddressFamily}}{{end}}
+{{- end}}
+pid-file={{if not .NoPidFile}}{{.PidFile}}{{end}}
+{{- if .DNSPort}}
+port={{.DNSPort}}
+{{- end}}
+except-interface=lo
+{{- if .BindInterfaceOnly}}
+bind-interfaces
+{{- range .ListenAddresses}}
+listen-address={{.}}
+{{- end}}
+{{- else}}
+bind-dynamic
+{{- end}}
+no-hosts
+{{- if .Isolated}}
+no-resolv
+address=/#/
+{{- end}}
+{{- if .ForceUpstreamTCP}}
+edns-packet-max=512
+{{- end}}
+{{- if .DNSForwardMax}}
+dns-forward-max={{.DNSForwardMax}}
+{{- end}}
+{{- if .AddSubnet}}
+{{.AddSubnet}}
+{{- end}}
+{{- if .NegTTL}}
+neg-ttl={{.NegTTL}}
+{{- end}}
+{{- if .StopDNSRebind}}
+stop-dns-rebind
+{{- if .RebindDomainOK}}
+{{.RebindDomainOK}}
+{{- end}}
+{{- end}}
+{{- if .DNSSEC}}
+dnssec
+conf-file={{.TrustAnchorsFile}}
+{{- if .DNSSECCheckUnsigned}}
+dnssec-check-unsigned
+{{- end}}
+{{- end}}
+{{- if .Group}}
+{{- range .Members}}
+interface={{.Interface}}
+{{- end}}
+{{- else if not .BindInterfaceOnly}}
+interface={{.NetworkInterface}}
+{{- end}}
+{{- if .Group}}
+addn-hosts={{.HostsDir}}
+{{- else}}
+{{- if not .ForwardOnly}}
+addn-hosts={{.AddOnHostsFile}}
+{{- else}}
+# pods-hosts={{.AddOnHostsFile}}
+{{- end}}
+addn-hosts={{.StaticHostsFile}}
+{{- if .CNAMEAliases}}
+conf-file={{.CNAMEFile}}
+{{- end}}
+{{- end}}
+servers-file={{.LocalServersConfFile}}
+{{- range .IncludeConfFiles}}
+conf-file={{.}}
+{{- end}}
+{{- range .ExtraOptions}}
+{{.}}
+{{- end}}`
+
+var (
+	// ErrBinaryNotFound means that the dnsmasq binary was not found
+	ErrBinaryNotFound = errors.New("unable to locate dnsmasq in path")
+	// ErrNoIPAddressFound means that CNI was unable to resolve an IP address in the CNI configuration
+	ErrNoIPAddressFound = errors.New("no ip address was found in the network")
+	// ErrNoInterfaceFound means that the prevResult has no interfaces
+	ErrNoInterfaceFound = errors.New("no interface was found in the prevResult")
+	// ErrPrevResultMissing means that the plugin was not called with a prevResult
+	ErrPrevResultMissing = errors.New("required prevResult missing")
+	// ErrDNSMasqNotRunning means that the dnsmasq instance of the network is not running
+	ErrDNSMasqNotRunning = errors.New("dnsmasq instance not running")
+	// ErrConfigFileMissing means that a file of the dnsmasq instance configuration is missing
+	ErrConfigFileMissing = errors.New("file missing from configuration")
+	// ErrDomainExists means that the domain name is already served by another network
+	ErrDomainExists = errors.New("domain already exists")
+	// ErrStartFailed means that the dnsmasq instance could not be started
+	ErrStartFailed = errors.New("unable to start dnsmasq")
+	// ErrStopFailed means that the dnsmasq instance could not be stopped
+	ErrStopFailed = errors.New("unable to stop dnsmasq")
+	// ErrTimeout means that an external command did not finish in time
+	ErrTimeout = errors.New("operation timed out")
+	// ErrAddressInUse means that another process listens on the address dnsmasq should listen on
+	ErrAddressInUse = errors.New("dnsmasq listen address in use")
+	// ErrDomainNotAllowed means that the network may not claim its domain name
+	ErrDomainNotAllowed = errors.New("domain not allowed")
+	// ErrHostsLimit means that the hosts file of the network has no room for the pod
+	ErrHostsLimit = errors.New("hosts limit reached")
+	// ErrInvalidConfig means that dnsmasq rejected the generated configuration
+	ErrInvalidConfig = errors.New("invalid dnsmasq configuration")
+)
+
+// DNSNameConf represents the cni config with the domain name attribute
+type DNSNameConf struct {
+	types.NetConf
+	DomainName    string   `json:"domainName"`
+	MultiDomain   bool     `json:"multiDomain"`
+	RemoteServers []string `json:"remoteServers"`
+	// DomainServers delegates further domains of a multi-domain network to
+	// the given servers, e.g. for split-horizon setups. The network and its
+	// peers forward the queries for each domain to its servers, while the
+	// domain of the network is still answered by its own instance.
+	DomainServers map[string][]string `json:"domainServers"`
+	// ForwardOnly forwards the queries for the domain to RemoteServers, e.g.
+	// authoritative servers fed from the hosts file, instead of answering them
+	// from the hosts file. The pods are still written to the hosts file.
+	ForwardOnly bool        `json:"forwardOnly"`
+	HostAliases []HostAlias `json:"hostAliases"`
+	// AddressFamily restricts the interface addresses used as nameservers to
+	// one family ("4" or "6"), both families are used if empty
+	AddressFamily string `json:"addressFamily"`
+	// NameserverFamily further restricts the nameservers returned to the pod
+	// to one family ("4" or "6"), the instance still serves both
+	NameserverFamily string `json:"nameserverFamily"`
+	// RedirectFamily selects the families the DNS queries are accepted for by
+	// the redirect rule: "4" (default, iptables), "6" (ip6tables) or "dual"
+	RedirectFamily string `json:"redirectFamily"`
+	// CommandTimeout limits the time external commands (dnsmasq, iptables)
+	// may take, defaultCommandTimeout is used if unset
+	CommandTimeout Duration `json:"commandTimeout"`
+	// ReloadTimeout makes ADD wait until the reloaded instance serves the pod,
+	// for at most the given time. ADD does not wait if unset.
+	ReloadTimeout Duration `json:"reloadTimeout"`
+	// ReloadWindow coalesces the SIGHUPs of a running instance for networks
+	// with a high pod churn: the changed hosts files are applied by a single
+	// SIGHUP once no change came for the given time, or right away once
+	// ReloadMaxBatch changes are pending. Changes are applied at once if unset.
+	ReloadWindow   Duration `json:"reloadWindow"`
+	ReloadMaxBatch int      `json:"reloadMaxBatch"`
+	// LockTimeout limits the time waiting for the locks of the network,
+	// defaultLockTimeout is used if unset. The locks are polled every
+	// LockPollInterval, defaultLockPollInterval if unset.
+	LockTimeout      Duration `json:"lockTimeout"`
+	LockPollInterval Duration `json:"lockPollInterval"`
+	// LockDir is the directory of the lock files, the configuration directory
+	// if unset. It must be the same for all networks.
+	LockDir string `json:"lockDir"`
+	// ForceUpstreamTCP makes answers which do not fit a plain DNS UDP packet
+	// go over TCP. dnsmasq has no directive to force TCP to upstream servers,
+	// so the EDNS UDP payload is limited to 512 bytes instead: upstream servers
+	// truncate larger answers, clients retry over TCP and dnsmasq forwards TCP
+	// queries over TCP. It is a global option and applies to every server of
+	// the instance, remote servers and multi-domain peers alike.
+	ForceUpstreamTCP bool `json:"forceUpstreamTCP"`
+	// DNSSEC enables validation of DNSSEC signed answers with the trust anchors
+	// from DNSSECTrustAnchors or, if unset, from the dnsmasq distribution
+	DNSSEC              bool   `json:"dnssec"`
+	DNSSECCheckUnsigned bool   `json:"dnssecCheckUnsigned"`
+	DNSSECTrustAnchors  string `json:"dnssecTrustAnchors"`
+	// ExtraDnsmasqOptions are dnsmasq options (e.g. "domain-needed",
+	// "cache-size=1000") appended verbatim to the generated conf file
+	ExtraDnsmasqOptions []string `json:"extraDnsmasqOptions"`
+	// ValidateConfig checks a new dnsmasq configuration with dnsmasq --test
+	// before the instance is started
+	ValidateConfig bool `json:"validateConfig"`
+	// ServiceDomain is the domain of the service names passed for the pods
+	// in the SERVICE_NAME CNI argument. The pods are registered under
+	// <service>.<serviceDomain> on every network configured with it.
+	ServiceDomain string `json:"serviceDomain"`
+	// AllowMDNSDomain drops the guard of a domain under .local, which keeps
+	// dnsmasq from forwarding other .local names upstream, and its warning
+	AllowMDNSDomain bool `json:"allowMDNSDomain"`
+	// Isolated makes dnsmasq answer from its hosts files only, any other name
+	// is NXDOMAIN instead of being forwarded upstream
+	Isolated bool `json:"isolated"`
+	// SuppressNameservers leaves the nameservers of the result as they are,
+	// for chains where a later plugin owns the resolv.conf of the pod
+	SuppressNameservers bool `json:"suppressNameservers"`
+	// FallbackNameservers are listed after the addresses of the instance in
+	// the result, e.g. a resolver of the node, so the pods still resolve
+	// names if the instance dies
+	FallbackNameservers []string `json:"fallbackNameservers"`
+	// Search overrides the search domains returned to the pod, the domain
+	// name of the network is used if unset
+	Search []string `json:"search"`
+	// BindInterfaceOnly makes dnsmasq bind only to the addresses of the
+	// network interface instead of listening on the interface dynamically
+	BindInterfaceOnly bool `json:"bindInterfaceOnly"`
+	// InterfaceName is a host name in the network domain which dnsmasq answers
+	// with the addresses the network interface has at query time
+	// (interface-name), so the name stays right when the addresses change
+	InterfaceName string `json:"interfaceName"`
+	// StopDNSRebind makes dnsmasq reject upstream answers with private
+	// addresses (stop-dns-rebind), except for the domains of RebindAllowlist
+	StopDNSRebind   bool     `json:"stopDNSRebind"`
+	RebindAllowlist []string `json:"rebindAllowlist"`
+	// IPVersionPreference orders the pod addresses in the hosts file: "4"
+	// puts IPv4 first, "6" puts IPv6 first and "dual" (default) keeps the
+	// order of the previous result
+	IPVersionPreference string `json:"ipVersionPreference"`
+	// IPVersionOnly drops the addresses of the other family if
+	// IPVersionPreference is "4" or "6"
+	IPVersionOnly bool `json:"ipVersionOnly"`
+	// ExcludeIPs are IPs or CIDRs of pod addresses which are not published,
+	// e.g. service or secondary addresses
+	ExcludeIPs []string `json:"excludeIPs"`
+	// AdvertiseAllIPs publishes all addresses of the pod (default), if false
+	// only its primary address of each family is published
+	AdvertiseAllIPs *bool `json:"advertiseAllIPs"`
+	// RequireDNSMasq fails the operations if dnsmasq is missing (default),
+	// if false they pass the pod through without DNS
+	RequireDNSMasq *bool `json:"requireDNSMasq"`
+	// Critical has a watcher process restart the dnsmasq instance of the
+	// network when it dies, instead of waiting for the next pod
+	Critical bool `json:"critical"`
+	// AllowedDomains are the domain names the network may claim, given as
+	// glob patterns, e.g. "*.tenant1.org". Any domain is allowed if unset.
+	AllowedDomains []string `json:"allowedDomains"`
+	// NegTTL is the time in seconds failed lookups are cached, clamped to
+	// maxNegTTL. dnsmasq does not cache them if unset as the replies have no
+	// TTL otherwise.
+	NegTTL int `json:"negTTL"`
+	// HardenUpstream guards the queries forwarded upstream against spoofed
+	// replies: the randomized source ports of dnsmasq can't be pinned with
+	// query-port and the concurrent queries are limited to DNSForwardMax
+	// (defaultDNSForwardMax if unset)
+	HardenUpstream bool `json:"hardenUpstream"`
+	DNSForwardMax  int  `json:"dnsForwardMax"`
+	// DNSPort is the port dnsmasq listens on, 53 if unset. The nameservers
+	// returned to the pod are given as address:port if it is customized.
+	DNSPort int `json:"dnsPort"`
+	// Reconcile makes ADD verify the instance against the files of the
+	// network and of its peers and repair them before adding the pod
+	Reconcile bool `json:"reconcile"`
+	// DisableRedirect skips the iptables rule accepting DNS queries on the
+	// network interface, for runtimes which manage the rules themselves
+	DisableRedirect bool `json:"disableRedirect"`
+	// HostsFilePrefix is prepended to the names of the hosts files of the
+	// network, so they don't clash with the files of other addn-hosts writers
+	HostsFilePrefix string `json:"hostsFilePrefix"`
+	// HostsFile is the absolute path of the hosts file with the pods of the
+	// network, the addnhosts file in the directory of the instance if unset
+	HostsFile string `json:"hostsFile"`
+	// ReverseZone is a CIDR dnsmasq synthesizes names in the domain of the
+	// network for, so reverse lookups of any pod address are answered
+	ReverseZone string `json:"reverseZone"`
+	// AddClientSubnet makes dnsmasq pass the subnet of the querying pod to the
+	// upstream servers (EDNS client subnet, add-subnet), e.g. for geo-aware
+	// upstreams. It is either ["auto"] for the dnsmasq defaults, which send
+	// the full pod address, or the IPv4 and optionally the IPv6 subnet, each a
+	// prefix length the pod address is truncated to or a fixed CIDR sent
+	// instead. Unlike plain forwarding this discloses the pod addresses to the
+	// upstream servers and anything on the path to them, so prefer short
+	// prefixes. Off if unset.
+	AddClientSubnet []string `json:"addClientSubnet"`
+	// RedirectInterfaces are the host interfaces of the previous result the
+	// iptables rule accepting DNS queries is added for, "*" selects all of
+	// them. Only the first interface of the previous result is used if unset.
+	RedirectInterfaces []string `json:"redirectInterfaces"`
+	// Nice is the nice value of the dnsmasq instance, e.g. 10 to prefer the
+	// workloads, and CPUAffinity the CPUs it is restricted to. The instance
+	// is left as started if unset.
+	Nice        int   `json:"nice"`
+	CPUAffinity []int `json:"cpuAffinity"`
+	// MaxOpenFiles limits the open files of the dnsmasq instance, the limit
+	// is left as inherited if unset
+	MaxOpenFiles int `json:"maxOpenFiles"`
+	// KeepRunning keeps the instance running when the last pod leaves, until
+	// the gc command removes it once IdleTimeout passed (never if unset)
+	KeepRunning bool     `json:"keepRunning"`
+	IdleTimeout Duration `json:"idleTimeout"`
+	// MaxInstanceLifetime makes the gc command tear the instance down once
+	// the given time passed since it was set up, even if it still has pods,
+	// e.g. for ephemeral networks whose teardown may be skipped
+	MaxInstanceLifetime Duration `json:"maxInstanceLifetime"`
+	// MaxHosts limits the entries of the hosts file of the network, one per
+	// pod address, unlimited if unset. ADD fails once it is reached, unless
+	// EvictOldestHosts drops the entries of the oldest pods to make room.
+	MaxHosts         int  `json:"maxHosts"`
+	EvictOldestHosts bool `json:"evictOldestHosts"`
+	// RunAsUser is the user dnsmasq drops its privileges to, root if unset.
+	// RunAsGroup is its group. The directory of the instance and the files
+	// dnsmasq reloads are owned by RunAsUser and readable by RunAsGroup, so
+	// the dropped dnsmasq can reload its files.
+	RunAsUser  string `json:"runAsUser"`
+	RunAsGroup string `json:"runAsGroup"`
+	// LogLevel is the level of the plugin logs written to stderr, e.g.
+	// "debug", and LogFormat their format, "text" (default) or "json" for
+	// log collectors. The logrus defaults are kept if unset.
+	LogLevel  string `json:"logLevel"`
+	LogFormat string `json:"logFormat"`
+	// NoPidFile keeps dnsmasq from writing a pidfile, for hardened hosts
+	// where the runtime directory should not hold one. The instance is found
+	// by its conf file argument among the running processes then.
+	NoPidFile bool `json:"noPidFile"`
+	// InstanceGroup makes the networks of the group share one dnsmasq
+	// instance instead of running one per network
+	InstanceGroup string `json:"instanceGroup"`
+	// IncludeConfFiles are dnsmasq conf files included by every instance,
+	// e.g. settings shared by all networks
+	IncludeConfFiles []string `json:"includeConfFiles"`
+	// AppendDomainToHosts adds the fully qualified names of the pod and of
+	// its aliases to the hosts file next to the short ones
+	AppendDomainToHosts bool `json:"appendDomainToHosts"`
+	// AliasRecords is how the aliases of a pod are served: "hosts" (default)
+	// adds them to the hosts entries of the pod, "cname" makes them CNAMEs of
+	// the pod name, so they follow the pod addresses
+	AliasRecords string `json:"aliasRecords"`
+	// SharedHostsFile is an absolute path where a world readable copy of
+	// the host mappings of the network is kept for host side tooling
+	SharedHostsFile string   `json:"sharedHostsFile"`
+	RuntimeConfig   struct { // The capability arg
+		Aliases map[string][]string `json:"aliases"`
+	} `json:"runtimeConfig,omitempty"`
+}
+
+// strictDNSNameConf is DNSNameConf with the generic CNI attributes kept raw, so
+// only the plugin specific attributes are checked for unknown fields. The
+// generic attributes (ipam, dns, prevResult...) belong to other plugins and to
+// the runtime and may carry anything.
+type strictDNSNameConf struct {
+	DNSNameConf
+	Capabilities  json.RawMessage `json:"capabilities"`
+	IPAM          json.RawMessage `json:"ipam"`
+	DNS           json.RawMessage `json:"dns"`
+	RawPrevResult json.RawMessage `json:"prevResult"`
+	RuntimeConfig json.RawMessage `json:"runtimeConfig"`
+	Args          json.RawMessage `json:"args"`
+}
+
+// checkUnknownFields rejects configurations with attributes the plugin does
+// not know, which are most likely misspelled
+func checkUnknownFields(stdin []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(stdin))
+	decoder.DisallowUnknownFields()
+	var conf strictDNSNameConf
+	if err := decoder.Decode(&conf); err != nil {
+		return errors.Wrap(err, "invalid network configuration, check the attribute names")
+	}
+	return nil
+}
+
+// validate checks the plugin specific attributes of the configuration
+func (c *DNSNameConf) validate() error {
+	if !isValidIPFamily(c.AddressFamily) {
+		return errors.Errorf("invalid address family %q", c.AddressFamily)
+	}
+	if !isValidIPFamily(c.NameserverFamily) {
+		return errors.Errorf("invalid nameserver family %q", c.NameserverFamily)
+	}
+	if c.RedirectFamily != ipFamilyDual && !isValidIPFamily(c.RedirectFamily) {
+		return errors.Errorf("invalid redirect family %q", c.RedirectFamily)
+	}
+	if c.IPVersionPreference != ipFamilyDual && !isValidIPFamily(c.IPVersionPreference) {
+		return errors.Errorf("invalid IP version preference %q", c.IPVersionPreference)
+	}
+	if c.SharedHostsFile != "" && !filepath.IsAbs(c.SharedHostsFile) {
+		return errors.Errorf("shared hosts file %q must be an absolute path", c.SharedHostsFile)
+	}
+	if c.InstanceGroup != "" {
+		if c.InstanceGroup == "." || c.InstanceGroup == ".." || strings.ContainsRune(c.InstanceGroup, '/') {
+			return errors.Errorf("invalid instance group %q", c.InstanceGroup)
+		}
+		if c.MultiDomain || c.BindInterfaceOnly {
+			return errors.New("instance group can't be combined with multiDomain or bindInterfaceOnly")
+		}
+	}
+	if c.LockDir != "" && !filepath.IsAbs(c.LockDir) {
+		return errors.Errorf("lock dir %q must be an absolute path", c.LockDir)
+	}
+	for _, file := range c.IncludeConfFiles {
+		if !filepath.IsAbs(file) {
+			return errors.Errorf("included conf file %q must be an absolute path", file)
+		}
+	}
+	if _, err := parseIPNets(c.ExcludeIPs); err != nil {
+		return err
+	}
+	for _, pattern := range c.AllowedDomains {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.Errorf("invalid allowed domain pattern %q", pattern)
+		}
+	}
+	for _, name := range []string{c.RunAsUser, c.RunAsGroup} {
+		if strings.ContainsAny(name, " \t\n,:/") {
+			return errors.Errorf("invalid user or group name %q", name)
+		}
+	}
+	if c.ServiceDomain != "" && strings.ContainsAny(c.ServiceDomain, " \t\n/") {
+		return errors.Errorf("invalid service domain %q", c.ServiceDomain)
+	}
+	if len(c.RebindAllowlist) > 0 && !c.StopDNSRebind {
+		return errors.New("rebindAllowlist requires stopDNSRebind")
+	}
+	for _, domain := range c.RebindAllowlist {
+		if domain == "" || strings.ContainsAny(domain, " \t\n/") {
+			return errors.Errorf("invalid rebind allowlist domain %q", domain)
+		}
+	}
+	if c.InterfaceName != "" {
+		if strings.ContainsAny(c.InterfaceName, " \t\n,/.") {
+			return errors.Errorf("invalid interface name host %q", c.InterfaceName)
+		}
+		if c.InstanceGroup != "" {
+			return errors.New("interfaceName can't be combined with instanceGroup")
+		}
+	}
+	if c.LogLevel != "" {
+		if _, err := logrus.ParseLevel(c.LogLevel); err != nil {
+			return err
+		}
+	}
+	if c.LogFormat != "" && c.LogFormat != logFormatText && c.LogFormat != logFormatJSON {
+		return errors.Errorf("invalid log format %q, want %q or %q", c.LogFormat, logFormatText, logFormatJSON)
+	}
+	if c.MaxHosts < 0 {
+		return errors.Errorf("invalid negative hosts limit %d", c.MaxHosts)
+	}
+	if c.NegTTL < 0 {
+		return errors.Errorf("invalid negative cache TTL %d", c.NegTTL)
+	}
+	if c.HostsFilePrefix != "" && (c.HostsFilePrefix == "." || c.HostsFilePrefix == ".." ||
+		strings.ContainsAny(c.HostsFilePrefix, "/\n")) {
+		return errors.Errorf("invalid hosts file prefix %q", c.HostsFilePrefix)
+	}
+	if c.HostsFile != "" {
+		if !filepath.IsAbs(c.HostsFile) || strings.ContainsRune(c.HostsFile, '\n') {
+			return errors.Errorf("invalid hosts file %q, it must be an absolute path", c.HostsFile)
+		}
+		if c.InstanceGroup != "" {
+			return errors.New("hostsFile can't be combined with instanceGroup")
+		}
+	}
+	if len(c.DomainServers) > 0 && !c.MultiDomain {
+		return errors.New("domainServers requires multiDomain")
+	}
+	for domain, servers := range c.DomainServers {
+		if domain == "" || strings.ContainsAny(domain, " \t\n/") || normalizeDomain(domain) == normalizeDomain(c.DomainName) {
+			return errors.Errorf("invalid delegated domain %q", domain)
+		}
+		if len(servers) == 0 {
+			return errors.Errorf("no servers for the delegated domain %q", domain)
+		}
+		for _, server := range servers {
+			if server == "" || strings.ContainsAny(server, " \t\n/") {
+				return errors.Errorf("invalid server %q of the delegated domain %q", server, domain)
+			}
+		}
+	}
+	if c.Critical && c.InstanceGroup != "" {
+		return errors.New("critical can't be combined with instanceGroup")
+	}
+	switch c.AliasRecords {
+	case "", aliasRecordsHosts:
+	case aliasRecordsCNAME:
+		if c.InstanceGroup != "" || c.ForwardOnly {
+			return errors.New("cname alias records can't be combined with instanceGroup or forwardOnly")
+		}
+	default:
+		return errors.Errorf("invalid alias records %q, want %q or %q", c.AliasRecords, aliasRecordsHosts, aliasRecordsCNAME)
+	}
+	if c.Isolated && (len(c.RemoteServers) > 0 || c.ForwardOnly) {
+		return errors.New("isolated can't be combined with remoteServers or forwardOnly")
+	}
+	if c.ForwardOnly {
+		if c.MultiDomain || c.InstanceGroup != "" || c.ReverseZone != "" {
+			return errors.New("forwardOnly can't be combined with multiDomain, instanceGroup or reverseZone")
+		}
+		if len(c.RemoteServers) == 0 {
+			return errors.New("forwardOnly requires remoteServers to forward the domain to")
+		}
+		for _, server := range c.RemoteServers {
+			if strings.Contains(server, "/") {
+				return errors.Errorf("invalid remote server %q with forwardOnly, want an address", server)
+			}
+		}
+	}
+	if c.ReverseZone != "" {
+		if _, _, err := net.ParseCIDR(c.ReverseZone); err != nil {
+			return errors.Wrapf(err, "invalid reverse zone %q", c.ReverseZone)
+		}
+		if c.InstanceGroup != "" {
+			return errors.New("reverse zone can't be combined with instanceGroup")
+		}
+	}
+	if err := validateClientSubnet(c.AddClientSubnet); err != nil {
+		return err
+	}
+	if c.ReloadTimeout.Duration < 0 {
+		return errors.Errorf("invalid negative reload timeout %s", c.ReloadTimeout)
+	}
+	if c.ReloadWindow.Duration < 0 {
+		return errors.Errorf("invalid negative reload window %s", c.ReloadWindow)
+	}
+	if c.ReloadMaxBatch < 0 {
+		return errors.Errorf("invalid negative reload max batch %d", c.ReloadMaxBatch)
+	}
+	if c.ReloadMaxBatch > 0 && c.ReloadWindow.Duration == 0 {
+		return errors.New("reloadMaxBatch requires reloadWindow")
+	}
+	if c.ReloadWindow.Duration > 0 {
+		// the pod is only served once the window quiesces
+		if c.ReloadTimeout.Duration > 0 {
+			return errors.New("reloadWindow can't be combined with reloadTimeout")
+		}
+		if c.InstanceGroup != "" {
+			return errors.New("reloadWindow can't be combined with instanceGroup")
+		}
+	}
+	if c.IdleTimeout.Duration < 0 {
+		return errors.Errorf("invalid negative idle timeout %s", c.IdleTimeout)
+	}
+	if c.MaxInstanceLifetime.Duration < 0 {
+		return errors.Errorf("invalid negative max instance lifetime %s", c.MaxInstanceLifetime)
+	}
+	if c.MaxInstanceLifetime.Duration > 0 && c.InstanceGroup != "" {
+		return errors.New("maxInstanceLifetime can't be combined with instanceGroup")
+	}
+	if c.DNSForwardMax < 0 {
+		return errors.Errorf("invalid negative DNS forward max %d", c.DNSForwardMax)
+	}
+	if c.HardenUpstream {
+		for _, option := range c.ExtraDnsmasqOptions {
+			if strings.HasPrefix(strings.TrimSpace(option), "query-port") {
+				return errors.Errorf("extra dnsmasq option %q pins the source port of the queries, which hardenUpstream forbids", option)
+			}
+		}
+	}
+	if c.Nice < -20 || c.Nice > 19 {
+		return errors.Errorf("invalid nice value %d, it must be between -20 and 19", c.Nice)
+	}
+	if c.MaxOpenFiles != 0 && c.MaxOpenFiles < minMaxOpenFiles {
+		return errors.Errorf("invalid open files limit %d, it must be at least %d", c.MaxOpenFiles, minMaxOpenFiles)
+	}
+	for _, cpu := range c.CPUAffinity {
+		if cpu < 0 || cpu >= maxCPUs {
+			return errors.Errorf("invalid CPU %d in CPU affinity", cpu)
+		}
+	}
+	if c.DNSPort < 0 || c.DNSPort > 65535 {
+		return errors.Errorf("invalid DNS port %d", c.DNSPort)
+	}
+	if c.DNSSEC {
+		if _, err := c.trustAnchorsFile(); err != nil {
+			return err
+		}
+	}
+	for _, option := range c.ExtraDnsmasqOptions {
+		if strings.TrimSpace(option) == "" || strings.ContainsAny(option, "\r\n") {
+			return errors.Errorf("invalid extra dnsmasq option %q, it must be a single non empty line", option)
+		}
+	}
+	for _, nameserver := range c.FallbackNameservers {
+		if net.ParseIP(nameserver) == nil {
+			return errors.Errorf("invalid fallback nameserver %q, it must be an IP address", nameserver)
+		}
+	}
+	if len(c.FallbackNameservers) > 0 && c.SuppressNameservers {
+		return errors.New("fallbackNameservers can't be combined with suppressNameservers")
+	}
+	for _, alias := range c.HostAliases {
+		if net.ParseIP(alias.IP) == nil {
+			return errors.Errorf("invalid host alias IP %q", alias.IP)
+		}
+		if len(alias.Names) == 0 {
+			return errors.Errorf("host alias %s has no names", alias.IP)
+		}
+	}
+	return nil
+}
+
+// trustAnchorsFile returns the dnsmasq conf file with the DNSSEC trust anchors
+func (c *DNSNameConf) trustAnchorsFile() (string, error) {
+	candidates := defaultTrustAnchorsFiles
+	if c.DNSSECTrustAnchors != "" {
+		candidates = []string{c.DNSSECTrustAnchors}
+	}
+	for _, candidate := range candidates {
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, nil
+		}
+	}
+	return "", errors.Errorf("DNSSEC requires a trust anchors file, none of %v found", candidates)
+}
+
+// checkIncludeConfFiles checks that the included conf files exist, dnsmasq
+// would not start otherwise
+func (c *DNSNameConf) checkIncludeConfFiles() error {
+	for _, file := range c.IncludeConfFiles {
+		if _, err := os.Stat(file); err != nil {
+			return errors.Wrap(err, "included conf file is not available")
+		}
+	}
+	return nil
+}
+
+// ConfigureLogging applies the log level and format of the network
+// configuration to the global logger. The plugin binary calls it before the
+// commands, the commands leave the logger of an embedding process alone.
+func ConfigureLogging(stdin []byte) {
+	var conf DNSNameConf
+	if err := json.Unmarshal(stdin, &conf); err != nil {
+		// the command reports the invalid configuration
+		return
+	}
+	conf.configureLogging()
+}
+
+// configureLogging applies the log level and format of the configuration to
+// the logs of the plugin, from then on
+func (c *DNSNameConf) configureLogging() {
+	if level, err := logrus.ParseLevel(c.LogLevel); err == nil {
+		logrus.SetLevel(level)
+	}
+	switch c.LogFormat {
+	case logFormatJSON:
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	case logFormatText:
+		logrus.SetFormatter(&logrus.TextFormatter{})
+	}
+}
+
+// checkDomainAllowed checks that the network may claim its domain name,
+// domain names are compared case insensitively and without trailing dot
+func (c *DNSNameConf) checkDomainAllowed() error {
+	if len(c.AllowedDomains) == 0 {
+		return nil
+	}
+	domainName := normalizeDomain(c.DomainName)
+	for _, pattern := range c.AllowedDomains {
+		if ok, _ := path.Match(normalizeDomain(pattern), domainName); ok {
+			return nil
+		}
+	}
+	return errors.Wrapf(ErrDomainNotAllowed, "network %s may not claim %s", c.Name, c.DomainName)
+}
+
+// instanceName returns the name of the dnsmasq instance serving the network
+func (c *DNSNameConf) instanceName() string {
+	if c.InstanceGroup != "" {
+		return groupInstanceName(c.InstanceGroup)
+	}
+	return c.Name
+}
+
+// advertiseAllIPs returns whether all addresses of a pod are published, the default
+func (c *DNSNameConf) advertiseAllIPs() bool {
+	return c.AdvertiseAllIPs == nil || *c.AdvertiseAllIPs
+}
+
+// requireDNSMasq returns whether a missing dnsmasq fails the operations, the default
+func (c *DNSNameConf) requireDNSMasq() bool {
+	return c.RequireDNSMasq == nil || *c.RequireDNSMasq
+}
+
+// negTTL returns the negative cache TTL clamped to maxNegTTL
+func (c *DNSNameConf) negTTL() int {
+	if c.NegTTL > maxNegTTL {
+		return maxNegTTL
+	}
+	return c.NegTTL
+}
+
+// dnsForwardMax returns the limit of concurrent forwarded queries, 0 keeps
+// the dnsmasq default
+func (c *DNSNameConf) dnsForwardMax() int {
+	if c.HardenUpstream && c.DNSForwardMax == 0 {
+		return defaultDNSForwardMax
+	}
+	return c.DNSForwardMax
+}
+
+// validateClientSubnet checks the add-subnet specs: "auto" alone, or an IPv4
+// and an optional IPv6 spec, each a prefix length or a CIDR of the family
+func validateClientSubnet(specs []string) error {
+	if len(specs) == 1 && specs[0] == clientSubnetAuto {
+		return nil
+	}
+	if len(specs) > 2 {
+		return errors.Errorf("invalid client subnet %v, at most an IPv4 and an IPv6 subnet are allowed", specs)
+	}
+	for i, spec := range specs {
+		bits := net.IPv4len * 8
+		if i == 1 {
+			bits = net.IPv6len * 8
+		}
+		if length, err := strconv.Atoi(spec); err == nil {
+			if length < 0 || length > bits {
+				return errors.Errorf("invalid client subnet prefix length %d", length)
+			}
+			continue
+		}
+		ip, _, err := net.ParseCIDR(spec)
+		if err != nil || (ip.To4() != nil) != (i == 0) {
+			return errors.Errorf("invalid client subnet %q, want the IPv4 then the IPv6 subnet", spec)
+		}
+	}
+	return nil
+}
+
+// addSubnet returns the add-subnet directive, empty if disabled
+func (c *DNSNameConf) addSubnet() string {
+	switch {
+	case len(c.AddClientSubnet) == 0:
+		return ""
+	case c.AddClientSubnet[0] == clientSubnetAuto:
+		return "add-subnet"
+	}
+	return "add-subnet=" + strings.Join(c.AddClientSubnet, ",")
+}
+
+// rebindDomainOK returns the rebind-domain-ok directive, empty if no domain is
+// exempt from the rebind protection. Forwarded domains are exempt, their
+// servers are expected to answer with private addresses.
+func (c *DNSNameConf) rebindDomainOK() string {
+	domains := c.RebindAllowlist
+	if c.ForwardOnly {
+		domains = append([]string{c.DomainName}, domains...)
+	}
+	if !c.StopDNSRebind || len(domains) == 0 {
+		return ""
+	}
+	return "rebind-domain-ok=/" + strings.Join(domains, "/") + "/"
+}
+
+// dnsPort returns the port dnsmasq listens on, 0 means the default one
+func (c *DNSNameConf) dnsPort() int {
+	if c.DNSPort == defaultDNSPort {
+		return 0
+	}
+	return c.DNSPort
+}
+
+// commandTimeout returns the time limit for external commands
+func (c *DNSNameConf) commandTimeout() time.Duration {
+	if c.CommandTimeout.Duration <= 0 {
+		return defaultCommandTimeout
+	}
+	return c.CommandTimeout.Duration
+}
+
+// lockTimeout returns the time limit for acquiring the locks
+func (c *DNSNameConf) lockTimeout() time.Duration {
+	if c.LockTimeout.Duration <= 0 {
+		return defaultLockTimeout
+	}
+	return c.LockTimeout.Duration
+}
+
+// lockPollInterval returns the interval the locks are polled in
+func (c *DNSNameConf) lockPollInterval() time.Duration {
+	if c.LockPollInterval.Duration <= 0 {
+		return defaultLockPollInterval
+	}
+	return c.LockPollInterval.Duration
+}
+
+// Duration is a time.Duration represented in JSON as a string like "1m30s"
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalJSON parses the duration from a JSON string
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return errors.Wrap(err, "duration must be a string like \"10s\"")
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
+
+// MarshalJSON formats the duration as a JSON string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// isValidIPFamily checks that the family is either empty or one of the IP families
+func isValidIPFamily(family string) bool {
+	return family == "" || family == ipFamilyV4 || family == ipFamilyV6
+}
+
+// HostAlias is a static name to IP mapping added to every instance of the network
+type HostAlias struct {
+	IP    string   `json:"ip"`
+	Names []string `json:"names"`
+}
+
+// dnsNameFile describes the plugin's attributes
+type dnsNameFile struct {
+	AddOnHostsFile       string
+	Binary               string
+	ConfigFile           string
+	InstanceDir          string
+	Domain               string
+	NetworkInterface     string
+	PidFile              string
+	LocalServersConfFile string
+	OwnServersConfFile   string
+	DomainServers        map[string][]string
+	StaticHostsFile      string
+	CNAMEFile            string
+	CNAMEAliases         bool
+	MDNSGuard            bool
+	HostAliases          []HostAlias
+	AddressFamily        string
+	ForceUpstreamTCP     bool
+	Isolated             bool
+	DNSSEC               bool
+	DNSSECCheckUnsigned  bool
+	TrustAnchorsFile     string
+	ExtraOptions         []string
+	IncludeConfFiles     []string
+	ValidateConfig       bool
+	BindInterfaceOnly    bool
+	ListenAddresses      []string
+	InterfaceName        string
+	ServiceDomain        string
+	NegTTL               int
+	StopDNSRebind        bool
+	RebindDomainOK       string
+	DNSForwardMax        int
+	Nice                 int
+	CPUAffinity          []int
+	MaxOpenFiles         int
+	DNSPort              int
+	ReverseZone          string
+	ForwardOnly          bool
+	ForwardServers       []string
+	AddSubnet            string
+	SharedHostsFile      string
+	AppendDomainToHosts  bool
+	DisableRedirect      bool
+	RedirectInterfaces   []string
+	RedirectFamily       string
+	KeepRunning          bool
+	NoPidFile            bool
+	RunAsUser            string
+	RunAsGroup           string
+	MaxHosts             int
+	EvictOldestHosts     bool
+	IdleTimeout          Duration
+	MaxInstanceLifetime  Duration
+	ReloadWindow         Duration
+	ReloadMaxBatch       int
+	LockDir              string
+	// Group is the instance group of the network, the group instance
+	// serves the Members and reads their hosts files from HostsDir
+	Group    string
+	Network  string
+	HostsDir string
+	Members  []groupMember
+	// procManager launches and signals the dnsmasq processes, nil means real processes
+	procManager processManager
+}
+
+// redirectInterfaces returns the interfaces the DNS queries are accepted on,
+// the network interface if none were set
+func (d dnsNameFile) redirectInterfaces() []string {
+	if len(d.RedirectInterfaces) == 0 {
+		return []string{d.NetworkInterface}
+	}
+	return d.RedirectInterfaces
+}
+
+// ruleComment returns the comment of the redirect rules of the instance,
+// naming the plugin and the network, or the group, of the instance
+func (d dnsNameFile) ruleComment() string {
+	return "dnsname:" + filepath.Base(d.InstanceDir)
+}
+
+// redirectProtocols returns the iptables protocols the DNS queries are
+// accepted for, IPv4 only if RedirectFamily is unset
+func (d dnsNameFile) redirectProtocols() []iptables.Protocol {
+	switch d.RedirectFamily {
+	case ipFamilyV6:
+		return []iptables.Protocol{iptables.ProtocolIPv6}
+	case ipFamilyDual:
+		return []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6}
+	}
+	return []iptables.Protocol{iptables.ProtocolIPv4}
+}
+
+// dnsNameConfPath tells where we store the conf, pid, and hosts files
+func dnsNameConfPath() string {
+	xdgRuntimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if xdgRuntimeDir != "" {
+		return filepath.Join(xdgRuntimeDir, "containers/cni/dnsname")
+	}
+	return "/run/containers/cni/dnsname"
+}
@@ -0,0 +1,482 @@
+package dnsname
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/sirupsen/logrus"
+)
+
+func TestValidateDNSSEC(t *testing.T) {
+	trustAnchors := filepath.Join(t.TempDir(), "trust-anchors.conf")
+	if err := ioutil.WriteFile(trustAnchors, []byte("trust-anchor=.,20326,8,2,E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D\n"), 0o644); err != nil {
+		t.Fatalf("Can't write trust anchors: %v", err)
+	}
+	conf := DNSNameConf{DNSSEC: true, DNSSECTrustAnchors: trustAnchors}
+	if err := conf.validate(); err != nil {
+		t.Fatalf("Valid DNSSEC config rejected: %v", err)
+	}
+	var d dnsNameFile
+	d.setConfig(&conf)
+	if !d.DNSSEC || d.TrustAnchorsFile != trustAnchors {
+		t.Errorf("DNSSEC not applied, got DNSSEC %v trust anchors %q", d.DNSSEC, d.TrustAnchorsFile)
+	}
+	conf.DNSSECTrustAnchors = filepath.Join(t.TempDir(), "missing.conf")
+	if err := conf.validate(); err == nil {
+		t.Error("DNSSEC without trust anchors should be rejected")
+	}
+	conf.DNSSEC = false
+	if err := conf.validate(); err != nil {
+		t.Errorf("Trust anchors should not be checked without DNSSEC: %v", err)
+	}
+}
+
+func TestValidateExtraDnsmasqOptions(t *testing.T) {
+	conf := DNSNameConf{ExtraDnsmasqOptions: []string{"domain-needed", "stop-dns-rebind"}}
+	if err := conf.validate(); err != nil {
+		t.Fatalf("Valid options rejected: %v", err)
+	}
+	for _, option := range []string{"", " ", "bogus-priv\naddress=/#/1.2.3.4"} {
+		conf.ExtraDnsmasqOptions = []string{option}
+		if err := conf.validate(); err == nil {
+			t.Errorf("Option %q should be rejected", option)
+		}
+	}
+}
+
+func TestValidateNegTTL(t *testing.T) {
+	tests := []struct {
+		negTTL  int
+		want    int
+		wantErr bool
+	}{
+		{0, 0, false},
+		{30, 30, false},
+		{maxNegTTL + 1, maxNegTTL, false},
+		{-1, 0, true},
+	}
+	for _, tt := range tests {
+		conf := DNSNameConf{NegTTL: tt.negTTL}
+		if err := conf.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		var d dnsNameFile
+		d.setConfig(&conf)
+		if d.NegTTL != tt.want {
+			t.Errorf("setConfig() got = '%v', want '%v'", d.NegTTL, tt.want)
+		}
+	}
+}
+
+func TestValidateDNSPort(t *testing.T) {
+	tests := []struct {
+		dnsPort int
+		want    int
+		wantErr bool
+	}{
+		{0, 0, false},
+		{defaultDNSPort, 0, false},
+		{5353, 5353, false},
+		{-1, 0, true},
+		{65536, 0, true},
+	}
+	for _, tt := range tests {
+		conf := DNSNameConf{DNSPort: tt.dnsPort}
+		if err := conf.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		var d dnsNameFile
+		d.setConfig(&conf)
+		if d.DNSPort != tt.want {
+			t.Errorf("setConfig() got = '%v', want '%v'", d.DNSPort, tt.want)
+		}
+	}
+}
+
+func TestHardenUpstream(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    DNSNameConf
+		want    int
+		wantErr bool
+	}{
+		{"unset", DNSNameConf{}, 0, false},
+		{"default forward max", DNSNameConf{HardenUpstream: true}, defaultDNSForwardMax, false},
+		{"forward max", DNSNameConf{HardenUpstream: true, DNSForwardMax: 50}, 50, false},
+		{"negative forward max", DNSNameConf{DNSForwardMax: -1}, 0, true},
+		{"pinned port", DNSNameConf{HardenUpstream: true, ExtraDnsmasqOptions: []string{"query-port=5353"}}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.conf.validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := tt.conf.dnsForwardMax(); !tt.wantErr && got != tt.want {
+				t.Errorf("dnsForwardMax() got = '%v', want '%v'", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateReverseZone(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    DNSNameConf
+		wantErr bool
+	}{
+		{"unset", DNSNameConf{}, false},
+		{"ipv4", DNSNameConf{ReverseZone: "10.88.0.0/16"}, false},
+		{"ipv6", DNSNameConf{ReverseZone: "fd00::/64"}, false},
+		{"no prefix length", DNSNameConf{ReverseZone: "10.88.0.0"}, true},
+		{"instance group", DNSNameConf{ReverseZone: "10.88.0.0/16", InstanceGroup: "shared"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.conf.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHostsFilePrefix(t *testing.T) {
+	for _, prefix := range []string{"..", "a/b", "a\nb"} {
+		conf := DNSNameConf{HostsFilePrefix: prefix}
+		if err := conf.validate(); err == nil {
+			t.Errorf("validate() should fail for prefix %q", prefix)
+		}
+	}
+	conf := DNSNameConf{HostsFilePrefix: "dnsname-"}
+	conf.Name = "net1"
+	if err := conf.validate(); err != nil {
+		t.Fatalf("validate() error = %v", err)
+	}
+	var d dnsNameFile
+	d.setConfig(&conf)
+	if want := makePath("net1", "dnsname-addnhosts"); d.AddOnHostsFile != want {
+		t.Errorf("setConfig() got = '%v', want '%v'", d.AddOnHostsFile, want)
+	}
+	if want := makePath("net1", "dnsname-staticaddnhosts"); d.StaticHostsFile != want {
+		t.Errorf("setConfig() got = '%v', want '%v'", d.StaticHostsFile, want)
+	}
+}
+
+func TestHostsFile(t *testing.T) {
+	for _, conf := range []DNSNameConf{{HostsFile: "hosts"}, {HostsFile: "/var/lib/hosts", InstanceGroup: "shared"}} {
+		if err := conf.validate(); err == nil {
+			t.Errorf("validate() should fail for %+v", conf)
+		}
+	}
+	conf := DNSNameConf{HostsFile: "/var/lib/dnsname/net1.hosts", HostsFilePrefix: "dnsname-"}
+	conf.Name = "net1"
+	if err := conf.validate(); err != nil {
+		t.Fatalf("validate() error = %v", err)
+	}
+	var d dnsNameFile
+	d.setConfig(&conf)
+	if d.AddOnHostsFile != conf.HostsFile {
+		t.Errorf("setConfig() got = '%v', want '%v'", d.AddOnHostsFile, conf.HostsFile)
+	}
+	// the static hosts stay with the instance
+	if want := makePath("net1", "dnsname-staticaddnhosts"); d.StaticHostsFile != want {
+		t.Errorf("setConfig() got = '%v', want '%v'", d.StaticHostsFile, want)
+	}
+}
+
+func TestCheckDomainAllowed(t *testing.T) {
+	tests := []struct {
+		domain  string
+		allowed []string
+		wantErr bool
+	}{
+		{"foobar.io", nil, false},
+		{"foobar.io", []string{"foobar.io"}, false},
+		{"FooBar.io.", []string{"foobar.io"}, false},
+		{"app.tenant1.org", []string{"foobar.io", "*.tenant1.org"}, false},
+		{"app.tenant2.org", []string{"*.tenant1.org"}, true},
+		{"tenant1.org", []string{"*.tenant1.org"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			conf := DNSNameConf{DomainName: tt.domain, AllowedDomains: tt.allowed}
+			if err := conf.validate(); err != nil {
+				t.Fatalf("validate() error = %v", err)
+			}
+			err := conf.checkDomainAllowed()
+			if (err != nil) != tt.wantErr || (err != nil && !errors.Is(err, ErrDomainNotAllowed)) {
+				t.Errorf("checkDomainAllowed() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+	conf := DNSNameConf{AllowedDomains: []string{"[a-"}}
+	if err := conf.validate(); err == nil {
+		t.Error("validate() should fail for an invalid pattern")
+	}
+}
+
+func TestAddClientSubnet(t *testing.T) {
+	tests := []struct {
+		specs   []string
+		want    string
+		wantErr bool
+	}{
+		{nil, "", false},
+		{[]string{"auto"}, "add-subnet", false},
+		{[]string{"24"}, "add-subnet=24", false},
+		{[]string{"24", "56"}, "add-subnet=24,56", false},
+		{[]string{"192.0.2.0/24", "2001:db8::/56"}, "add-subnet=192.0.2.0/24,2001:db8::/56", false},
+		{[]string{"33"}, "", true},
+		{[]string{"24", "129"}, "", true},
+		{[]string{"2001:db8::/56"}, "", true},
+		{[]string{"auto", "56"}, "", true},
+		{[]string{"24", "56", "56"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.specs, ","), func(t *testing.T) {
+			conf := DNSNameConf{AddClientSubnet: tt.specs}
+			if err := conf.validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := conf.addSubnet(); !tt.wantErr && got != tt.want {
+				t.Errorf("addSubnet() got = '%v', want '%v'", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateForwardOnly(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    DNSNameConf
+		wantErr bool
+	}{
+		{"valid", DNSNameConf{ForwardOnly: true, RemoteServers: []string{"10.10.0.1", "10.10.0.2#5353"}}, false},
+		{"no servers", DNSNameConf{ForwardOnly: true}, true},
+		{"domain server", DNSNameConf{ForwardOnly: true, RemoteServers: []string{"/foo.org/10.10.0.1"}}, true},
+		{"multi domain", DNSNameConf{ForwardOnly: true, MultiDomain: true, RemoteServers: []string{"10.10.0.1"}}, true},
+		{"group", DNSNameConf{ForwardOnly: true, InstanceGroup: "shared", RemoteServers: []string{"10.10.0.1"}}, true},
+		{"isolated", DNSNameConf{ForwardOnly: true, Isolated: true, RemoteServers: []string{"10.10.0.1"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.conf.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateIsolated(t *testing.T) {
+	if err := (&DNSNameConf{Isolated: true, MultiDomain: true}).validate(); err != nil {
+		t.Errorf("validate() error = %v", err)
+	}
+	if err := (&DNSNameConf{Isolated: true, RemoteServers: []string{"10.10.0.1"}}).validate(); err == nil {
+		t.Error("validate() should fail for isolated with remote servers")
+	}
+}
+
+func TestValidateAliasRecords(t *testing.T) {
+	if err := (&DNSNameConf{AliasRecords: aliasRecordsCNAME, MultiDomain: true}).validate(); err != nil {
+		t.Errorf("validate() error = %v", err)
+	}
+	if err := (&DNSNameConf{AliasRecords: aliasRecordsCNAME, InstanceGroup: "shared"}).validate(); err == nil {
+		t.Error("validate() should fail for cname alias records with an instance group")
+	}
+	if err := (&DNSNameConf{AliasRecords: "srv"}).validate(); err == nil {
+		t.Error("validate() should fail for unknown alias records")
+	}
+}
+
+func TestValidateDomainServers(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    DNSNameConf
+		wantErr bool
+	}{
+		{"valid", DNSNameConf{DomainName: "net1", MultiDomain: true,
+			DomainServers: map[string][]string{"corp.example": {"10.10.0.1", "10.10.0.2#5353"}}}, false},
+		{"single domain", DNSNameConf{DomainName: "net1",
+			DomainServers: map[string][]string{"corp.example": {"10.10.0.1"}}}, true},
+		{"own domain", DNSNameConf{DomainName: "net1", MultiDomain: true,
+			DomainServers: map[string][]string{"NET1.": {"10.10.0.1"}}}, true},
+		{"no servers", DNSNameConf{DomainName: "net1", MultiDomain: true,
+			DomainServers: map[string][]string{"corp.example": {}}}, true},
+		{"invalid server", DNSNameConf{DomainName: "net1", MultiDomain: true,
+			DomainServers: map[string][]string{"corp.example": {"/foo/10.10.0.1"}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.conf.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateReloadWindow(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    DNSNameConf
+		wantErr bool
+	}{
+		{"valid", DNSNameConf{ReloadWindow: Duration{time.Second}, ReloadMaxBatch: 20}, false},
+		{"negative window", DNSNameConf{ReloadWindow: Duration{-time.Second}}, true},
+		{"batch without window", DNSNameConf{ReloadMaxBatch: 20}, true},
+		{"reload timeout", DNSNameConf{ReloadWindow: Duration{time.Second}, ReloadTimeout: Duration{time.Second}}, true},
+		{"group", DNSNameConf{ReloadWindow: Duration{time.Second}, InstanceGroup: "shared"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.conf.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateFallbackNameservers(t *testing.T) {
+	if err := (&DNSNameConf{FallbackNameservers: []string{"192.168.1.1", "fd00::1"}}).validate(); err != nil {
+		t.Errorf("validate() error = %v", err)
+	}
+	if err := (&DNSNameConf{FallbackNameservers: []string{"192.168.1.1:53"}}).validate(); err == nil {
+		t.Error("validate() should fail for a fallback nameserver which is not an IP address")
+	}
+	if err := (&DNSNameConf{FallbackNameservers: []string{"192.168.1.1"}, SuppressNameservers: true}).validate(); err == nil {
+		t.Error("validate() should fail for fallback nameservers with suppressed nameservers")
+	}
+}
+
+func TestStopDNSRebind(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    DNSNameConf
+		want    string
+		wantErr bool
+	}{
+		{"disabled", DNSNameConf{}, "", false},
+		{"no allowlist", DNSNameConf{StopDNSRebind: true}, "", false},
+		{"allowlist", DNSNameConf{StopDNSRebind: true, RebindAllowlist: []string{"corp.example", "lan"}},
+			"rebind-domain-ok=/corp.example/lan/", false},
+		{"forward only", DNSNameConf{StopDNSRebind: true, ForwardOnly: true, DomainName: "foo.org",
+			RemoteServers: []string{"10.10.0.1"}}, "rebind-domain-ok=/foo.org/", false},
+		{"allowlist without protection", DNSNameConf{RebindAllowlist: []string{"lan"}}, "", true},
+		{"invalid domain", DNSNameConf{StopDNSRebind: true, RebindAllowlist: []string{"corp/lan"}}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.conf.validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := tt.conf.rebindDomainOK(); !tt.wantErr && got != tt.want {
+				t.Errorf("rebindDomainOK() got = '%v', want '%v'", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigureLogging(t *testing.T) {
+	for _, conf := range []DNSNameConf{{LogLevel: "verbose"}, {LogFormat: "xml"}} {
+		if err := conf.validate(); err == nil {
+			t.Errorf("validate() should fail for %+v", conf)
+		}
+	}
+	var buf bytes.Buffer
+	logrus.SetOutput(&buf)
+	t.Cleanup(func() {
+		logrus.SetOutput(os.Stderr)
+		logrus.SetFormatter(&logrus.TextFormatter{})
+		logrus.SetLevel(logrus.InfoLevel)
+	})
+	ConfigureLogging([]byte(`{"cniVersion": "1.0.0", "name": "net1", "logLevel": "warn", "logFormat": "json"}`))
+	logrus.Infof("filtered")
+	logrus.Errorf("unable to release lock for %q: %v", "net1", "failed")
+	var entry map[string]string
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("Log is not a JSON object: %v, got '%s'", err, buf.String())
+	}
+	if entry["level"] != "error" || entry["msg"] != `unable to release lock for "net1": failed` {
+		t.Errorf("ConfigureLogging() got = '%v'", entry)
+	}
+}
+
+func TestCommandsKeepLogger(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	level := logrus.GetLevel()
+	args := &skel.CmdArgs{StdinData: []byte(`{"cniVersion": "1.0.0", "name": "net1", "type": "dnsname",
+		"domainName": "net1.org", "logLevel": "debug"}`)}
+	// without dnsmasq it fails once the configuration is parsed
+	if err := Check(args); !errors.Is(err, ErrBinaryNotFound) {
+		t.Fatalf("Check() error = %v, want %v", err, ErrBinaryNotFound)
+	}
+	// the logger belongs to the embedding process
+	if got := logrus.GetLevel(); got != level {
+		t.Errorf("Check() changed the log level to %v, want %v", got, level)
+	}
+}
+
+func TestCheckUnknownFields(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    string
+		wantErr bool
+	}{
+		{"known", `{"cniVersion": "1.0.0", "name": "test", "type": "dnsname", "domainName": "foobar.io",
+			"remoteServers": ["8.8.8.8"], "hostAliases": [{"ip": "10.88.0.1", "names": ["gw"]}]}`, false},
+		{"generic attributes", `{"cniVersion": "1.0.0", "name": "test", "type": "dnsname", "domainName": "foobar.io",
+			"ipam": {"type": "host-local", "subnet": "10.88.0.0/16"}, "dns": {"nameservers": ["10.88.0.1"]},
+			"capabilities": {"aliases": true}, "runtimeConfig": {"aliases": {"test": ["web"]}, "portMappings": []},
+			"args": {"cni": {"ips": ["10.88.0.2"]}}, "prevResult": {"cniVersion": "1.0.0", "custom": 1}}`, false},
+		{"misspelled", `{"cniVersion": "1.0.0", "name": "test", "type": "dnsname", "remoteServer": ["8.8.8.8"]}`, true},
+		{"misspelled nested", `{"cniVersion": "1.0.0", "name": "test", "type": "dnsname",
+			"hostAliases": [{"ipp": "10.88.0.1", "names": ["gw"]}]}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkUnknownFields([]byte(tt.conf))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkUnknownFields() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), "remoteServer") && !strings.Contains(err.Error(), "ipp") {
+				t.Errorf("checkUnknownFields() error %q should name the field", err)
+			}
+		})
+	}
+}
+
+func TestIncludeConfFiles(t *testing.T) {
+	includeFile := filepath.Join(t.TempDir(), "org.conf")
+	conf := DNSNameConf{IncludeConfFiles: []string{includeFile}}
+	if err := conf.validate(); err != nil {
+		t.Fatalf("Valid config rejected: %v", err)
+	}
+	if err := conf.checkIncludeConfFiles(); err == nil {
+		t.Error("Missing include file should be rejected")
+	}
+	if err := ioutil.WriteFile(includeFile, []byte("stop-dns-rebind\n"), 0o644); err != nil {
+		t.Fatalf("Can't write include file: %v", err)
+	}
+	if err := conf.checkIncludeConfFiles(); err != nil {
+		t.Errorf("Existing include file rejected: %v", err)
+	}
+	conf.IncludeConfFiles = []string{"org.conf"}
+	if err := conf.validate(); err == nil {
+		t.Error("Relative include file should be rejected")
+	}
+}
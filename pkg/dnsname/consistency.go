@@ -0,0 +1,289 @@
+package dnsname
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// consistencyTimeout limits the time the queries of the consistency check may take
+	consistencyTimeout = 10 * time.Second
+	// clockTicks is the unit of the process start time in /proc, USER_HZ is
+	// 100 on all architectures Linux exports to user space
+	clockTicks = 100
+)
+
+// checkConsistency compares the files of the instance of the network with
+// what its running dnsmasq serves and returns the discrepancies found. The
+// hosts and server files are reloaded on SIGHUP, so they are checked by
+// querying the instance, while a conf file changed after the start of the
+// instance is only applied by a restart.
+func checkConsistency(ctx context.Context, networkName string) ([]string, error) {
+	conf, _, err := loadInstance(networkName)
+	if err != nil {
+		return nil, err
+	}
+	isRunning, pid := conf.isRunning()
+	if !isRunning {
+		return []string{fmt.Sprintf("dnsmasq instance of %s is not running", networkName)}, nil
+	}
+	var issues []string
+	if started, err := processStartTime(pid); err != nil {
+		logrus.Warnf("unable to get the start time of dnsmasq %d: %v", pid, err)
+	} else if info, err := os.Stat(conf.ConfigFile); err == nil && info.ModTime().After(started) {
+		issues = append(issues, fmt.Sprintf("%s changed at %s after dnsmasq %d started at %s, it is applied on restart only",
+			conf.ConfigFile, info.ModTime().Format(time.RFC3339), pid, started.Format(time.RFC3339)))
+	}
+	server, err := instanceServer(networkName)
+	if err != nil {
+		return nil, err
+	}
+	hostIssues, err := checkHosts(ctx, server, conf)
+	if err != nil {
+		return nil, err
+	}
+	issues = append(issues, hostIssues...)
+	serverIssues, err := checkServers(ctx, server, networkName)
+	if err != nil {
+		return nil, err
+	}
+	return append(issues, serverIssues...), nil
+}
+
+// checkHosts reports the entries of the hosts files the instance doesn't
+// answer with their address
+func checkHosts(ctx context.Context, server string, conf dnsNameFile) ([]string, error) {
+	paths := []string{conf.AddOnHostsFile}
+	if info, err := os.Stat(conf.AddOnHostsFile); err == nil && info.IsDir() {
+		// group instances read all hosts files of the directory
+		items, err := ioutil.ReadDir(conf.AddOnHostsFile)
+		if err != nil {
+			return nil, err
+		}
+		paths = paths[:0]
+		for _, item := range items {
+			// dnsmasq skips the hidden files
+			if strings.HasPrefix(item.Name(), ".") {
+				continue
+			}
+			paths = append(paths, filepath.Join(conf.AddOnHostsFile, item.Name()))
+		}
+	}
+	resolver := newResolver(server)
+	var issues []string
+	for _, path := range paths {
+		entries, err := readHostEntries(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, fields := range entries {
+			name := qualifyHostName(fields[1], conf.Domain)
+			addrs, err := resolver.LookupHost(ctx, name+".")
+			if err != nil {
+				issues = append(issues, fmt.Sprintf("%s of %s is not resolvable: %v", name, path, err))
+				continue
+			}
+			if !stringInSlice(net.ParseIP(fields[0]).String(), addrs) {
+				issues = append(issues, fmt.Sprintf("%s of %s resolves to %s instead of %s",
+					name, path, strings.Join(addrs, ", "), fields[0]))
+			}
+		}
+	}
+	return issues, nil
+}
+
+// checkServers reports the server items of the instance which don't forward
+// to the network owning them: a pod of the owning network must be resolvable
+// through the instance. Items no network owns any more are reported as stale.
+func checkServers(ctx context.Context, server, networkName string) ([]string, error) {
+	items, err := readServerItems(makePath(networkName, localServersConfFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	owners, err := serverItemOwners(networkName)
+	if err != nil {
+		return nil, err
+	}
+	resolver := newResolver(server)
+	var issues []string
+	for _, item := range items {
+		fields := strings.Split(item, "/")
+		if len(fields) < 3 {
+			// upstream servers are not owned by a network
+			continue
+		}
+		owner, ok := owners[item]
+		if !ok {
+			issues = append(issues, fmt.Sprintf("%s is stale, no network owns it", item))
+			continue
+		}
+		entries, err := readHostEntries(addOnHostsFile(owner))
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) == 0 {
+			logrus.Debugf("network %s has no pods, %s is not checked", owner, item)
+			continue
+		}
+		name := qualifyHostName(entries[0][1], fields[1])
+		if _, err := resolver.LookupHost(ctx, name+"."); err != nil {
+			issues = append(issues, fmt.Sprintf("%s is not applied, %s of network %s is not resolvable: %v",
+				item, name, owner, err))
+		}
+	}
+	return issues, nil
+}
+
+// serverItemOwners returns the networks by the server items they own, other
+// than the given network
+func serverItemOwners(networkName string) (map[string]string, error) {
+	owners := make(map[string]string)
+	items, err := ioutil.ReadDir(dnsNameConfPath())
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		if !isInstanceDir(item) || item.Name() == networkName || isGroupInstance(item.Name()) {
+			continue
+		}
+		ownItems, err := readServerItems(makePath(item.Name(), ownServersConfFileName))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, ownItem := range ownItems {
+			owners[ownItem] = item.Name()
+		}
+	}
+	return owners, nil
+}
+
+// readHostEntries returns the fields of the entries of the hosts file
+func readHostEntries(path string) ([][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var entries [][]string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if fields, _ := splitHostLine(scanner.Text()); isHostEntry(fields) && net.ParseIP(fields[0]) != nil {
+			entries = append(entries, fields)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// qualifyHostName returns the name a hosts file name is served under: dnsmasq
+// adds the domain to the names without a period only (expand-hosts)
+func qualifyHostName(name, domain string) string {
+	if strings.Contains(name, ".") || domain == "" {
+		return name
+	}
+	return name + "." + domain
+}
+
+// instanceServer returns the address the queries of the instance of the
+// network are sent to
+func instanceServer(networkName string) (string, error) {
+	target, err := readProbeTarget(makePath(networkName, confFileName))
+	if err != nil {
+		return "", err
+	}
+	addresses := target.addresses
+	if len(addresses) == 0 {
+		if addresses, err = getInterfaceAddresses(dnsNameFile{NetworkInterface: target.iface}); err != nil {
+			return "", err
+		}
+	}
+	if len(addresses) == 0 {
+		return "", errors.Errorf("dnsmasq instance of %s has no address to query", networkName)
+	}
+	return net.JoinHostPort(addresses[0], strconv.Itoa(target.port)), nil
+}
+
+// processStartTime returns the time the process with the given PID started
+func processStartTime(pid int) (time.Time, error) {
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return time.Time{}, err
+	}
+	// the command name may contain spaces, the fields follow its closing
+	// parenthesis starting with the state, the third field
+	end := strings.LastIndexByte(string(stat), ')')
+	if end < 0 {
+		return time.Time{}, errors.Errorf("invalid stat of process %d", pid)
+	}
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) < 20 {
+		return time.Time{}, errors.Errorf("invalid stat of process %d", pid)
+	}
+	ticks, err := strconv.ParseInt(fields[19], 10, 64)
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "invalid start time of process %d", pid)
+	}
+	bootTime, err := readBootTime()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return bootTime.Add(time.Duration(ticks) * time.Second / clockTicks), nil
+}
+
+// readBootTime returns the boot time of the system
+func readBootTime() (time.Time, error) {
+	stat, err := ioutil.ReadFile("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, line := range strings.Split(string(stat), "\n") {
+		if value := strings.TrimPrefix(line, "btime "); value != line {
+			seconds, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			if err != nil {
+				return time.Time{}, errors.Wrap(err, "invalid boot time")
+			}
+			return time.Unix(seconds, 0), nil
+		}
+	}
+	return time.Time{}, errors.New("no boot time in /proc/stat")
+}
+
+// cmdConsistencyCheck reports the discrepancies between the files of the
+// instance of the network and what its running dnsmasq serves
+func cmdConsistencyCheck(args []string) error {
+	if len(args) != 1 {
+		return errors.New("the network name is required")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), consistencyTimeout)
+	defer cancel()
+	issues, err := checkConsistency(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	for _, issue := range issues {
+		fmt.Println(issue)
+	}
+	if len(issues) > 0 {
+		return errors.Errorf("%d discrepancies found", len(issues))
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package dnsname
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProcessStartTime(t *testing.T) {
+	started, err := processStartTime(os.Getpid())
+	if err != nil {
+		t.Fatalf("processStartTime() error = %v", err)
+	}
+	if now := time.Now(); started.After(now) || now.Sub(started) > time.Hour {
+		t.Errorf("processStartTime() got = '%v', want shortly before '%v'", started, now)
+	}
+}
+
+func TestCheckHosts(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Can't listen: %v", err)
+	}
+	defer conn.Close()
+	go serveA(conn, net.IPv4(10, 88, 0, 2))
+	conf := dnsNameFile{Domain: "foobar.org", AddOnHostsFile: filepath.Join(t.TempDir(), hostsFileName)}
+	if err := ioutil.WriteFile(conf.AddOnHostsFile, []byte("10.88.0.2\tpod1\t# c1\n10.88.0.3\tpod2.prod\n"), 0o644); err != nil {
+		t.Fatalf("Can't write hosts: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	issues, err := checkHosts(ctx, conn.LocalAddr().String(), conf)
+	if err != nil {
+		t.Fatalf("checkHosts() error = %v", err)
+	}
+	want := "pod2.prod of " + conf.AddOnHostsFile + " resolves to 10.88.0.2 instead of 10.88.0.3"
+	if len(issues) != 1 || issues[0] != want {
+		t.Errorf("checkHosts() got = '%v', want '%v'", issues, want)
+	}
+}
+
+func TestCheckServersStale(t *testing.T) {
+	setupFakeDNSMasq(t)
+	if err := createNetwork("net1", "server=10.10.1.1\nserver=/net3/192.168.3.1\n", "server=/net1/192.168.1.1\n"); err != nil {
+		t.Fatalf("Can't create network: %v", err)
+	}
+	issues, err := checkServers(context.Background(), "127.0.0.1:53", "net1")
+	if err != nil {
+		t.Fatalf("checkServers() error = %v", err)
+	}
+	want := "server=/net3/192.168.3.1 is stale, no network owns it"
+	if len(issues) != 1 || issues[0] != want {
+		t.Errorf("checkServers() got = '%v', want '%v'", issues, want)
+	}
+}
@@ -0,0 +1,205 @@
+package dnsname
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// versionTimeout limits the time dnsmasq --version may take
+const versionTimeout = 5 * time.Second
+
+var (
+	// dnsmasqVersionRegexp matches the version in the first line of dnsmasq --version:
+	// "Dnsmasq version 2.90  Copyright (c) 2000-2024 Simon Kelley"
+	dnsmasqVersionRegexp = regexp.MustCompile(`(?i)dnsmasq version (\S+)`)
+	// versionNumberRegexp matches the numeric part of a version like "2.86test3"
+	versionNumberRegexp = regexp.MustCompile(`^(\d+)\.(\d+)`)
+)
+
+// dnsmasqCapabilities describe what a dnsmasq binary supports
+type dnsmasqCapabilities struct {
+	version string
+	major   int
+	minor   int
+	// compileOptions are the compile time options, e.g. "DNSSEC" or "no-DNSSEC"
+	compileOptions map[string]bool
+}
+
+// atLeast checks if the dnsmasq version is major.minor or newer
+func (c dnsmasqCapabilities) atLeast(major, minor int) bool {
+	return c.major > major || (c.major == major && c.minor >= minor)
+}
+
+// directiveRequirement is what dnsmasq needs to support an optional directive
+type directiveRequirement struct {
+	directive string
+	minMajor  int
+	minMinor  int
+	// compileOption is the compile time option the directive needs, if any
+	compileOption string
+	enabled       func(d *dnsNameFile) bool
+	disable       func(d *dnsNameFile)
+}
+
+// directiveRequirements lists the optional directives which older or
+// stripped down dnsmasq builds do not understand
+var directiveRequirements = []directiveRequirement{
+	{
+		directive: "dnssec", minMajor: 2, minMinor: 69, compileOption: "DNSSEC",
+		enabled: func(d *dnsNameFile) bool { return d.DNSSEC },
+		disable: func(d *dnsNameFile) { d.DNSSEC = false },
+	},
+	{
+		directive: "add-subnet", minMajor: 2, minMinor: 69,
+		enabled: func(d *dnsNameFile) bool { return d.AddSubnet != "" },
+		disable: func(d *dnsNameFile) { d.AddSubnet = "" },
+	},
+}
+
+// capabilitiesKey identifies a dnsmasq binary run by a process manager
+type capabilitiesKey struct {
+	procs  processManager
+	binary string
+}
+
+var (
+	capabilitiesMutex sync.Mutex
+	// capabilitiesCache keeps the detected capabilities by binary for the process run
+	capabilitiesCache = make(map[capabilitiesKey]dnsmasqCapabilities)
+)
+
+var (
+	binaryMutex sync.Mutex
+	// binaryCache keeps the dnsmasq binary found by PATH for the process run,
+	// so the instances of a multi-domain fan-out don't scan PATH each
+	binaryCache = make(map[string]string)
+)
+
+// lookupDNSMasq returns the path of the dnsmasq binary in PATH. The result is
+// cached for the PATH, a binary not found is looked up again next time.
+func lookupDNSMasq() (string, error) {
+	binaryMutex.Lock()
+	defer binaryMutex.Unlock()
+	path := os.Getenv("PATH")
+	if binary, ok := binaryCache[path]; ok {
+		return binary, nil
+	}
+	binary, err := exec.LookPath("dnsmasq")
+	if err != nil {
+		return "", err
+	}
+	binaryCache[path] = binary
+	return binary, nil
+}
+
+// getDNSMasqCapabilities returns the capabilities of the dnsmasq binary. dnsmasq
+// is run once per process, the result is cached.
+func getDNSMasqCapabilities(ctx context.Context, procs processManager, binary string) (dnsmasqCapabilities, error) {
+	capabilitiesMutex.Lock()
+	defer capabilitiesMutex.Unlock()
+	key := capabilitiesKey{procs: procs, binary: binary}
+	if capabilities, ok := capabilitiesCache[key]; ok {
+		return capabilities, nil
+	}
+	output, stderr, err := procs.run(ctx, binary, []string{"--version"})
+	if err != nil {
+		return dnsmasqCapabilities{}, errors.Wrapf(err, "unable to get dnsmasq version: %s", stderr)
+	}
+	capabilities, err := parseDNSMasqCapabilities(output)
+	if err != nil {
+		return dnsmasqCapabilities{}, err
+	}
+	capabilitiesCache[key] = capabilities
+	return capabilities, nil
+}
+
+// getDNSMasqVersion runs the dnsmasq binary to get its version
+func getDNSMasqVersion(ctx context.Context, procs processManager, binary string) (string, error) {
+	capabilities, err := getDNSMasqCapabilities(ctx, procs, binary)
+	if err != nil {
+		return "", err
+	}
+	return capabilities.version, nil
+}
+
+// parseDNSMasqVersion extracts the version from the dnsmasq --version output
+func parseDNSMasqVersion(output []byte) (string, error) {
+	match := dnsmasqVersionRegexp.FindSubmatch(output)
+	if match == nil {
+		return "", errors.Errorf("unable to parse dnsmasq version from %q", output)
+	}
+	return string(match[1]), nil
+}
+
+// parseDNSMasqCapabilities parses the version and the compile time options
+// from the dnsmasq --version output
+func parseDNSMasqCapabilities(output []byte) (dnsmasqCapabilities, error) {
+	version, err := parseDNSMasqVersion(output)
+	if err != nil {
+		return dnsmasqCapabilities{}, err
+	}
+	match := versionNumberRegexp.FindStringSubmatch(version)
+	if match == nil {
+		return dnsmasqCapabilities{}, errors.Errorf("unable to parse dnsmasq version %q", version)
+	}
+	capabilities := dnsmasqCapabilities{version: version, compileOptions: make(map[string]bool)}
+	// the numbers are guaranteed by the regexp
+	capabilities.major, _ = strconv.Atoi(match[1])
+	capabilities.minor, _ = strconv.Atoi(match[2])
+	for _, line := range strings.Split(string(output), "\n") {
+		if options := strings.TrimPrefix(line, "Compile time options:"); options != line {
+			for _, option := range strings.Fields(options) {
+				capabilities.compileOptions[option] = true
+			}
+		}
+	}
+	return capabilities, nil
+}
+
+// gateDirectives disables the optional directives of the instance which the
+// dnsmasq build does not support, so the generated config stays startable
+func gateDirectives(d *dnsNameFile, capabilities dnsmasqCapabilities) {
+	for _, req := range directiveRequirements {
+		if !req.enabled(d) {
+			continue
+		}
+		if !capabilities.atLeast(req.minMajor, req.minMinor) {
+			logrus.Warnf("dnsmasq %s does not support %s (needs %d.%d), skipping it",
+				capabilities.version, req.directive, req.minMajor, req.minMinor)
+			req.disable(d)
+			continue
+		}
+		if req.compileOption != "" && !capabilities.compileOptions[req.compileOption] {
+			logrus.Warnf("dnsmasq %s is built without %s, skipping %s",
+				capabilities.version, req.compileOption, req.directive)
+			req.disable(d)
+		}
+	}
+}
+
+// BuildInfo describes the plugin build along with the dnsmasq it drives
+func BuildInfo() string {
+	about := bv.BuildString("dnsname")
+	binary, err := lookupDNSMasq()
+	if err != nil {
+		return fmt.Sprintf("%s, dnsmasq not found in PATH", about)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), versionTimeout)
+	defer cancel()
+	dnsmasqVersion, err := getDNSMasqVersion(ctx, execProcessManager{}, binary)
+	if err != nil {
+		return fmt.Sprintf("%s, dnsmasq %s: %v", about, binary, err)
+	}
+	return fmt.Sprintf("%s, dnsmasq %s version %s", about, binary, dnsmasqVersion)
+}
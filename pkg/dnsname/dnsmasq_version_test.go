@@ -0,0 +1,100 @@
+package dnsname
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+func Test_parseDNSMasqVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		want    string
+		wantErr bool
+	}{
+		{"release", "Dnsmasq version 2.90  Copyright (c) 2000-2024 Simon Kelley\nCompile time options: IPv6 GNU-getopt DBus\n", "2.90", false},
+		{"test release", "Dnsmasq version 2.86test3  Copyright (c) 2000-2021 Simon Kelley\n", "2.86test3", false},
+		{"garbage", "dnsmasq: bad command line options\n", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseDNSMasqVersion([]byte(tt.output))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseDNSMasqVersion() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseDNSMasqVersion() got = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_gateDirectives(t *testing.T) {
+	tests := []struct {
+		name          string
+		output        string
+		wantDNSSEC    bool
+		wantAddSubnet bool
+	}{
+		{"supported", "Dnsmasq version 2.90  Copyright (c) 2000-2024 Simon Kelley\nCompile time options: IPv6 GNU-getopt DNSSEC loop-detect\n", true, true},
+		{"too old", "Dnsmasq version 2.66  Copyright (c) 2000-2013 Simon Kelley\nCompile time options: IPv6 GNU-getopt\n", false, false},
+		{"built without", "Dnsmasq version 2.90  Copyright (c) 2000-2024 Simon Kelley\nCompile time options: IPv6 GNU-getopt no-DNSSEC loop-detect\n", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			capabilities, err := parseDNSMasqCapabilities([]byte(tt.output))
+			if err != nil {
+				t.Fatalf("parseDNSMasqCapabilities() error = %v", err)
+			}
+			d := dnsNameFile{DNSSEC: true, ForceUpstreamTCP: true, AddSubnet: "add-subnet"}
+			gateDirectives(&d, capabilities)
+			if d.DNSSEC != tt.wantDNSSEC {
+				t.Errorf("gateDirectives() DNSSEC = %v, want %v", d.DNSSEC, tt.wantDNSSEC)
+			}
+			if (d.AddSubnet != "") != tt.wantAddSubnet {
+				t.Errorf("gateDirectives() AddSubnet = %v, want %v", d.AddSubnet, tt.wantAddSubnet)
+			}
+			if !d.ForceUpstreamTCP {
+				t.Error("gateDirectives() should not touch ungated directives")
+			}
+		})
+	}
+}
+
+func TestGetDNSMasqCapabilities(t *testing.T) {
+	d, procs := newTestDNSMasqFile(t)
+	procs.version = "Dnsmasq version 2.66  Copyright (c) 2000-2013 Simon Kelley\nCompile time options: IPv6 GNU-getopt\n"
+	for i := 0; i < 2; i++ {
+		capabilities, err := getDNSMasqCapabilities(context.Background(), d.processes(), d.Binary)
+		if err != nil {
+			t.Fatalf("getDNSMasqCapabilities() error = %v", err)
+		}
+		if capabilities.version != "2.66" {
+			t.Errorf("getDNSMasqCapabilities() version = %q, want %q", capabilities.version, "2.66")
+		}
+	}
+	// dnsmasq is run through the process manager of the instance, once
+	if procs.versionRuns != 1 || procs.runs != 0 {
+		t.Errorf("getDNSMasqCapabilities() got %d version runs and %d starts, want 1 and 0", procs.versionRuns, procs.runs)
+	}
+}
+
+func TestLookupDNSMasq(t *testing.T) {
+	setupFakeDNSMasq(t)
+	binary, err := lookupDNSMasq()
+	if err != nil {
+		t.Fatalf("lookupDNSMasq() error = %v", err)
+	}
+	// the binary found for the PATH is not looked up again
+	if err := os.Remove(binary); err != nil {
+		t.Fatalf("Can't remove fake dnsmasq: %v", err)
+	}
+	if got, err := lookupDNSMasq(); err != nil || got != binary {
+		t.Errorf("lookupDNSMasq() got = '%v', want '%v'", got, binary)
+	}
+	t.Setenv("PATH", t.TempDir())
+	if _, err := lookupDNSMasq(); err == nil {
+		t.Error("lookupDNSMasq() should look up a changed PATH")
+	}
+}
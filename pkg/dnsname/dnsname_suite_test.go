@@ -13,7 +13,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package dnsname
 
 import (
 	. "github.com/onsi/ginkgo"
@@ -24,5 +24,5 @@ import (
 
 func TestTuning(t *testing.T) {
 	RegisterFailHandler(Fail)
-	RunSpecs(t, "plugins/meta/dnsname")
+	RunSpecs(t, "pkg/dnsname")
 }
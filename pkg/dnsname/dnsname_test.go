@@ -1,4 +1,4 @@
-package main
+package dnsname
 
 import (
 	"io/ioutil"
@@ -17,9 +17,18 @@ import (
 	"github.com/vishvananda/netlink"
 )
 
+// cmdAdd runs Add the way the plugin binary does
+func cmdAdd(args *skel.CmdArgs) error {
+	result, err := Add(args)
+	if err != nil {
+		return err
+	}
+	return result.Print()
+}
+
 func cleanup(d dnsNameFile) error {
 	_ = d.stop()
-	return os.RemoveAll(filepath.Dir(d.PidFile))
+	return os.RemoveAll(d.InstanceDir)
 }
 
 var _ = Describe("dnsname tests", func() {
@@ -138,10 +147,10 @@ var _ = Describe("dnsname tests", func() {
 			Expect(err).To(BeNil())
 
 			// Check that the dns masq instance is running
-			pid, err := d.getProcess()
+			pid, err := d.getPID()
 			Expect(err).To(BeNil())
 			// Send it a signal 0; if alive, error will be nil
-			err = pid.Signal(syscall.Signal(0))
+			err = syscall.Kill(pid, syscall.Signal(0))
 			Expect(err).To(BeNil())
 
 			// Stop the dnsmasq instance and clean up files in the filesystem
@@ -177,13 +186,13 @@ var _ = Describe("dnsname tests", func() {
 			d, err := newDNSMasqFile("foobar.io", "dummy0", "test", true)
 			Expect(err).To(BeNil())
 
-			pid, err := d.getProcess()
+			pid, err := d.getPID()
 			Expect(err).To(BeNil())
-			err = pid.Signal(syscall.Signal(0))
+			err = syscall.Kill(pid, syscall.Signal(0))
 			Expect(err).To(BeNil())
 
 			err = testutils.CmdDel(targetNS.Path(), args.ContainerID, IFNAME, func() error {
-				return cmdDel(args)
+				return Del(args)
 			})
 			Expect(err).To(BeNil())
 
@@ -191,7 +200,7 @@ var _ = Describe("dnsname tests", func() {
 			// It sometimes takes time for the dnsmasq pid to be killed
 			// check every .5 second for maximum of 10 tries
 			for {
-				err = pid.Signal(syscall.Signal(0))
+				err = syscall.Kill(pid, syscall.Signal(0))
 				if err != nil {
 					dnsDead = true
 					break
@@ -211,4 +220,40 @@ var _ = Describe("dnsname tests", func() {
 		})
 		Expect(err).NotTo(HaveOccurred())
 	})
+
+	It("dnsname double del", func() {
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   fullConf,
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, _, err := testutils.CmdAdd(targetNS.Path(), args.ContainerID, IFNAME, fullConf, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			d, err := newDNSMasqFile("foobar.io", "dummy0", "test", true)
+			Expect(err).To(BeNil())
+
+			for i := 0; i < 2; i++ {
+				err = testutils.CmdDel(targetNS.Path(), args.ContainerID, IFNAME, func() error {
+					return Del(args)
+				})
+				Expect(err).To(BeNil())
+			}
+
+			// the network directory is gone after the first DEL
+			_, err = os.Stat(d.InstanceDir)
+			Expect(os.IsNotExist(err)).To(BeTrue())
+
+			Expect(cleanup(d)).To(BeNil())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
 })
@@ -0,0 +1,845 @@
+package dnsname
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// chainArgs returns the iptables rule accepting the DNS queries to dnsmasq on
+// the interface, port 0 means the default one. The rule carries the comment,
+// so it is told apart from the rules of other networks and tools.
+func chainArgs(interfaceName string, port int, comment string) []string {
+	if port == 0 {
+		port = defaultDNSPort
+	}
+	return []string{"-i", interfaceName, "-p", "udp", "-m", "udp", "--dport", strconv.Itoa(port),
+		"-m", "comment", "--comment", comment, "-j", "ACCEPT"}
+}
+
+// checkFromDNSMasqConfFile ensures that the dnsmasq conf file for the
+// network interface is up to date with the configuration, it creates or
+// rewrites it otherwise. It reports whether an existing conf file changed,
+// which the running instance only picks up on restart.
+func checkForDNSMasqConfFile(ctx context.Context, conf dnsNameFile) (bool, error) {
+	if conf.Group != "" {
+		// the hosts files of the group members are read from one directory
+		if err := os.MkdirAll(conf.HostsDir, 0o700); err != nil {
+			return false, err
+		}
+	}
+	// static hosts are rewritten every time so the instance picks up
+	// changed mappings on the next hup
+	if err := writeStaticHosts(conf.StaticHostsFile, conf.HostAliases); err != nil {
+		return false, err
+	}
+	if conf.Group != "" {
+		// the group instance is restarted by joinGroup if its conf changed
+		return false, joinGroup(ctx, conf)
+	}
+	if conf.CNAMEAliases {
+		// dnsmasq fails to start if an included conf file is missing
+		if err := createIfMissing(conf.CNAMEFile); err != nil {
+			return false, err
+		}
+	}
+	if conf.BindInterfaceOnly {
+		addresses, err := getInterfaceAddresses(conf)
+		if err != nil {
+			return false, err
+		}
+		if len(addresses) == 0 {
+			return false, errors.Errorf("interface %s has no address to bind dnsmasq to", conf.NetworkInterface)
+		}
+		conf.ListenAddresses = addresses
+	}
+	capabilities, err := getDNSMasqCapabilities(ctx, conf.processes(), conf.Binary)
+	if err != nil {
+		// keep the directives as configured, dnsmasq reports them if unsupported
+		logrus.Warnf("unable to check dnsmasq capabilities: %v", err)
+	} else {
+		gateDirectives(&conf, capabilities)
+	}
+	newConfig, err := generateDNSMasqConfig(conf)
+	if err != nil {
+		return false, err
+	}
+	oldConfig, err := ioutil.ReadFile(conf.ConfigFile)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	exists := err == nil
+	if exists && bytes.Equal(oldConfig, newConfig) {
+		return false, nil
+	}
+	if err := writeLayoutVersion(conf.layoutFile()); err != nil {
+		return false, err
+	}
+	// the new conf replaces the old one at once, a restarting instance must
+	// never read a partially written or rejected file
+	tmpConf := conf
+	tmpConf.ConfigFile = filepath.Join(filepath.Dir(conf.ConfigFile), "."+filepath.Base(conf.ConfigFile)+".tmp")
+	if err := ioutil.WriteFile(tmpConf.ConfigFile, newConfig, 0o700); err != nil {
+		return false, err
+	}
+	if conf.ValidateConfig {
+		if err := tmpConf.testConfig(ctx); err != nil {
+			// the instance keeps its current configuration, the next ADD
+			// must not pick up the rejected one
+			if removeErr := os.Remove(tmpConf.ConfigFile); removeErr != nil {
+				logrus.Warnf("unable to remove invalid %s: %v", tmpConf.ConfigFile, removeErr)
+			}
+			return false, err
+		}
+	}
+	if err := os.Rename(tmpConf.ConfigFile, conf.ConfigFile); err != nil {
+		os.Remove(tmpConf.ConfigFile)
+		return false, err
+	}
+	if exists {
+		logrus.Infof("conf file %s changed, a running instance is restarted", conf.ConfigFile)
+	}
+	return exists, nil
+}
+
+// writeStaticHosts writes the static host mappings of the network. They are kept
+// in a separate addnhosts file so pod churn never touches them.
+func writeStaticHosts(path string, hostAliases []HostAlias) error {
+	var content strings.Builder
+	for _, alias := range hostAliases {
+		content.WriteString(alias.IP)
+		for _, name := range alias.Names {
+			content.WriteString("\t" + name)
+		}
+		content.WriteString("\n")
+	}
+	return ioutil.WriteFile(path, []byte(content.String()), 0o644)
+}
+
+// syncSharedHosts writes the world readable view of the host mappings of the
+// network (pods and static mappings) to conf.SharedHostsFile. The view is
+// removed along with the instance.
+func syncSharedHosts(conf dnsNameFile) error {
+	if conf.SharedHostsFile == "" {
+		return nil
+	}
+	var (
+		content []byte
+		found   bool
+	)
+	for _, path := range []string{conf.StaticHostsFile, conf.AddOnHostsFile} {
+		hosts, err := ioutil.ReadFile(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		found = true
+		content = append(content, hosts...)
+	}
+	if !found {
+		if err := os.Remove(conf.SharedHostsFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(conf.SharedHostsFile), 0o755); err != nil {
+		return err
+	}
+	// readers must never see a partially written file
+	tmpFile := conf.SharedHostsFile + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, content, 0o644); err != nil {
+		return err
+	}
+	// the umask may have dropped the read permission of the others
+	if err := os.Chmod(tmpFile, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, conf.SharedHostsFile)
+}
+
+// newIPTables returns the iptables of the protocol. go-iptables doesn't take a
+// context, so the time left until the deadline bounds the wait for the xtables
+// lock instead, as this is where iptables blocks; iptables older than 1.6.0
+// can't bound it and wait for the lock as long as it takes.
+func newIPTables(ctx context.Context, protocol iptables.Protocol) (*iptables.IPTables, error) {
+	if ctx.Err() != nil {
+		return nil, timeoutError(ctx, "iptables")
+	}
+	timeout := 0
+	if deadline, ok := ctx.Deadline(); ok {
+		// the timeout is in seconds and 0 waits forever
+		timeout = int((time.Until(deadline) + time.Second - 1) / time.Second)
+		if timeout < 1 {
+			timeout = 1
+		}
+	}
+	return iptables.New(iptables.IPFamily(protocol), iptables.Timeout(timeout))
+}
+
+// addIPTablesChain adds dnsmasq iptables chain for each redirect interface and
+// protocol of the instance
+func addIPTablesChain(ctx context.Context, conf dnsNameFile) error {
+	for _, protocol := range conf.redirectProtocols() {
+		ip, err := newIPTables(ctx, protocol)
+		if err != nil {
+			return err
+		}
+		for _, interfaceName := range conf.redirectInterfaces() {
+			args := chainArgs(interfaceName, conf.DNSPort, conf.ruleComment())
+			exists, err := ip.Exists("filter", "INPUT", args...)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				if err := ip.Insert("filter", "INPUT", 1, args...); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// deleteIPTablesChain deletes dnsmasq iptables chain of each redirect interface
+// and protocol of the instance. Only the rules with the comment of the
+// instance match, rules added by others are left alone.
+func deleteIPTablesChain(ctx context.Context, conf dnsNameFile) error {
+	for _, protocol := range conf.redirectProtocols() {
+		ip, err := newIPTables(ctx, protocol)
+		if err != nil {
+			return err
+		}
+		for _, interfaceName := range conf.redirectInterfaces() {
+			if err := ip.DeleteIfExists("filter", "INPUT", chainArgs(interfaceName, conf.DNSPort, conf.ruleComment())...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deleteCommentedRules deletes the iptables rules carrying the comment of the
+// instance, whatever their interface. DEL without a previous result doesn't
+// know the interfaces, so the rules are found by the comment alone.
+func deleteCommentedRules(ctx context.Context, conf dnsNameFile) error {
+	for _, protocol := range conf.redirectProtocols() {
+		ip, err := newIPTables(ctx, protocol)
+		if err != nil {
+			return err
+		}
+		rules, err := ip.List("filter", "INPUT")
+		if err != nil {
+			return err
+		}
+		for _, args := range commentedRules(rules, conf.ruleComment()) {
+			if err := ip.DeleteIfExists("filter", "INPUT", args...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// commentedRules returns the arguments of the listed INPUT rules carrying the
+// comment. The comments of the instances don't contain spaces, so they are
+// listed unquoted.
+func commentedRules(rules []string, comment string) [][]string {
+	var found [][]string
+	for _, rule := range rules {
+		fields := strings.Fields(rule)
+		if len(fields) < 2 || fields[0] != "-A" || fields[1] != "INPUT" {
+			continue
+		}
+		args := fields[2:]
+		for i := 0; i+1 < len(args); i++ {
+			if args[i] == "--comment" && args[i+1] == comment {
+				found = append(found, args)
+				break
+			}
+		}
+	}
+	return found
+}
+
+// generateDNSMasqConfig fills out the configuration file template for the dnsmasq service
+func generateDNSMasqConfig(config dnsNameFile) ([]byte, error) {
+	var buf bytes.Buffer
+	templ, err := template.New("dnsmasq-conf-file").Parse(dnsMasqTemplate)
+	if err != nil {
+		return nil, err
+	}
+	if err := templ.Execute(&buf, config); err != nil {
+		return nil, err
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// hostAliases returns the aliases of the pod for the hosts file: with
+// AppendDomainToHosts the fully qualified names of the pod and of the aliases
+// follow them. The names of group instances are always fully qualified.
+func (d dnsNameFile) hostAliases(podName string, aliases []string) []string {
+	if !d.AppendDomainToHosts || d.Group != "" || d.Domain == "" {
+		return aliases
+	}
+	fqdns := make([]string, 0, len(aliases)+1)
+	for _, name := range append([]string{podName}, aliases...) {
+		if name != "" {
+			fqdns = append(fqdns, name+"."+d.Domain)
+		}
+	}
+	return mergeUnique(aliases, fqdns)
+}
+
+// qualifiedNames returns the names as dnsmasq serves them from the hosts file,
+// i.e. with the domain added to the names without a period
+func (d dnsNameFile) qualifiedNames(names []string) []string {
+	qualified := make([]string, 0, len(names))
+	for _, name := range names {
+		qualified = append(qualified, qualifyHostName(name, d.Domain))
+	}
+	return qualified
+}
+
+// createIfMissing creates the file empty unless it exists already
+func createIfMissing(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// addCNAMEs makes the aliases CNAMEs of the target in the cname file, an
+// alias of another target is moved to this one. It reports whether the file
+// changed.
+func addCNAMEs(path string, aliases []string, target string) (bool, error) {
+	lines, err := readCNAMELines(path)
+	if err != nil {
+		return false, err
+	}
+	var kept []string
+	for _, line := range lines {
+		if alias, _ := parseCNAMELine(line); !stringInSlice(alias, aliases) {
+			kept = append(kept, line)
+		}
+	}
+	for _, alias := range aliases {
+		kept = append(kept, fmt.Sprintf("cname=%s,%s", alias, target))
+	}
+	if strings.Join(kept, "\n") == strings.Join(lines, "\n") {
+		return false, nil
+	}
+	return true, writeCNAMELines(path, kept)
+}
+
+// removeCNAMEs removes the CNAMEs of the target from the cname file and
+// reports whether the file changed
+func removeCNAMEs(path string, target string) (bool, error) {
+	lines, err := readCNAMELines(path)
+	if err != nil {
+		return false, err
+	}
+	var kept []string
+	for _, line := range lines {
+		if _, lineTarget := parseCNAMELine(line); lineTarget != target {
+			kept = append(kept, line)
+		}
+	}
+	if len(kept) == len(lines) {
+		return false, nil
+	}
+	return true, writeCNAMELines(path, kept)
+}
+
+// readCNAMELines returns the non-empty lines of the cname file, none if it
+// doesn't exist
+func readCNAMELines(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// writeCNAMELines writes the lines to the cname file
+func writeCNAMELines(path string, lines []string) error {
+	var content strings.Builder
+	for _, line := range lines {
+		content.WriteString(line + "\n")
+	}
+	return ioutil.WriteFile(path, []byte(content.String()), 0o644)
+}
+
+// parseCNAMELine returns the alias and the target of a cname directive
+func parseCNAMELine(line string) (string, string) {
+	names := strings.Split(strings.TrimPrefix(strings.TrimSpace(line), "cname="), ",")
+	return names[0], names[len(names)-1]
+}
+
+// hostsLimit bounds the entries of a hosts file, see DNSNameConf.MaxHosts
+type hostsLimit struct {
+	max   int
+	evict bool
+}
+
+// hostsLimit returns the limit of the hosts file of the instance
+func (d dnsNameFile) hostsLimit() hostsLimit {
+	return hostsLimit{max: d.MaxHosts, evict: d.EvictOldestHosts}
+}
+
+// appendToFile appends a new entry to the dnsmasqs hosts file. A repeated ADD
+// of the pod finds its entries already there and leaves the file unchanged.
+// The entries of the oldest pods are evicted if the limit allows it, the
+// file is rewritten then. The container ID is recorded in the comment of the
+// entries, so the entries of a pod on its way out may keep its name until its
+// DEL removes exactly them.
+func appendToFile(path, podname, containerID string, aliases []string, ips []*net.IPNet, limit hostsLimit) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			logrus.Errorf("failed to close file %q: %v", path, err)
+		}
+	}()
+	entries := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		entry := fmt.Sprintf("%s\t%s", ip.IP.String(), podname)
+		for _, alias := range aliases {
+			entry += fmt.Sprintf("\t%s", alias)
+		}
+		if containerID != "" {
+			entry += "\t# " + containerID
+		}
+		entries = append(entries, entry)
+	}
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if hasEntries(lines, podname, containerID, entries) {
+		logrus.Debugf("%s already has the entries of %s", path, podname)
+		return nil
+	}
+	for _, line := range lines {
+		fields, id := splitHostLine(line)
+		if len(fields) > 1 && fields[1] == podname && isOtherContainer(id, containerID) {
+			logrus.Infof("%s has entries of %s from container %s, keeping them until its DEL", path, podname, id)
+			continue
+		}
+		if len(fields) > 1 {
+			for _, item := range fields[1:] {
+				for _, alias := range aliases {
+					if alias == item {
+						return errors.Errorf("Alias %s already exists", alias)
+					}
+				}
+				if item == podname {
+					return errors.Errorf("Host %s already exists", podname)
+				}
+			}
+		}
+	}
+	lines, evicted, err := applyHostsLimit(lines, len(entries), limit)
+	if err != nil {
+		return errors.Wrapf(err, "unable to add %s to %s", podname, path)
+	}
+	if len(evicted) > 0 {
+		logrus.Warnf("%s reached its limit of %d entries, evicted %s", path, limit.max, strings.Join(evicted, ", "))
+	}
+	removed, err := readCount(removedCountFile(path))
+	if err != nil {
+		// a broken count must not keep the entries from being added
+		logrus.Warnf("unable to read the removed entries of %s: %v", path, err)
+		removed = hostsCompactThreshold
+	}
+	lines, compacted := compactHostLines(lines, removed)
+	if compacted {
+		logrus.Debugf("compacting %s", path)
+	}
+	if len(evicted) > 0 || compacted {
+		if err := writeHostsFile(path, append(lines, entries...)); err != nil {
+			return err
+		}
+		if err := os.Remove(removedCountFile(path)); err != nil && !os.IsNotExist(err) {
+			logrus.Warnf("unable to reset the removed entries of %s: %v", path, err)
+		}
+		logrus.Debugf("rewrote %s with %s", path, strings.Join(entries, ", "))
+		return nil
+	}
+	for _, entry := range entries {
+		if _, err = f.WriteString(entry + "\n"); err != nil {
+			return err
+		}
+		logrus.Debugf("appended %s: %s", path, entry)
+	}
+	return nil
+}
+
+// hostsCompactThreshold is the number of entries removed since the last
+// rewrite, or of blank lines, from which appendToFile rewrites the hosts file
+const hostsCompactThreshold = 16
+
+// removedCountFile returns the path of the file counting the entries removed
+// from the hosts file since it was last rewritten. It is hidden, as dnsmasq
+// skips hidden files of a hosts directory.
+func removedCountFile(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".removed")
+}
+
+// recordRemoved adds the entries removed from the hosts file to its count. The
+// count only triggers the compaction, so failing to update it isn't fatal.
+func recordRemoved(path string, removed int) {
+	if removed == 0 {
+		return
+	}
+	countFile := removedCountFile(path)
+	count, err := readCount(countFile)
+	if err != nil {
+		logrus.Warnf("unable to read the removed entries of %s: %v", path, err)
+		count = 0
+	}
+	if err := ioutil.WriteFile(countFile, []byte(strconv.Itoa(count+removed)+"\n"), 0o644); err != nil {
+		logrus.Warnf("unable to count the removed entries of %s: %v", path, err)
+	}
+}
+
+// compactHostLines drops the blank lines of the hosts file and normalizes the
+// separators of the entries once hostsCompactThreshold entries were removed
+// or there are as many blank lines, so the file doesn't degrade with pod churn
+func compactHostLines(lines []string, removed int) ([]string, bool) {
+	blank := 0
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			blank++
+		}
+	}
+	if removed < hostsCompactThreshold && blank < hostsCompactThreshold {
+		return lines, false
+	}
+	compacted := make([]string, 0, len(lines)-blank)
+	for _, line := range lines {
+		fields, comment := splitHostLine(line)
+		switch {
+		case strings.TrimSpace(line) == "":
+			continue
+		case len(fields) == 0:
+			compacted = append(compacted, strings.TrimSpace(line))
+		case comment != "":
+			compacted = append(compacted, strings.Join(fields, "\t")+"\t# "+comment)
+		default:
+			compacted = append(compacted, strings.Join(fields, "\t"))
+		}
+	}
+	return compacted, true
+}
+
+// writeHostsFile replaces the hosts file with the lines. The new content is
+// renamed into place, so dnsmasq never reads a partially written file. The
+// temporary file is hidden, as dnsmasq skips hidden files of a hosts directory.
+func writeHostsFile(path string, lines []string) error {
+	var content strings.Builder
+	for _, line := range lines {
+		content.WriteString(line + "\n")
+	}
+	tmpFile := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err := ioutil.WriteFile(tmpFile, []byte(content.String()), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile, path); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	return nil
+}
+
+// applyHostsLimit checks that the entries to add fit into the hosts file
+// lines. If they don't and the limit allows eviction, the entries of the
+// oldest pods, which come first as entries are appended, are dropped from the
+// lines and the pods returned.
+func applyHostsLimit(lines []string, adding int, limit hostsLimit) ([]string, []string, error) {
+	count := 0
+	for _, line := range lines {
+		if isHostEntry(strings.Fields(line)) {
+			count++
+		}
+	}
+	if limit.max == 0 || count+adding <= limit.max {
+		return lines, nil, nil
+	}
+	if !limit.evict || adding > limit.max {
+		return nil, nil, errors.Wrapf(ErrHostsLimit, "%d of %d entries used", count, limit.max)
+	}
+	var evicted []string
+	for count+adding > limit.max {
+		var oldest string
+		for _, line := range lines {
+			if fields := strings.Fields(line); isHostEntry(fields) {
+				oldest = fields[1]
+				break
+			}
+		}
+		kept := lines[:0:0]
+		for _, line := range lines {
+			if fields := strings.Fields(line); isHostEntry(fields) && fields[1] == oldest {
+				count--
+				continue
+			}
+			kept = append(kept, line)
+		}
+		lines = kept
+		evicted = append(evicted, oldest)
+	}
+	return lines, evicted, nil
+}
+
+// isHostEntry checks if the fields of a hosts file line are an entry
+func isHostEntry(fields []string) bool {
+	return len(fields) > 1 && !strings.HasPrefix(fields[0], "#")
+}
+
+// hasEntries checks if the lines of the pod container in the hosts file are
+// exactly the given entries
+func hasEntries(lines []string, podname, containerID string, entries []string) bool {
+	var podLines []string
+	for _, line := range lines {
+		if fields, id := splitHostLine(line); len(fields) > 1 && fields[1] == podname && !isOtherContainer(id, containerID) {
+			podLines = append(podLines, line)
+		}
+	}
+	if len(podLines) == 0 || len(podLines) != len(entries) {
+		return false
+	}
+	for i := range entries {
+		fields, id := splitHostLine(podLines[i])
+		entryFields, entryID := splitHostLine(entries[i])
+		if strings.Join(fields, "\t") != strings.Join(entryFields, "\t") || id != entryID {
+			return false
+		}
+	}
+	return true
+}
+
+// splitHostLine returns the fields of a hosts file line and the container ID
+// recorded in its comment, if any
+func splitHostLine(line string) ([]string, string) {
+	entry, comment, _ := strings.Cut(line, "#")
+	return strings.Fields(entry), strings.TrimSpace(comment)
+}
+
+// isOtherContainer checks if the container ID of an entry belongs to another
+// container, entries without container ID belong to any
+func isOtherContainer(id, containerID string) bool {
+	return id != "" && containerID != "" && id != containerID
+}
+
+func removeHostLinesByIP(path string, ips []*net.IPNet) (modified bool, err error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0o644)
+	if err != nil {
+		return false, err
+	}
+
+	defer func() {
+		if err := f.Close(); err != nil {
+			logrus.Errorf("Failed to close file %q: %v", path, err)
+		}
+	}()
+
+	var (
+		newContent strings.Builder
+		found      bool = false
+		removed    int
+	)
+
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+
+		if len(fields) < 1 {
+			newContent.WriteString(line + "\n")
+
+			continue
+		}
+
+		ip := fields[0]
+
+		if ipMatches(ip, ips) {
+			found = true
+			removed++
+
+			logrus.Debugf("Removing line from file: %s", line)
+
+			continue
+		}
+
+		newContent.WriteString(line + "\n")
+	}
+
+	if err := scanner.Err(); err != nil {
+		return false, err
+	}
+
+	if !found {
+		logrus.Infof("No matching IPs found for removal in file %q", path)
+
+		return false, nil
+	}
+
+	if err := f.Truncate(0); err != nil {
+		return false, err
+	}
+
+	if _, err := f.Seek(0, 0); err != nil {
+		return false, err
+	}
+
+	if _, err := f.WriteString(newContent.String()); err != nil {
+		return false, err
+	}
+
+	logrus.Infof("Updated file %q with removed entries", path)
+
+	recordRemoved(path, removed)
+
+	return true, nil
+}
+
+// ipMatches checks if the hosts file address is one of the ips. The addresses
+// are compared parsed, so equivalent IPv6 notations match.
+func ipMatches(ipStr string, ips []*net.IPNet) bool {
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return false
+	}
+
+	for _, ipNet := range ips {
+		if ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// removeLineFromFile removes a given entry from the dnsmasq host file, only
+// the entries of the container if the container ID is given. It returns if
+// entries are left and the number of entries removed.
+func removeFromFile(path, podname, containerID string) (bool, int, error) {
+	var (
+		keepers []string
+		removed int
+	)
+	shouldHUP := false
+	backup := fmt.Sprintf("%s.old", path)
+	if err := os.Rename(path, backup); err != nil {
+		if os.IsNotExist(err) {
+			return shouldHUP, 0, nil
+		}
+		return shouldHUP, 0, err
+	}
+	f, err := os.Open(backup)
+	if err != nil {
+		//	if the open fails here, we need to revert things
+		renameFile(backup, path)
+		return shouldHUP, 0, err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			logrus.Errorf("unable to close %q: %v", backup, err)
+		}
+	}()
+
+	oldFile := bufio.NewScanner(f)
+	// Iterate the old file
+	for oldFile.Scan() {
+		fields, id := splitHostLine(oldFile.Text())
+		// if the IP of the entry and the given IP dont match, it should
+		// go into the new file
+		if len(fields) > 1 && (fields[1] != podname || isOtherContainer(id, containerID)) {
+			keepers = append(keepers, fmt.Sprintf("%s\n", oldFile.Text()))
+			continue
+		}
+		if len(fields) > 1 {
+			removed++
+		}
+	}
+	if removed == 0 {
+		// We never found a matching record; non-fatal
+		logrus.Debugf("a record for %s was never found in %s", podname, path)
+	}
+	fileLength, err := writeFile(path, keepers)
+	if err != nil {
+		renameFile(backup, path)
+		return shouldHUP, 0, err
+	}
+	if fileLength > 0 {
+		shouldHUP = true
+	}
+	if err := os.Remove(backup); err != nil {
+		logrus.Errorf("unable to delete '%s': %q", backup, err)
+	}
+	recordRemoved(path, removed)
+	return shouldHUP, removed, nil
+}
+
+// renameFile renames a file to backup
+func renameFile(oldpath, newpath string) {
+	if renameError := os.Rename(oldpath, newpath); renameError != nil {
+		logrus.Errorf("unable to restore %q to %q: %v", oldpath, newpath, renameError)
+	}
+}
+
+// writeFile writes a []string to the given path and returns the number
+// of lines in the file
+func writeFile(path string, content []string) (int, error) {
+	var counter int
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			logrus.Errorf("unable to close %q: %v", path, err)
+		}
+	}()
+
+	for _, line := range content {
+		if _, err := f.WriteString(line); err != nil {
+			return 0, err
+		}
+		counter++
+	}
+	return counter, nil
+}
@@ -0,0 +1,592 @@
+package dnsname
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+func Test_generateDNSMasqConfig(t *testing.T) {
+	testResult := strings.ReplaceAll(`## WARNING: THIS IS AN AUTOGENERATED FILE
+## AND SHOULD NOT BE EDITED MANUALLY AS IT
+## LIKELY TO AUTOMATICALLY BE REPLACED.
+all-servers
+strict-order
+local=/foobar.org/
+domain=foobar.org
+expand-hosts
+pid-file=%{path}/cni0/pidfile
+except-interface=lo
+bind-dynamic
+no-hosts
+interface=cni0
+addn-hosts=%{path}/cni0/addnhosts
+addn-hosts=%{path}/cni0/staticaddnhosts
+servers-file=%{path}/cni0/localservers.conf
+`, "%{path}", dnsNameConfPath())
+
+	testConfig := dnsNameFile{
+		AddOnHostsFile:       makePath("cni0", hostsFileName),
+		StaticHostsFile:      makePath("cni0", staticHostsFileName),
+		Binary:               "/usr/bin/foo",
+		ConfigFile:           makePath("cni0", confFileName),
+		Domain:               "foobar.org",
+		NetworkInterface:     "cni0",
+		PidFile:              makePath("cni0", pidFileName),
+		LocalServersConfFile: makePath("cni0", localServersConfFileName),
+	}
+	tcpConfig := testConfig
+	tcpConfig.ForceUpstreamTCP = true
+	tcpResult := strings.Replace(testResult, "no-hosts\n", "no-hosts\nedns-packet-max=512\n", 1)
+	isolatedConfig := testConfig
+	isolatedConfig.Isolated = true
+	isolatedResult := strings.Replace(testResult, "no-hosts\n", "no-hosts\nno-resolv\naddress=/#/\n", 1)
+	cnameConfig := testConfig
+	cnameConfig.CNAMEAliases = true
+	cnameConfig.CNAMEFile = makePath("cni0", cnamesFileName)
+	cnameResult := strings.Replace(testResult, "staticaddnhosts\n",
+		"staticaddnhosts\nconf-file="+makePath("cni0", cnamesFileName)+"\n", 1)
+	dnssecConfig := testConfig
+	dnssecConfig.DNSSEC = true
+	dnssecConfig.DNSSECCheckUnsigned = true
+	dnssecConfig.TrustAnchorsFile = "/usr/share/dnsmasq/trust-anchors.conf"
+	dnssecResult := strings.Replace(testResult, "no-hosts\n",
+		"no-hosts\ndnssec\nconf-file=/usr/share/dnsmasq/trust-anchors.conf\ndnssec-check-unsigned\n", 1)
+	extraConfig := testConfig
+	extraConfig.ExtraOptions = []string{"domain-needed", "bogus-priv"}
+	extraResult := testResult + "domain-needed\nbogus-priv\n"
+	bindConfig := testConfig
+	bindConfig.BindInterfaceOnly = true
+	bindConfig.ListenAddresses = []string{"10.88.0.1", "fd00::1"}
+	bindResult := strings.Replace(testResult, "bind-dynamic\n",
+		"bind-interfaces\nlisten-address=10.88.0.1\nlisten-address=fd00::1\n", 1)
+	bindResult = strings.Replace(bindResult, "interface=cni0\n", "", 1)
+	negTTLConfig := testConfig
+	negTTLConfig.NegTTL = 5
+	negTTLResult := strings.Replace(testResult, "no-hosts\n", "no-hosts\nneg-ttl=5\n", 1)
+	rebindConfig := testConfig
+	rebindConfig.StopDNSRebind = true
+	rebindConfig.RebindDomainOK = "rebind-domain-ok=/corp.example/lan/"
+	rebindResult := strings.Replace(testResult, "no-hosts\n", "no-hosts\nstop-dns-rebind\nrebind-domain-ok=/corp.example/lan/\n", 1)
+	forwardMaxConfig := testConfig
+	forwardMaxConfig.DNSForwardMax = 100
+	forwardMaxResult := strings.Replace(testResult, "no-hosts\n", "no-hosts\ndns-forward-max=100\n", 1)
+	portConfig := testConfig
+	portConfig.DNSPort = 5353
+	portResult := strings.Replace(testResult, "cni0/pidfile\n", "cni0/pidfile\nport=5353\n", 1)
+	noPidFileConfig := testConfig
+	noPidFileConfig.NoPidFile = true
+	noPidFileResult := strings.Replace(testResult, "pid-file="+testConfig.PidFile+"\n", "pid-file=\n", 1)
+	forwardConfig := testConfig
+	forwardConfig.ForwardOnly = true
+	forwardConfig.ForwardServers = []string{"10.10.0.1", "10.10.0.2#5353"}
+	forwardResult := strings.Replace(testResult, "local=/foobar.org/\ndomain=foobar.org\nexpand-hosts\n",
+		"server=/foobar.org/10.10.0.1\nserver=/foobar.org/10.10.0.2#5353\n", 1)
+	forwardResult = strings.Replace(forwardResult, "addn-hosts="+testConfig.AddOnHostsFile+"\n",
+		podsHostsMarker+testConfig.AddOnHostsFile+"\n", 1)
+	subnetConfig := testConfig
+	subnetConfig.AddSubnet = "add-subnet=24,56"
+	subnetResult := strings.Replace(testResult, "no-hosts\n", "no-hosts\nadd-subnet=24,56\n", 1)
+	reverseConfig := testConfig
+	reverseConfig.ReverseZone = "10.88.0.0/16"
+	reverseResult := strings.Replace(testResult, "expand-hosts\n", "expand-hosts\nsynth-domain=foobar.org,10.88.0.0/16\n", 1)
+	interfaceNameConfig := testConfig
+	interfaceNameConfig.InterfaceName = "dns"
+	interfaceNameConfig.AddressFamily = "4"
+	interfaceNameResult := strings.Replace(testResult, "expand-hosts\n", "expand-hosts\ninterface-name=dns.foobar.org,cni0/4\n", 1)
+	serviceConfig := testConfig
+	serviceConfig.ServiceDomain = "svc.example"
+	serviceResult := strings.Replace(testResult, "expand-hosts\n", "expand-hosts\nlocal=/svc.example/\n", 1)
+	mdnsConfig := testConfig
+	mdnsConfig.Domain = "pods.local"
+	mdnsConfig.MDNSGuard = true
+	mdnsResult := strings.ReplaceAll(testResult, "foobar.org", "pods.local")
+	mdnsResult = strings.Replace(mdnsResult, "expand-hosts\n", "expand-hosts\nlocal=/local/\n", 1)
+	groupConfig := testConfig
+	groupConfig.Group = "shared"
+	groupConfig.ConfigFile = makePath("group-shared", confFileName)
+	groupConfig.PidFile = makePath("group-shared", pidFileName)
+	groupConfig.HostsDir = makePath("group-shared", "hosts")
+	groupConfig.Members = []groupMember{
+		{Network: "net1", Domain: "net1.org", Interface: "cni1"},
+		{Network: "net2", Domain: "net2.org", Interface: "cni2"},
+	}
+	groupResult := strings.Replace(testResult, "local=/foobar.org/\ndomain=foobar.org\nexpand-hosts\n",
+		"local=/net1.org/\nlocal=/net2.org/\n", 1)
+	groupResult = strings.Replace(groupResult, "cni0/pidfile", "group-shared/pidfile", 1)
+	groupResult = strings.Replace(groupResult, "interface=cni0\n", "interface=cni1\ninterface=cni2\n", 1)
+	groupResult = strings.Replace(groupResult, makePath("cni0", hostsFileName)+"\naddn-hosts="+makePath("cni0", staticHostsFileName),
+		makePath("group-shared", "hosts"), 1)
+	includeConfig := testConfig
+	includeConfig.IncludeConfFiles = []string{"/etc/dnsmasq.d/org.conf"}
+	includeConfig.ExtraOptions = []string{"domain-needed"}
+	includeResult := testResult + "conf-file=/etc/dnsmasq.d/org.conf\ndomain-needed\n"
+	type args struct {
+		config dnsNameFile
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    []byte
+		wantErr bool
+	}{
+		{"pass", args{testConfig}, []byte(testResult), false},
+		{"force upstream tcp", args{tcpConfig}, []byte(tcpResult), false},
+		{"isolated", args{isolatedConfig}, []byte(isolatedResult), false},
+		{"cname aliases", args{cnameConfig}, []byte(cnameResult), false},
+		{"dnssec", args{dnssecConfig}, []byte(dnssecResult), false},
+		{"extra options", args{extraConfig}, []byte(extraResult), false},
+		{"bind interface only", args{bindConfig}, []byte(bindResult), false},
+		{"neg ttl", args{negTTLConfig}, []byte(negTTLResult), false},
+		{"stop dns rebind", args{rebindConfig}, []byte(rebindResult), false},
+		{"dns forward max", args{forwardMaxConfig}, []byte(forwardMaxResult), false},
+		{"dns port", args{portConfig}, []byte(portResult), false},
+		{"reverse zone", args{reverseConfig}, []byte(reverseResult), false},
+		{"interface name", args{interfaceNameConfig}, []byte(interfaceNameResult), false},
+		{"service domain", args{serviceConfig}, []byte(serviceResult), false},
+		{"mdns domain", args{mdnsConfig}, []byte(mdnsResult), false},
+		{"client subnet", args{subnetConfig}, []byte(subnetResult), false},
+		{"forward only", args{forwardConfig}, []byte(forwardResult), false},
+		{"no pidfile", args{noPidFileConfig}, []byte(noPidFileResult), false},
+		{"group", args{groupConfig}, []byte(groupResult), false},
+		{"include conf files", args{includeConfig}, []byte(includeResult), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := generateDNSMasqConfig(tt.args.config)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("generateDNSMasqConfig() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("generateDNSMasqConfig() got = '%v', want '%v'", string(got), string(tt.want))
+			}
+		})
+	}
+}
+
+func Test_appendToFileContainerID(t *testing.T) {
+	testFile := path.Join(t.TempDir(), "hosts")
+	oldIP := []*net.IPNet{{IP: net.IP{192, 168, 0, 1}}}
+	newIP := []*net.IPNet{{IP: net.IP{192, 168, 0, 2}}}
+	if err := appendToFile(testFile, "pod1", "c1", []string{"web"}, oldIP, hostsLimit{}); err != nil {
+		t.Fatalf("Can't append to file: %v", err)
+	}
+	// a repeated ADD of the container leaves the file as it is
+	if err := appendToFile(testFile, "pod1", "c1", []string{"web"}, oldIP, hostsLimit{}); err != nil {
+		t.Fatalf("Repeated append should succeed: %v", err)
+	}
+	// the pod is recreated before the DEL of its old container
+	if err := appendToFile(testFile, "pod1", "c2", []string{"web"}, newIP, hostsLimit{}); err != nil {
+		t.Fatalf("Can't append to file: %v", err)
+	}
+	want := "192.168.0.1\tpod1\tweb\t# c1\n192.168.0.2\tpod1\tweb\t# c2\n"
+	if got, err := ioutil.ReadFile(testFile); err != nil || string(got) != want {
+		t.Errorf("appendToFile() got = '%v', want '%v'", string(got), want)
+	}
+	// another pod still can't take the name
+	if err := appendToFile(testFile, "pod2", "c3", []string{"pod1"}, newIP, hostsLimit{}); err == nil {
+		t.Error("New data should not be appended due to unique host violation")
+	}
+	// the DEL of the old container removes its entries only
+	if _, _, err := removeFromFile(testFile, "pod1", "c1"); err != nil {
+		t.Fatalf("Can't remove from file: %v", err)
+	}
+	want = "192.168.0.2\tpod1\tweb\t# c2\n"
+	if got, err := ioutil.ReadFile(testFile); err != nil || string(got) != want {
+		t.Errorf("removeFromFile() got = '%v', want '%v'", string(got), want)
+	}
+}
+
+func Test_appendToFileCompaction(t *testing.T) {
+	testFile := path.Join(t.TempDir(), "hosts")
+	ips := []*net.IPNet{{IP: net.IP{192, 168, 0, 4}}}
+	sparse := "192.168.0.1  pod1\n" + strings.Repeat("\n", hostsCompactThreshold-1) + "# static\n192.168.0.2 pod2 web # c2\n"
+	if err := ioutil.WriteFile(testFile, []byte(sparse), 0o644); err != nil {
+		t.Fatalf("Can't write initial file: %v", err)
+	}
+	// below the threshold the entry is appended
+	if err := appendToFile(testFile, "pod4", "", nil, ips, hostsLimit{}); err != nil {
+		t.Fatalf("appendToFile() error = %v", err)
+	}
+	want := sparse + "192.168.0.4\tpod4\n"
+	if got, err := ioutil.ReadFile(testFile); err != nil || string(got) != want {
+		t.Errorf("appendToFile() got = '%v', want '%v'", string(got), want)
+	}
+	// one more blank line reaches it and the file is rewritten compacted
+	if err := ioutil.WriteFile(testFile, []byte(sparse+"\n"), 0o644); err != nil {
+		t.Fatalf("Can't write initial file: %v", err)
+	}
+	if err := appendToFile(testFile, "pod4", "", nil, ips, hostsLimit{}); err != nil {
+		t.Fatalf("appendToFile() error = %v", err)
+	}
+	want = "192.168.0.1\tpod1\n# static\n192.168.0.2\tpod2\tweb\t# c2\n192.168.0.4\tpod4\n"
+	if got, err := ioutil.ReadFile(testFile); err != nil || string(got) != want {
+		t.Errorf("appendToFile() got = '%v', want '%v'", string(got), want)
+	}
+	if items, err := ioutil.ReadDir(path.Dir(testFile)); err != nil || len(items) != 1 {
+		t.Errorf("appendToFile() should leave no temporary file, got %v", items)
+	}
+}
+
+func Test_appendToFileChurn(t *testing.T) {
+	testFile := path.Join(t.TempDir(), "hosts")
+	static := "192.168.0.100  static\n"
+	if err := ioutil.WriteFile(testFile, []byte(static), 0o644); err != nil {
+		t.Fatalf("Can't write initial file: %v", err)
+	}
+	removed := func() int {
+		count, err := readCount(removedCountFile(testFile))
+		if err != nil {
+			t.Fatalf("Can't read removed entries: %v", err)
+		}
+		return count
+	}
+	for i := 1; i <= hostsCompactThreshold; i++ {
+		podname := fmt.Sprintf("pod%d", i)
+		ips := []*net.IPNet{{IP: net.IP{192, 168, 1, byte(i)}}}
+		if err := appendToFile(testFile, podname, "", nil, ips, hostsLimit{}); err != nil {
+			t.Fatalf("appendToFile() error = %v", err)
+		}
+		if _, _, err := removeFromFile(testFile, podname, ""); err != nil {
+			t.Fatalf("removeFromFile() error = %v", err)
+		}
+		if removed() != i {
+			t.Fatalf("removeFromFile() removed entries = %d, want %d", removed(), i)
+		}
+	}
+	// below the threshold the file is only appended to
+	if got, err := ioutil.ReadFile(testFile); err != nil || string(got) != static {
+		t.Errorf("removeFromFile() got = '%v', want '%v'", string(got), static)
+	}
+	ips := []*net.IPNet{{IP: net.IP{192, 168, 2, 1}}}
+	if err := appendToFile(testFile, "pod", "", nil, ips, hostsLimit{}); err != nil {
+		t.Fatalf("appendToFile() error = %v", err)
+	}
+	want := "192.168.0.100\tstatic\n192.168.2.1\tpod\n"
+	if got, err := ioutil.ReadFile(testFile); err != nil || string(got) != want {
+		t.Errorf("appendToFile() got = '%v', want '%v'", string(got), want)
+	}
+	if removed() != 0 {
+		t.Errorf("appendToFile() should reset the removed entries, got %d", removed())
+	}
+	if _, err := removeHostLinesByIP(testFile, ips); err != nil {
+		t.Fatalf("removeHostLinesByIP() error = %v", err)
+	}
+	if removed() != 1 {
+		t.Errorf("removeHostLinesByIP() removed entries = %d, want 1", removed())
+	}
+}
+
+func Test_appendToFileLimit(t *testing.T) {
+	testFile := path.Join(t.TempDir(), "hosts")
+	initialContent := "192.168.0.1\tpod1\n192.168.0.2\tpod2\nfd00::2\tpod2\n192.168.0.3\tpod3\n"
+	ips := []*net.IPNet{{IP: net.IP{192, 168, 0, 4}}}
+	tests := []struct {
+		name    string
+		limit   hostsLimit
+		want    string
+		wantErr bool
+	}{
+		{"unlimited", hostsLimit{}, initialContent + "192.168.0.4\tpod4\n", false},
+		{"room left", hostsLimit{max: 5}, initialContent + "192.168.0.4\tpod4\n", false},
+		{"full", hostsLimit{max: 4}, initialContent, true},
+		{"evict oldest", hostsLimit{max: 4, evict: true},
+			"192.168.0.2\tpod2\nfd00::2\tpod2\n192.168.0.3\tpod3\n192.168.0.4\tpod4\n", false},
+		{"evict all addresses of a pod", hostsLimit{max: 2, evict: true}, "192.168.0.3\tpod3\n192.168.0.4\tpod4\n", false},
+		{"too many addresses", hostsLimit{evict: true, max: 1}, "192.168.0.4\tpod4\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ioutil.WriteFile(testFile, []byte(initialContent), 0o644); err != nil {
+				t.Fatalf("Can't write initial file: %v", err)
+			}
+			err := appendToFile(testFile, "pod4", "", nil, ips, tt.limit)
+			if (err != nil) != tt.wantErr || (err != nil && !errors.Is(err, ErrHostsLimit)) {
+				t.Fatalf("appendToFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			got, err := ioutil.ReadFile(testFile)
+			if err != nil {
+				t.Fatalf("Can't read file: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("appendToFile() got = '%v', want '%v'", string(got), tt.want)
+			}
+		})
+	}
+	if err := appendToFile(testFile, "pod5", "", nil, []*net.IPNet{{IP: net.IP{192, 168, 0, 5}}, {IP: net.ParseIP("fd00::5")}},
+		hostsLimit{max: 1, evict: true}); !errors.Is(err, ErrHostsLimit) {
+		t.Errorf("appendToFile() error = %v, want %v", err, ErrHostsLimit)
+	}
+}
+
+func Test_appendToFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	testFile := path.Join(tmpDir, "hosts")
+	initialContent := `192.168.0.1	pod1	aliasPod1
+192.168.0.2	pod2	aliasPod2
+`
+	if err := ioutil.WriteFile(testFile, []byte(initialContent), 0644); err != nil {
+		t.Fatalf("Can't write initial file: %v", err)
+	}
+	if err := appendToFile(testFile, "pod3", "", []string{"aliasPod3"},
+		[]*net.IPNet{{IP: net.IP{192, 168, 0, 3}, Mask: nil}}, hostsLimit{}); err != nil {
+		t.Fatalf("Can't append to file: %v", err)
+	}
+	testResult := `192.168.0.1	pod1	aliasPod1
+192.168.0.2	pod2	aliasPod2
+192.168.0.3	pod3	aliasPod3
+`
+	got, err := ioutil.ReadFile(testFile)
+	if err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	if string(got) != testResult {
+		t.Errorf("appendToFile() got = '%v', want '%v'", string(got), string(testResult))
+	}
+	if err := appendToFile(testFile, "pod", "", []string{"aliasPod3"},
+		[]*net.IPNet{{IP: net.IP{192, 168, 0, 4}, Mask: nil}}, hostsLimit{}); err == nil {
+		t.Error("New data should not be appended due to unique host violation")
+	}
+	// a repeated ADD of pod3 leaves the file as it is
+	if err := appendToFile(testFile, "pod3", "", []string{"aliasPod3"},
+		[]*net.IPNet{{IP: net.IP{192, 168, 0, 3}, Mask: nil}}, hostsLimit{}); err != nil {
+		t.Fatalf("Repeated append should succeed: %v", err)
+	}
+	if got, err = ioutil.ReadFile(testFile); err != nil || string(got) != testResult {
+		t.Errorf("appendToFile() got = '%v', want '%v'", string(got), string(testResult))
+	}
+	// pod3 with another address is still a different pod
+	if err := appendToFile(testFile, "pod3", "", []string{"aliasPod3"},
+		[]*net.IPNet{{IP: net.IP{192, 168, 0, 4}, Mask: nil}}, hostsLimit{}); err == nil {
+		t.Error("New data should not be appended due to unique host violation")
+	}
+}
+
+func Test_hostAliases(t *testing.T) {
+	tests := []struct {
+		name string
+		conf dnsNameFile
+		want []string
+	}{
+		{"short names", dnsNameFile{Domain: "foobar.org"}, []string{"alias1"}},
+		{"fqdns", dnsNameFile{Domain: "foobar.org", AppendDomainToHosts: true},
+			[]string{"alias1", "pod1.foobar.org", "alias1.foobar.org"}},
+		{"group", dnsNameFile{Domain: "foobar.org", AppendDomainToHosts: true, Group: "shared"}, []string{"alias1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.conf.hostAliases("pod1", []string{"alias1"}); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("hostAliases() got = '%v', want '%v'", got, tt.want)
+			}
+		})
+	}
+	// DEL removes the entries with the fully qualified names along with the pod
+	testFile := path.Join(t.TempDir(), "hosts")
+	conf := dnsNameFile{Domain: "foobar.org", AppendDomainToHosts: true}
+	ips := []*net.IPNet{{IP: net.IP{192, 168, 0, 3}}, {IP: net.ParseIP("fd00::3")}}
+	if err := appendToFile(testFile, "pod1", "", conf.hostAliases("pod1", nil), ips, hostsLimit{}); err != nil {
+		t.Fatalf("Can't append to file: %v", err)
+	}
+	if _, _, err := removeFromFile(testFile, "pod1", ""); err != nil {
+		t.Fatalf("Can't remove from file: %v", err)
+	}
+	if got, err := ioutil.ReadFile(testFile); err != nil || len(got) != 0 {
+		t.Errorf("removeFromFile() got = '%v', want no entries", string(got))
+	}
+}
+
+func Test_removeFromFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	testFile := path.Join(tmpDir, "hosts")
+	initialContent := `192.168.0.1	pod1	aliasPod1
+192.168.0.2	pod2	aliasPod2
+192.168.0.3	pod3	aliasPod3
+192.168.0.3	pod3	aliasPod3
+`
+	if err := ioutil.WriteFile(testFile, []byte(initialContent), 0644); err != nil {
+		t.Fatalf("Can't write initial file: %v", err)
+	}
+	shouldHUP, removed, err := removeFromFile(testFile, "pod3", "")
+	if err != nil {
+		t.Fatalf("Can't remove from file: %v", err)
+	}
+	if !shouldHUP {
+		t.Error("Should HUP")
+	}
+	if removed != 2 {
+		t.Errorf("removeFromFile() removed = %d, want %d", removed, 2)
+	}
+	testResult := `192.168.0.1	pod1	aliasPod1
+192.168.0.2	pod2	aliasPod2
+`
+	got, err := ioutil.ReadFile(testFile)
+	if err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	if string(got) != testResult {
+		t.Errorf("appendToFile() got = '%v', want '%v'", string(got), string(testResult))
+	}
+}
+
+func Test_addCNAMEs(t *testing.T) {
+	testFile := path.Join(t.TempDir(), cnamesFileName)
+	if modified, err := addCNAMEs(testFile, []string{"web.foo.org", "api.foo.org"}, "pod1.foo.org"); err != nil || !modified {
+		t.Fatalf("addCNAMEs() got = '%v', '%v', want 'true'", modified, err)
+	}
+	// a repeated ADD leaves the file as it is
+	if modified, err := addCNAMEs(testFile, []string{"web.foo.org", "api.foo.org"}, "pod1.foo.org"); err != nil || modified {
+		t.Errorf("addCNAMEs() got = '%v', '%v', want 'false'", modified, err)
+	}
+	// the alias moves to the pod taking it over
+	if _, err := addCNAMEs(testFile, []string{"web.foo.org"}, "pod2.foo.org"); err != nil {
+		t.Fatalf("Can't add CNAMEs: %v", err)
+	}
+	want := "cname=api.foo.org,pod1.foo.org\ncname=web.foo.org,pod2.foo.org\n"
+	if got, err := ioutil.ReadFile(testFile); err != nil || string(got) != want {
+		t.Errorf("addCNAMEs() got = '%v', want '%v'", string(got), want)
+	}
+	if modified, err := removeCNAMEs(testFile, "pod1.foo.org"); err != nil || !modified {
+		t.Fatalf("removeCNAMEs() got = '%v', '%v', want 'true'", modified, err)
+	}
+	want = "cname=web.foo.org,pod2.foo.org\n"
+	if got, err := ioutil.ReadFile(testFile); err != nil || string(got) != want {
+		t.Errorf("removeCNAMEs() got = '%v', want '%v'", string(got), want)
+	}
+	if modified, err := removeCNAMEs(path.Join(t.TempDir(), cnamesFileName), "pod1.foo.org"); err != nil || modified {
+		t.Errorf("removeCNAMEs() of a missing file got = '%v', '%v', want 'false'", modified, err)
+	}
+}
+
+func Test_writeStaticHosts(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	testFile := path.Join(tmpDir, "statichosts")
+	if err := ioutil.WriteFile(testFile, []byte("10.0.0.1\tstale\n"), 0644); err != nil {
+		t.Fatalf("Can't write initial file: %v", err)
+	}
+	hostAliases := []HostAlias{
+		{IP: "192.168.0.254", Names: []string{"gateway", "gw"}},
+		{IP: "fd00::1", Names: []string{"gateway6"}},
+	}
+	if err := writeStaticHosts(testFile, hostAliases); err != nil {
+		t.Fatalf("Can't write static hosts: %v", err)
+	}
+	testResult := `192.168.0.254	gateway	gw
+fd00::1	gateway6
+`
+	got, err := ioutil.ReadFile(testFile)
+	if err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	if string(got) != testResult {
+		t.Errorf("writeStaticHosts() got = '%v', want '%v'", string(got), testResult)
+	}
+}
+
+func Test_syncSharedHosts(t *testing.T) {
+	tmpDir := t.TempDir()
+	conf := dnsNameFile{
+		AddOnHostsFile:  path.Join(tmpDir, "cni0", hostsFileName),
+		StaticHostsFile: path.Join(tmpDir, "cni0", staticHostsFileName),
+		SharedHostsFile: path.Join(tmpDir, "shared", "cni0.hosts"),
+	}
+	if err := os.MkdirAll(path.Join(tmpDir, "cni0"), 0o700); err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	if err := ioutil.WriteFile(conf.StaticHostsFile, []byte("192.168.0.254\tgateway\n"), 0o644); err != nil {
+		t.Fatalf("Can't write static hosts: %v", err)
+	}
+	if err := ioutil.WriteFile(conf.AddOnHostsFile, []byte("10.88.0.2\tpod1\n"), 0o600); err != nil {
+		t.Fatalf("Can't write hosts: %v", err)
+	}
+	if err := syncSharedHosts(conf); err != nil {
+		t.Fatalf("Can't sync shared hosts: %v", err)
+	}
+	testResult := "192.168.0.254\tgateway\n10.88.0.2\tpod1\n"
+	got, err := ioutil.ReadFile(conf.SharedHostsFile)
+	if err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	if string(got) != testResult {
+		t.Errorf("syncSharedHosts() got = '%v', want '%v'", string(got), testResult)
+	}
+	info, err := os.Stat(conf.SharedHostsFile)
+	if err != nil {
+		t.Fatalf("Can't stat file: %v", err)
+	}
+	if info.Mode().Perm() != 0o644 {
+		t.Errorf("syncSharedHosts() mode = '%v', want '%v'", info.Mode().Perm(), os.FileMode(0o644))
+	}
+	// the instance is gone
+	if err := os.RemoveAll(path.Join(tmpDir, "cni0")); err != nil {
+		t.Fatalf("Can't remove dir: %v", err)
+	}
+	if err := syncSharedHosts(conf); err != nil {
+		t.Fatalf("Can't sync shared hosts: %v", err)
+	}
+	if _, err := os.Stat(conf.SharedHostsFile); !os.IsNotExist(err) {
+		t.Errorf("Shared hosts file should be removed, got %v", err)
+	}
+}
+
+func Test_removeHostLinesByIP(t *testing.T) {
+	testFile := path.Join(t.TempDir(), "hosts")
+	initialContent := `192.168.0.1	pod1
+2001:0db8:0:0:0:0:0:1	pod1
+192.168.0.2	pod2
+2001:db8::2	pod2
+`
+	if err := ioutil.WriteFile(testFile, []byte(initialContent), 0644); err != nil {
+		t.Fatalf("Can't write initial file: %v", err)
+	}
+	modified, err := removeHostLinesByIP(testFile, []*net.IPNet{
+		{IP: net.ParseIP("192.168.0.1")},
+		{IP: net.ParseIP("2001:db8::1")},
+	})
+	if err != nil {
+		t.Fatalf("Can't remove lines: %v", err)
+	}
+	if !modified {
+		t.Error("File should be modified")
+	}
+	testResult := `192.168.0.2	pod2
+2001:db8::2	pod2
+`
+	got, err := ioutil.ReadFile(testFile)
+	if err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	if string(got) != testResult {
+		t.Errorf("removeHostLinesByIP() got = '%v', want '%v'", string(got), testResult)
+	}
+}
+
+func Test_newIPTables(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// iptables isn't run once the context is done
+	if _, err := newIPTables(ctx, iptables.ProtocolIPv4); !errors.Is(err, ErrTimeout) {
+		t.Errorf("newIPTables() error = %v, want %v", err, ErrTimeout)
+	}
+}
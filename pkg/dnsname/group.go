@@ -0,0 +1,180 @@
+package dnsname
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// groupInstancePrefix marks the directories of the dnsmasq instances shared by
+// a group of networks, so they are not taken for networks
+const groupInstancePrefix = "group-"
+
+const (
+	// groupHostsDirName is the directory with the hosts files of the group members
+	groupHostsDirName = "hosts"
+	// groupMembersDirName is the directory with a file per group member
+	groupMembersDirName = "members"
+)
+
+// groupMember is a network served by the dnsmasq instance of a group
+type groupMember struct {
+	Network   string `json:"network"`
+	Domain    string `json:"domain"`
+	Interface string `json:"interface"`
+}
+
+// groupInstanceName returns the name of the dnsmasq instance of the group
+func groupInstanceName(group string) string {
+	return groupInstancePrefix + group
+}
+
+// isGroupInstance checks if the directory of the configuration path belongs to a group instance
+func isGroupInstance(name string) bool {
+	return strings.HasPrefix(name, groupInstancePrefix)
+}
+
+// setGroup moves the network to the dnsmasq instance shared by the group. The
+// instance reads the hosts files of all members from one directory.
+func (d *dnsNameFile) setGroup(group, networkName string) {
+	instance := groupInstanceName(group)
+	d.Group = group
+	d.Network = networkName
+	d.InstanceDir = makePath(instance, "")
+	d.ConfigFile = makePath(instance, confFileName)
+	d.PidFile = makePath(instance, pidFileName)
+	d.HostsDir = makePath(instance, groupHostsDirName)
+	d.AddOnHostsFile = filepath.Join(d.HostsDir, networkName)
+	d.StaticHostsFile = filepath.Join(d.HostsDir, networkName+".static")
+}
+
+// memberFile returns the member file of the network in the group
+func (d dnsNameFile) memberFile() string {
+	return makePath(groupInstanceName(d.Group), filepath.Join(groupMembersDirName, d.Network+".json"))
+}
+
+// hostName returns the name as written to the hosts file. Group instances serve
+// several domains, so their names are fully qualified.
+func (d dnsNameFile) hostName(name string) string {
+	if d.Group == "" {
+		return name
+	}
+	return name + "." + d.Domain
+}
+
+// hostNames returns the names as written to the hosts file
+func (d dnsNameFile) hostNames(names []string) []string {
+	hostNames := make([]string, 0, len(names))
+	for _, name := range names {
+		hostNames = append(hostNames, d.hostName(name))
+	}
+	return hostNames
+}
+
+// joinGroup registers the network as a member of its group and updates the
+// conf file of the group instance
+func joinGroup(ctx context.Context, conf dnsNameFile) error {
+	if err := os.MkdirAll(filepath.Dir(conf.memberFile()), 0o700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(groupMember{Network: conf.Network, Domain: conf.Domain, Interface: conf.NetworkInterface})
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(conf.memberFile(), data, 0o600); err != nil {
+		return err
+	}
+	return writeGroupConf(ctx, conf)
+}
+
+// leaveGroup removes the network from its group. The group instance is removed
+// along with its last member, otherwise it is restarted without the network.
+func leaveGroup(ctx context.Context, conf dnsNameFile) error {
+	for _, path := range []string{conf.memberFile(), conf.AddOnHostsFile, removedCountFile(conf.AddOnHostsFile),
+		conf.StaticHostsFile} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	members, err := readGroupMembers(conf)
+	if err != nil {
+		return err
+	}
+	if len(members) == 0 {
+		if err := conf.stop(); err != nil {
+			return err
+		}
+		return os.RemoveAll(conf.InstanceDir)
+	}
+	if err := writeGroupConf(ctx, conf); err != nil {
+		return err
+	}
+	return conf.hup(ctx)
+}
+
+// writeGroupConf generates the conf file of the group instance from its
+// members. dnsmasq can't reload its conf file, so a running instance with a
+// changed conf is stopped and started again by the following hup.
+func writeGroupConf(ctx context.Context, conf dnsNameFile) error {
+	members, err := readGroupMembers(conf)
+	if err != nil {
+		return err
+	}
+	conf.Members = members
+	capabilities, err := getDNSMasqCapabilities(ctx, conf.processes(), conf.Binary)
+	if err != nil {
+		// keep the directives as configured, dnsmasq reports them if unsupported
+		logrus.Warnf("unable to check dnsmasq capabilities: %v", err)
+	} else {
+		gateDirectives(&conf, capabilities)
+	}
+	newConfig, err := generateDNSMasqConfig(conf)
+	if err != nil {
+		return err
+	}
+	if oldConfig, err := ioutil.ReadFile(conf.ConfigFile); err == nil && bytes.Equal(oldConfig, newConfig) {
+		return nil
+	}
+	if err := writeLayoutVersion(conf.layoutFile()); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(conf.ConfigFile, newConfig, 0o700); err != nil {
+		return err
+	}
+	if isRunning, _ := conf.isRunning(); isRunning {
+		logrus.Infof("members of group %s changed, restarting its instance", conf.Group)
+		return conf.stop()
+	}
+	return nil
+}
+
+// readGroupMembers returns the members of the group sorted by network name
+func readGroupMembers(conf dnsNameFile) ([]groupMember, error) {
+	membersDir := filepath.Dir(conf.memberFile())
+	items, err := ioutil.ReadDir(membersDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	members := make([]groupMember, 0, len(items))
+	for _, item := range items {
+		data, err := ioutil.ReadFile(filepath.Join(membersDir, item.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var member groupMember
+		if err := json.Unmarshal(data, &member); err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, nil
+}
@@ -0,0 +1,75 @@
+package dnsname
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestGroupMember(procs *fakeProcessManager, network, domain, iface string) dnsNameFile {
+	d := dnsNameFile{Binary: "/nonexistent/dnsmasq", Domain: domain, NetworkInterface: iface, procManager: procs}
+	d.setGroup("shared", network)
+	return d
+}
+
+func TestGroupMembership(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	procs := newFakeProcessManager(makePath(groupInstanceName("shared"), pidFileName))
+	net1 := newTestGroupMember(procs, "net1", "net1.org", "cni1")
+	net2 := newTestGroupMember(procs, "net2", "net2.org", "cni2")
+	ctx := context.Background()
+
+	for _, d := range []dnsNameFile{net1, net2} {
+		if err := os.MkdirAll(d.InstanceDir, 0o700); err != nil {
+			t.Fatalf("Can't create dir: %v", err)
+		}
+		if _, err := checkForDNSMasqConfFile(ctx, d); err != nil {
+			t.Fatalf("Can't join group: %v", err)
+		}
+		if err := d.hup(ctx); err != nil {
+			t.Fatalf("Can't hup: %v", err)
+		}
+	}
+	members, err := readGroupMembers(net1)
+	if err != nil {
+		t.Fatalf("Can't read members: %v", err)
+	}
+	want := []groupMember{
+		{Network: "net1", Domain: "net1.org", Interface: "cni1"},
+		{Network: "net2", Domain: "net2.org", Interface: "cni2"},
+	}
+	if !reflect.DeepEqual(members, want) {
+		t.Errorf("readGroupMembers() got = '%v', want '%v'", members, want)
+	}
+	// the second member changed the conf of the running instance
+	if procs.runs != 2 {
+		t.Errorf("Group instance should be restarted for the new member, got %d starts", procs.runs)
+	}
+	if name := net2.hostName("pod1"); name != "pod1.net2.org" {
+		t.Errorf("hostName() got = '%v', want '%v'", name, "pod1.net2.org")
+	}
+
+	if err := leaveGroup(ctx, net1); err != nil {
+		t.Fatalf("Can't leave group: %v", err)
+	}
+	if isRunning, _ := net2.isRunning(); !isRunning {
+		t.Error("Group instance should keep running for the remaining member")
+	}
+	conf, err := ioutil.ReadFile(net2.ConfigFile)
+	if err != nil {
+		t.Fatalf("Can't read conf: %v", err)
+	}
+	if strings.Contains(string(conf), "local=/net1.org/\n") {
+		t.Error("Conf should not serve the domain of the member which left")
+	}
+	if err := leaveGroup(ctx, net2); err != nil {
+		t.Fatalf("Can't leave group: %v", err)
+	}
+	if _, err := os.Stat(filepath.Dir(net2.PidFile)); !os.IsNotExist(err) {
+		t.Errorf("Group instance should be removed with its last member, got %v", err)
+	}
+}
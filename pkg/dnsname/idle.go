@@ -0,0 +1,262 @@
+package dnsname
+
+import (
+	"context"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// idleFileName is the name of the file marking an instance kept running
+// without pods
+const idleFileName = "idle"
+
+// teardownState is what gc needs to tear an instance down without the CNI
+// config of its network, it is persisted in the state files of the instance
+type teardownState struct {
+	Domain          string `json:"domain"`
+	Interface       string `json:"interface"`
+	MultiDomain     bool   `json:"multiDomain"`
+	DNSPort         int    `json:"dnsPort"`
+	HostsFile       string `json:"hostsFile"`
+	DisableRedirect bool   `json:"disableRedirect"`
+	RedirectFamily  string `json:"redirectFamily"`
+	// Nameservers are the servers of the instance propagated to the peers
+	Nameservers []string `json:"nameservers"`
+}
+
+// newTeardownState returns the teardown state of the instance
+func newTeardownState(conf dnsNameFile, multiDomain bool, nameservers []string) teardownState {
+	return teardownState{
+		Domain:          conf.Domain,
+		Interface:       conf.NetworkInterface,
+		MultiDomain:     multiDomain,
+		DNSPort:         conf.DNSPort,
+		HostsFile:       conf.AddOnHostsFile,
+		DisableRedirect: conf.DisableRedirect,
+		RedirectFamily:  conf.RedirectFamily,
+		Nameservers:     nameservers,
+	}
+}
+
+// dnsMasqFile returns the configuration of the instance of the network
+func (s teardownState) dnsMasqFile(networkName string) (dnsNameFile, error) {
+	conf, err := newDNSMasqFile(s.Domain, s.Interface, networkName, s.MultiDomain)
+	if err != nil {
+		return dnsNameFile{}, err
+	}
+	conf.DNSPort = s.DNSPort
+	conf.DisableRedirect = s.DisableRedirect
+	conf.RedirectFamily = s.RedirectFamily
+	if s.HostsFile != "" {
+		conf.AddOnHostsFile = s.HostsFile
+	}
+	return conf, nil
+}
+
+// idleState describes an instance kept running after its last pod left, with
+// what gc needs to tear it down once the idle timeout expired
+type idleState struct {
+	Since   time.Time `json:"since"`
+	Timeout Duration  `json:"timeout"`
+	teardownState
+}
+
+// expired checks if the idle timeout passed, instances without timeout are
+// kept until a pod is added again
+func (s idleState) expired(now time.Time) bool {
+	return s.Timeout.Duration > 0 && now.After(s.Since.Add(s.Timeout.Duration))
+}
+
+// idleFile returns the path of the idle file of the instance
+func (d dnsNameFile) idleFile() string {
+	return filepath.Join(d.InstanceDir, idleFileName)
+}
+
+// markIdle keeps the instance running without pods: the emptied hosts file is
+// reloaded and the idle file is written for gc. A repeated DEL does not
+// extend the idle time.
+func markIdle(ctx context.Context, conf dnsNameFile, multiDomain bool) error {
+	nameservers, err := getInterfaceAddresses(conf)
+	if err != nil {
+		return err
+	}
+	since := time.Now()
+	if state, err := readIdleState(conf.idleFile()); err == nil && state != nil {
+		since = state.Since
+	}
+	data, err := json.Marshal(idleState{
+		Since:         since,
+		Timeout:       conf.IdleTimeout,
+		teardownState: newTeardownState(conf, multiDomain, nameservers),
+	})
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(conf.idleFile(), data, 0o600); err != nil {
+		return err
+	}
+	return conf.hup(ctx)
+}
+
+// clearIdle marks the instance as serving pods again
+func clearIdle(conf dnsNameFile) error {
+	if err := os.Remove(conf.idleFile()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// readIdleState reads the idle file of an instance, nil means the instance
+// serves pods
+func readIdleState(path string) (*idleState, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var state idleState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, errors.Wrapf(err, "invalid idle file %s", path)
+	}
+	return &state, nil
+}
+
+// teardown removes the instance: its servers are removed from the peers, the
+// dnsmasq process is stopped and the files of the network are deleted. The
+// instance is stopped even if the peers could not be updated, but its files
+// are kept if it could not be stopped, so a retry still finds its pidfile.
+func teardown(ctx context.Context, conf dnsNameFile, multiDomain bool, nameservers []string) error {
+	var errs []error
+	if multiDomain {
+		if err := removeLocalServers(ctx, conf, nameservers); err != nil {
+			errs = append(errs, errors.Wrap(err, "unable to remove the servers from the peers"))
+		}
+	}
+	if err := conf.stop(); err != nil {
+		return stderrors.Join(append(errs, err)...)
+	}
+	if err := os.RemoveAll(conf.InstanceDir); err != nil {
+		errs = append(errs, err)
+	}
+	// a hosts file kept elsewhere goes along with the instance
+	for _, path := range []string{conf.AddOnHostsFile, removedCountFile(conf.AddOnHostsFile)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+	return stderrors.Join(errs...)
+}
+
+// gcMatch returns the teardown state of the instance of the network if gc
+// must remove it, along with the reason logged, and nil otherwise
+type gcMatch func(networkName string, now time.Time) (*teardownState, string, error)
+
+// gcInstances tears down the instances matched by match and returns the names
+// of their networks
+func gcInstances(what string, match gcMatch, now time.Time) ([]string, error) {
+	items, err := ioutil.ReadDir(dnsNameConfPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var removed []string
+	for _, item := range items {
+		if !isInstanceDir(item) || isGroupInstance(item.Name()) {
+			continue
+		}
+		state, _, err := match(item.Name(), now)
+		if err != nil {
+			return removed, err
+		}
+		if state == nil {
+			continue
+		}
+		ok, err := gcInstance(item.Name(), state.MultiDomain, match, now)
+		if err != nil {
+			return removed, errors.Wrapf(err, "unable to remove %s instance of %s", what, item.Name())
+		}
+		if ok {
+			removed = append(removed, item.Name())
+		}
+	}
+	return removed, nil
+}
+
+// gcInstance tears down the instance of the network under the network lock,
+// unless it does not match anymore, along with the redirect rules its pods
+// may still use
+func gcInstance(networkName string, multiDomain bool, match gcMatch, now time.Time) (bool, error) {
+	lockCtx, cancel := context.WithTimeout(context.Background(), defaultLockTimeout)
+	defer cancel()
+	lock, err := lockNetwork(lockCtx, commandLockDir(), networkName, multiDomain, defaultLockPollInterval)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err := lock.release(); err != nil {
+			logrus.Errorf("unable to release lock for %q: %v", networkName, err)
+		}
+	}()
+	state, reason, err := match(networkName, now)
+	if err != nil || state == nil {
+		return false, err
+	}
+	conf, err := state.dnsMasqFile(networkName)
+	if err != nil {
+		return false, err
+	}
+	hosts, err := countHostEntries(conf.AddOnHostsFile)
+	if err != nil && !os.IsNotExist(err) {
+		logrus.Warnf("unable to count the hosts of %s: %v", networkName, err)
+	}
+	logrus.Warnf("reaping instance of %s, %s with %d host entries left", networkName, reason, hosts)
+	ctx, cancel := context.WithTimeout(context.Background(), defaultCommandTimeout)
+	defer cancel()
+	if !conf.DisableRedirect {
+		// the rules must not keep the instance from being reaped
+		if err := deleteCommentedRules(ctx, conf); err != nil {
+			logrus.Warnf("unable to delete iptables rules of %s: %v", networkName, err)
+		}
+	}
+	if err := teardown(ctx, conf, state.MultiDomain, state.Nameservers); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// matchIdle matches the idle instances whose idle timeout expired
+func matchIdle(networkName string, now time.Time) (*teardownState, string, error) {
+	state, err := readIdleState(makePath(networkName, idleFileName))
+	if err != nil || state == nil || !state.expired(now) {
+		return nil, "", err
+	}
+	return &state.teardownState, fmt.Sprintf("idle since %s, its idle timeout of %s expired",
+		state.Since.Format(time.RFC3339), state.Timeout), nil
+}
+
+// cmdGC removes the idle instances whose idle timeout expired and the
+// instances whose lifetime expired
+func cmdGC([]string) error {
+	now := time.Now()
+	removed, err := gcInstances("idle", matchIdle, now)
+	for _, network := range removed {
+		fmt.Printf("removed idle instance of %s\n", network)
+	}
+	expired, expiredErr := gcInstances("expired", matchExpired, now)
+	for _, network := range expired {
+		fmt.Printf("removed expired instance of %s\n", network)
+	}
+	return stderrors.Join(err, expiredErr)
+}
@@ -0,0 +1,83 @@
+package dnsname
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGCIdleInstances(t *testing.T) {
+	setupFakeDNSMasq(t)
+	now := time.Now()
+	// the hosts file of net1 is kept outside of its directory
+	hostsFile := filepath.Join(t.TempDir(), "net1.hosts")
+	if err := ioutil.WriteFile(hostsFile, nil, 0o644); err != nil {
+		t.Fatalf("Can't write hosts: %v", err)
+	}
+	states := map[string]*idleState{
+		"net1": {Since: now.Add(-time.Hour), Timeout: Duration{time.Minute}, teardownState: teardownState{
+			Domain: "net1.org", Interface: "cni1", HostsFile: hostsFile, DisableRedirect: true}},
+		"net2": {Since: now.Add(-time.Hour), Timeout: Duration{2 * time.Hour}, teardownState: teardownState{
+			Domain: "net2.org", Interface: "cni2", DisableRedirect: true}},
+		"net3": {Since: now.Add(-time.Hour), teardownState: teardownState{
+			Domain: "net3.org", Interface: "cni3", DisableRedirect: true}},
+		"net4": nil,
+	}
+	for network, state := range states {
+		if err := os.MkdirAll(makePath(network, ""), 0o700); err != nil {
+			t.Fatalf("Can't create network dir: %v", err)
+		}
+		if state == nil {
+			continue
+		}
+		data, err := json.Marshal(state)
+		if err != nil {
+			t.Fatalf("Can't marshal idle state: %v", err)
+		}
+		if err := ioutil.WriteFile(makePath(network, idleFileName), data, 0o600); err != nil {
+			t.Fatalf("Can't write idle file: %v", err)
+		}
+	}
+	removed, err := gcInstances("idle", matchIdle, now)
+	if err != nil {
+		t.Fatalf("gcInstances() error = %v", err)
+	}
+	if !reflect.DeepEqual(removed, []string{"net1"}) {
+		t.Errorf("gcInstances() got = '%v', want '%v'", removed, []string{"net1"})
+	}
+	for network := range states {
+		_, err := os.Stat(makePath(network, ""))
+		if exists := err == nil; exists != (network != "net1") {
+			t.Errorf("network %s exists = %v", network, exists)
+		}
+	}
+	if _, err := os.Stat(hostsFile); !os.IsNotExist(err) {
+		t.Errorf("Hosts file of net1 should be removed, got %v", err)
+	}
+}
+
+func TestClearIdle(t *testing.T) {
+	conf, _ := newTestDNSMasqFile(t)
+	since := time.Now().Add(-time.Hour).Round(0)
+	data, err := json.Marshal(idleState{Since: since})
+	if err != nil {
+		t.Fatalf("Can't marshal idle state: %v", err)
+	}
+	if err := ioutil.WriteFile(conf.idleFile(), data, 0o600); err != nil {
+		t.Fatalf("Can't write idle file: %v", err)
+	}
+	state, err := readIdleState(conf.idleFile())
+	if err != nil || state == nil || !state.Since.Equal(since) {
+		t.Fatalf("readIdleState() got = '%v', error = %v", state, err)
+	}
+	if err := clearIdle(conf); err != nil {
+		t.Fatalf("clearIdle() error = %v", err)
+	}
+	if state, err := readIdleState(conf.idleFile()); err != nil || state != nil {
+		t.Errorf("readIdleState() got = '%v', error = %v, want no state", state, err)
+	}
+}
@@ -0,0 +1,147 @@
+package dnsname
+
+import (
+	"context"
+	stderrors "errors"
+	"net"
+	"os"
+	"path/filepath"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Instance is the dnsmasq instance serving the pods of a network. It gives the
+// steps ADD and DEL are made of to embedders, which use the same files as the
+// plugin binary. The steps changing the instance must run under the locks
+// taken by Lock.
+type Instance struct {
+	conf *DNSNameConf
+	file dnsNameFile
+}
+
+// ParseConfig parses and validates the network configuration of the plugin
+// along with its previous result, nil if it has none
+func ParseConfig(stdin []byte) (*DNSNameConf, *current.Result, error) {
+	conf, result, _, err := parseConfig(stdin, "", "")
+	return conf, result, err
+}
+
+// NewInstance returns the instance of the network of the configuration on the
+// interface of the previous result. Nothing is changed on disk.
+func NewInstance(conf *DNSNameConf, result *current.Result) (*Instance, error) {
+	iface, err := networkInterface(result)
+	if err != nil {
+		return nil, err
+	}
+	file, err := newDNSMasqFile(conf.DomainName, iface, conf.Name, conf.MultiDomain)
+	if err != nil {
+		return nil, err
+	}
+	file.setConfig(conf)
+	file.RedirectInterfaces = redirectInterfaces(result, conf.RedirectInterfaces)
+	return &Instance{conf: conf, file: file}, nil
+}
+
+// MakeDirs creates the directory of the instance and the one of a hosts file
+// kept elsewhere, ADD does it before taking the locks
+func (i *Instance) MakeDirs() error {
+	for _, dir := range []string{i.file.InstanceDir, filepath.Dir(i.file.AddOnHostsFile)} {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Lock takes the locks of the instance, see the lock hierarchy in lock.go, and
+// returns the function releasing them
+func (i *Instance) Lock() (func() error, error) {
+	lock, err := i.conf.lockNetwork()
+	if err != nil {
+		return nil, err
+	}
+	return lock.release, nil
+}
+
+// AddRedirect adds the iptables rules accepting the DNS queries of the pods,
+// unless the redirect is disabled
+func (i *Instance) AddRedirect(ctx context.Context) error {
+	if i.file.DisableRedirect {
+		return nil
+	}
+	return addIPTablesChain(ctx, i.file)
+}
+
+// RemoveRedirect deletes the iptables rules of the instance, unless the
+// redirect is disabled
+func (i *Instance) RemoveRedirect(ctx context.Context) error {
+	if i.file.DisableRedirect {
+		return nil
+	}
+	return deleteIPTablesChain(ctx, i.file)
+}
+
+// AddHost adds the entries of the pod to the hosts file of the instance. The
+// aliases are added as given, the container ID keeps the entries apart from
+// the ones of another container of the pod.
+func (i *Instance) AddHost(podName, containerID string, aliases []string, ips []*net.IPNet) error {
+	if err := appendToFile(i.file.AddOnHostsFile, i.file.hostName(podName), containerID, aliases, ips,
+		i.file.hostsLimit()); err != nil {
+		return err
+	}
+	// the shared view is informational only, it must not fail the pod
+	if err := syncSharedHosts(i.file); err != nil {
+		logrus.Warnf("unable to update shared hosts file: %v", err)
+	}
+	return nil
+}
+
+// Nameservers returns the addresses the instance serves the pods on
+func (i *Instance) Nameservers() ([]string, error) {
+	return getInterfaceAddresses(i.file)
+}
+
+// Reload writes the conf file of the instance and applies the changed files,
+// starting the instance if it is not running. serversChanged tells if the
+// server files were changed.
+func (i *Instance) Reload(ctx context.Context, serversChanged bool) error {
+	confChanged, err := checkForDNSMasqConfFile(ctx, i.file)
+	if err != nil {
+		return err
+	}
+	if err := i.file.shareWithDNSMasq(); err != nil {
+		return errors.Wrap(err, "unable to give the dnsmasq user access to its files")
+	}
+	return i.file.reload(ctx, serversChanged, confChanged)
+}
+
+// RemovePod removes the pod from the instance, which is torn down along with
+// its last pod
+func (i *Instance) RemovePod(ctx context.Context, podName, containerID string, ips []*net.IPNet) error {
+	return cleanUp(ctx, podName, containerID, i.file, i.conf.MultiDomain, ips)
+}
+
+// Teardown removes the instance whether it has pods or not
+func (i *Instance) Teardown(ctx context.Context) error {
+	return teardownInstance(ctx, i.file, i.conf.MultiDomain)
+}
+
+// teardownInstance removes the instance along with its servers from the
+// peers and updates the shared hosts file
+func teardownInstance(ctx context.Context, conf dnsNameFile, multiDomain bool) error {
+	var errs []error
+	nameservers, err := getInterfaceAddresses(conf)
+	if err != nil {
+		// the instance is removed anyway, only its servers stay with the peers
+		errs = append(errs, errors.Wrap(err, "unable to get the servers to remove from the peers"))
+	}
+	if err := teardown(ctx, conf, multiDomain && nameservers != nil, nameservers); err != nil {
+		errs = append(errs, err)
+	}
+	if err := syncSharedHosts(conf); err != nil {
+		logrus.Warnf("unable to remove shared hosts file: %v", err)
+	}
+	return stderrors.Join(errs...)
+}
@@ -0,0 +1,59 @@
+package dnsname
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestInstanceSteps(t *testing.T) {
+	setupFakeDNSMasq(t)
+	conf, result, err := ParseConfig([]byte(`{"cniVersion": "1.0.0", "name": "net1", "type": "dnsname",
+		"domainName": "net1.org", "disableRedirect": true, "prevResult": {"cniVersion": "1.0.0",
+		"interfaces": [{"name": "cni1"}], "ips": [{"address": "10.88.0.2/16", "interface": 0}]}}`))
+	if err != nil {
+		t.Fatalf("ParseConfig() error = %v", err)
+	}
+	instance, err := NewInstance(conf, result)
+	if err != nil {
+		t.Fatalf("NewInstance() error = %v", err)
+	}
+	if instance.file.InstanceDir != makePath("net1", "") || instance.file.NetworkInterface != "cni1" {
+		t.Errorf("NewInstance() got = '%v' '%v'", instance.file.InstanceDir, instance.file.NetworkInterface)
+	}
+	procs := newFakeProcessManager(instance.file.PidFile)
+	instance.file.procManager = procs
+	if err := instance.MakeDirs(); err != nil {
+		t.Fatalf("MakeDirs() error = %v", err)
+	}
+	unlock, err := instance.Lock()
+	if err != nil {
+		t.Fatalf("Lock() error = %v", err)
+	}
+	defer unlock()
+	ctx := context.Background()
+	if err := instance.AddRedirect(ctx); err != nil {
+		t.Fatalf("AddRedirect() error = %v", err)
+	}
+	for i, pod := range []string{"pod1", "pod2"} {
+		ips := []*net.IPNet{{IP: net.IP{10, 88, 0, byte(i + 2)}}}
+		if err := instance.AddHost(pod, "", []string{pod + "-web"}, ips); err != nil {
+			t.Fatalf("AddHost() error = %v", err)
+		}
+	}
+	if err := instance.RemovePod(ctx, "pod1", "", []*net.IPNet{{IP: net.IP{10, 88, 0, 2}}}); err != nil {
+		t.Fatalf("RemovePod() error = %v", err)
+	}
+	got, err := ioutil.ReadFile(instance.file.AddOnHostsFile)
+	if err != nil {
+		t.Fatalf("Can't read hosts: %v", err)
+	}
+	if want := "10.88.0.3\tpod2\tpod2-web\n"; string(got) != want {
+		t.Errorf("RemovePod() hosts got = '%v', want '%v'", string(got), want)
+	}
+	// the instance serving the left pod was started by the reload
+	if procs.runs != 1 {
+		t.Errorf("RemovePod() should start the instance, got %d starts", procs.runs)
+	}
+}
@@ -0,0 +1,236 @@
+//go:build integration
+
+package dnsname
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/vishvananda/netlink"
+)
+
+// The integration test runs a real dnsmasq in a new network namespace. It
+// needs root and dnsmasq in PATH: go test -tags integration -run TestIntegration
+
+const (
+	integrationInterface = "dnsname0"
+	integrationAddress   = "10.89.0.1"
+	integrationDomain    = "integration.test"
+)
+
+func TestIntegrationLifecycle(t *testing.T) {
+	testNS := newIntegrationNS(t)
+
+	ctx := context.Background()
+	conf, err := newDNSMasqFile(integrationDomain, integrationInterface, "integration", false)
+	if err != nil {
+		t.Fatalf("Can't create dnsmasq file: %v", err)
+	}
+	if err := os.MkdirAll(conf.InstanceDir, 0o700); err != nil {
+		t.Fatalf("Can't create network dir: %v", err)
+	}
+	if _, err := checkForDNSMasqConfFile(ctx, conf); err != nil {
+		t.Fatalf("Can't write conf file: %v", err)
+	}
+	// dnsmasq is started from the namespace thread and stays in the namespace
+	if err := testNS.Do(func(ns.NetNS) error { return conf.start(ctx) }); err != nil {
+		t.Fatalf("Can't start dnsmasq: %v", err)
+	}
+	defer conf.stop()
+	isRunning, pid := conf.isRunning()
+	if !isRunning {
+		t.Fatal("dnsmasq should be running")
+	}
+
+	podName := "pod1." + integrationDomain
+	if ip, err := queryIntegrationInstance(testNS, podName); err != nil || ip != nil {
+		t.Fatalf("%s should not resolve before it is added, got %v %v", podName, ip, err)
+	}
+	podIP := net.ParseIP("10.89.0.2")
+	if err := appendToFile(conf.AddOnHostsFile, "pod1", "", nil, []*net.IPNet{{IP: podIP}}, hostsLimit{}); err != nil {
+		t.Fatalf("Can't append to hosts file: %v", err)
+	}
+	if err := conf.hup(ctx); err != nil {
+		t.Fatalf("Can't hup: %v", err)
+	}
+	var ip net.IP
+	// dnsmasq rereads the hosts file asynchronously on SIGHUP
+	for i := 0; i < 10 && ip == nil; i++ {
+		if ip, err = queryIntegrationInstance(testNS, podName); err != nil {
+			t.Fatalf("Can't query dnsmasq: %v", err)
+		}
+		if ip == nil {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	if !podIP.Equal(ip) {
+		t.Fatalf("%s got = '%v', want '%v'", podName, ip, podIP)
+	}
+
+	if err := conf.stop(); err != nil {
+		t.Fatalf("Can't stop dnsmasq: %v", err)
+	}
+	exited := false
+	for i := 0; i < 10 && !exited; i++ {
+		exited = syscall.Kill(pid, 0) == syscall.ESRCH
+		if !exited {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	if !exited {
+		t.Errorf("dnsmasq %d should exit after stop", pid)
+	}
+	if isRunning, _ := conf.isRunning(); isRunning {
+		t.Error("Stopped instance should not be running")
+	}
+}
+
+func TestIntegrationAddTwice(t *testing.T) {
+	testNS := newIntegrationNS(t)
+
+	args := &skel.CmdArgs{
+		ContainerID: "pod1",
+		Args:        "K8S_POD_NAME=pod1",
+		StdinData: []byte(`{"cniVersion": "1.0.0", "name": "integration", "type": "dnsname",
+			"domainName": "` + integrationDomain + `", "multiDomain": true, "remoteServers": ["10.89.0.254"],
+			"disableRedirect": true,
+			"prevResult": {"cniVersion": "1.0.0", "interfaces": [{"name": "` + integrationInterface + `"}],
+				"ips": [{"address": "10.89.0.2/24"}]}}`),
+	}
+	add := func() map[string]string {
+		if err := testNS.Do(func(ns.NetNS) error {
+			_, err := Add(args)
+			return err
+		}); err != nil {
+			t.Fatalf("Can't add pod: %v", err)
+		}
+		files := make(map[string]string)
+		items, err := os.ReadDir(makePath("integration", ""))
+		if err != nil {
+			t.Fatalf("Can't read network dir: %v", err)
+		}
+		for _, item := range items {
+			if item.IsDir() {
+				continue
+			}
+			data, err := os.ReadFile(makePath("integration", item.Name()))
+			if err != nil {
+				t.Fatalf("Can't read %s: %v", item.Name(), err)
+			}
+			files[item.Name()] = string(data)
+		}
+		return files
+	}
+	defer func() {
+		if err := testNS.Do(func(ns.NetNS) error { return Del(args) }); err != nil {
+			t.Errorf("Can't delete pod: %v", err)
+		}
+	}()
+	first := add()
+	// a repeated ADD with the same inputs converges to the same files
+	if second := add(); !reflect.DeepEqual(first, second) {
+		t.Errorf("Files after the second ADD got = '%v', want '%v'", second, first)
+	}
+}
+
+// newIntegrationNS creates a network namespace with the network interface
+// dnsmasq listens on, the test is skipped without root or dnsmasq
+func newIntegrationNS(t *testing.T) ns.NetNS {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root")
+	}
+	if _, err := exec.LookPath("dnsmasq"); err != nil {
+		t.Skip("needs dnsmasq in PATH")
+	}
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+
+	testNS, err := testutils.NewNS()
+	if err != nil {
+		t.Fatalf("Can't create netns: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := testNS.Close(); err != nil {
+			t.Errorf("Can't close netns: %v", err)
+		}
+		if err := testutils.UnmountNS(testNS); err != nil {
+			t.Errorf("Can't unmount netns: %v", err)
+		}
+	})
+	if err := testNS.Do(func(ns.NetNS) error { return setupIntegrationInterface() }); err != nil {
+		t.Fatalf("Can't set up interface: %v", err)
+	}
+	return testNS
+}
+
+// setupIntegrationInterface creates the network interface dnsmasq listens on
+func setupIntegrationInterface() error {
+	if err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: integrationInterface}}); err != nil {
+		return err
+	}
+	link, err := netlink.LinkByName(integrationInterface)
+	if err != nil {
+		return err
+	}
+	addr, err := netlink.ParseAddr(integrationAddress + "/24")
+	if err != nil {
+		return err
+	}
+	if err := netlink.AddrAdd(link, addr); err != nil {
+		return err
+	}
+	return netlink.LinkSetUp(link)
+}
+
+// queryIntegrationInstance resolves the A record of the name with the
+// instance. It returns nil if the name does not exist.
+func queryIntegrationInstance(netNS ns.NetNS, name string) (net.IP, error) {
+	var conn net.Conn
+	// the socket belongs to the namespace it is created in
+	if err := netNS.Do(func(ns.NetNS) (err error) {
+		conn, err = net.DialTimeout("udp", net.JoinHostPort(integrationAddress, "53"), time.Second)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		return nil, err
+	}
+
+	// header: ID, recursion desired, one question
+	query := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range strings.Split(name, ".") {
+		query = append(query, byte(len(label)))
+		query = append(query, label...)
+	}
+	// root label, type A, class IN
+	query = append(query, 0, 0, 1, 0, 1)
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	reply := make([]byte, 512)
+	n, err := conn.Read(reply)
+	if err != nil {
+		return nil, err
+	}
+	reply = reply[:n]
+	if n < 12 || binary.BigEndian.Uint16(reply) != 0x1234 {
+		return nil, syscall.EBADMSG
+	}
+	if binary.BigEndian.Uint16(reply[6:]) == 0 {
+		return nil, nil
+	}
+	// a single answer without additional records, its address ends the reply
+	return net.IP(reply[n-4:]), nil
+}
@@ -0,0 +1,98 @@
+package dnsname
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// layoutFileName is the name of the file recording the layout version of
+	// the instance directory
+	layoutFileName = "layout.json"
+	// layoutVersion is the version of the file layout written by this plugin,
+	// it is increased whenever files of the instance are renamed or moved
+	layoutVersion = 1
+)
+
+// layoutState is the content of the layout file
+type layoutState struct {
+	Version int `json:"version"`
+}
+
+// layoutMigrations migrate an instance directory from the layout version
+// given by the index to the next one. Directories written before the layout
+// file was introduced are version 0, whose files are the ones of version 1.
+var layoutMigrations = []func(dir string) error{
+	func(string) error { return nil },
+}
+
+// layoutFile returns the path of the layout file of the instance
+func (d dnsNameFile) layoutFile() string {
+	return filepath.Join(d.InstanceDir, layoutFileName)
+}
+
+// readLayoutVersion reads the layout version of the instance directory
+func readLayoutVersion(path string) (int, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	var state layoutState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return 0, errors.Wrapf(err, "invalid layout file %s", path)
+	}
+	return state.Version, nil
+}
+
+// writeLayoutVersion records that the instance directory has the current layout
+func writeLayoutVersion(path string) error {
+	data, err := json.Marshal(layoutState{Version: layoutVersion})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0o600)
+}
+
+// migrateLayout brings the directory of an instance set up by an older plugin
+// to the current layout, so its running dnsmasq stays managed after an upgrade.
+// The migrated instance is reloaded to pick up moved files. Directories of a
+// newer plugin are refused rather than guessed at.
+func migrateLayout(ctx context.Context, conf dnsNameFile) error {
+	if _, err := os.Stat(conf.ConfigFile); os.IsNotExist(err) {
+		// a new instance, its layout file is written along with the conf file
+		return nil
+	}
+	version, err := readLayoutVersion(conf.layoutFile())
+	if err != nil {
+		return err
+	}
+	if version == layoutVersion {
+		return nil
+	}
+	dir := conf.InstanceDir
+	if version > layoutVersion {
+		return errors.Errorf("%s has layout version %d, this plugin supports up to %d", dir, version, layoutVersion)
+	}
+	for ; version < layoutVersion; version++ {
+		logrus.Infof("migrating %s from layout version %d", dir, version)
+		if err := layoutMigrations[version](dir); err != nil {
+			return errors.Wrapf(err, "unable to migrate %s from layout version %d", dir, version)
+		}
+	}
+	if err := writeLayoutVersion(conf.layoutFile()); err != nil {
+		return err
+	}
+	if isRunning, _ := conf.isRunning(); isRunning {
+		return conf.hup(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package dnsname
+
+import (
+	"context"
+	"io/ioutil"
+	"syscall"
+	"testing"
+)
+
+func TestMigrateLayout(t *testing.T) {
+	conf, procs := newTestDNSMasqFile(t)
+	// a new instance has nothing to migrate
+	if err := migrateLayout(context.Background(), conf); err != nil {
+		t.Fatalf("migrateLayout() error = %v", err)
+	}
+	if version, err := readLayoutVersion(conf.layoutFile()); err != nil || version != 0 {
+		t.Errorf("readLayoutVersion() got = '%v' '%v', want '0'", version, err)
+	}
+	// an instance of a plugin without layout file is migrated and reloaded
+	if err := ioutil.WriteFile(conf.ConfigFile, []byte("interface=cni0\n"), 0o644); err != nil {
+		t.Fatalf("Can't write conf: %v", err)
+	}
+	if err := conf.hup(context.Background()); err != nil {
+		t.Fatalf("Can't start: %v", err)
+	}
+	if err := migrateLayout(context.Background(), conf); err != nil {
+		t.Fatalf("migrateLayout() error = %v", err)
+	}
+	if version, err := readLayoutVersion(conf.layoutFile()); err != nil || version != layoutVersion {
+		t.Errorf("readLayoutVersion() got = '%v' '%v', want '%v'", version, err, layoutVersion)
+	}
+	if len(procs.signals) != 1 || procs.signals[0] != syscall.SIGHUP {
+		t.Errorf("migrateLayout() signals got = '%v', want '[hangup]'", procs.signals)
+	}
+	// a migrated instance is left alone
+	if err := migrateLayout(context.Background(), conf); err != nil || len(procs.signals) != 1 {
+		t.Errorf("migrateLayout() got = '%v' '%v'", err, procs.signals)
+	}
+	// the layout of a newer plugin is refused
+	if err := ioutil.WriteFile(conf.layoutFile(), []byte(`{"version": 99}`), 0o600); err != nil {
+		t.Fatalf("Can't write layout file: %v", err)
+	}
+	if err := migrateLayout(context.Background(), conf); err == nil {
+		t.Error("migrateLayout() should fail for a newer layout")
+	}
+}
@@ -0,0 +1,87 @@
+package dnsname
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// lifetimeFileName is the name of the file recording when an instance with a
+// maximum lifetime was set up
+const lifetimeFileName = "lifetime"
+
+// lifetimeState describes an instance with a maximum lifetime, with what gc
+// needs to tear it down once the lifetime expired
+type lifetimeState struct {
+	Created  time.Time `json:"created"`
+	Lifetime Duration  `json:"lifetime"`
+	teardownState
+}
+
+// expired checks if the lifetime of the instance passed
+func (s lifetimeState) expired(now time.Time) bool {
+	return s.Lifetime.Duration > 0 && now.After(s.Created.Add(s.Lifetime.Duration))
+}
+
+// lifetimeFile returns the path of the lifetime file of the instance
+func (d dnsNameFile) lifetimeFile() string {
+	return filepath.Join(d.InstanceDir, lifetimeFileName)
+}
+
+// recordLifetime writes the lifetime file of the instance for gc. The
+// creation time is kept once written, so the pods added later don't extend
+// the lifetime. The file is removed if the lifetime is unset.
+func recordLifetime(conf dnsNameFile, multiDomain bool, nameservers []string) error {
+	if conf.MaxInstanceLifetime.Duration == 0 {
+		if err := os.Remove(conf.lifetimeFile()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	created := time.Now()
+	if state, err := readLifetimeState(conf.lifetimeFile()); err == nil && state != nil {
+		created = state.Created
+	}
+	data, err := json.Marshal(lifetimeState{
+		Created:       created,
+		Lifetime:      conf.MaxInstanceLifetime,
+		teardownState: newTeardownState(conf, multiDomain, nameservers),
+	})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(conf.lifetimeFile(), data, 0o600)
+}
+
+// readLifetimeState reads the lifetime file of an instance, nil means the
+// instance has no maximum lifetime
+func readLifetimeState(path string) (*lifetimeState, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var state lifetimeState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, errors.Wrapf(err, "invalid lifetime file %s", path)
+	}
+	return &state, nil
+}
+
+// matchExpired matches the instances whose lifetime expired, whether they have
+// pods or not
+func matchExpired(networkName string, now time.Time) (*teardownState, string, error) {
+	state, err := readLifetimeState(makePath(networkName, lifetimeFileName))
+	if err != nil || state == nil || !state.expired(now) {
+		return nil, "", err
+	}
+	return &state.teardownState, fmt.Sprintf("created %s, its lifetime of %s expired",
+		state.Created.Format(time.RFC3339), state.Lifetime), nil
+}
@@ -0,0 +1,86 @@
+package dnsname
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGCExpiredInstances(t *testing.T) {
+	setupFakeDNSMasq(t)
+	now := time.Now()
+	states := map[string]*lifetimeState{
+		"net1": {Created: now.Add(-time.Hour), Lifetime: Duration{time.Minute}, teardownState: teardownState{
+			Domain: "net1.org", Interface: "cni1", DisableRedirect: true}},
+		"net2": {Created: now.Add(-time.Hour), Lifetime: Duration{2 * time.Hour}, teardownState: teardownState{
+			Domain: "net2.org", Interface: "cni2", DisableRedirect: true}},
+		"net3": nil,
+	}
+	for network, state := range states {
+		if err := os.MkdirAll(makePath(network, ""), 0o700); err != nil {
+			t.Fatalf("Can't create network dir: %v", err)
+		}
+		// the instances still have pods
+		if err := ioutil.WriteFile(makePath(network, hostsFileName), []byte("10.88.0.2\tpod1\n"), 0o644); err != nil {
+			t.Fatalf("Can't write hosts: %v", err)
+		}
+		if state == nil {
+			continue
+		}
+		data, err := json.Marshal(state)
+		if err != nil {
+			t.Fatalf("Can't marshal lifetime state: %v", err)
+		}
+		if err := ioutil.WriteFile(makePath(network, lifetimeFileName), data, 0o600); err != nil {
+			t.Fatalf("Can't write lifetime file: %v", err)
+		}
+	}
+	removed, err := gcInstances("expired", matchExpired, now)
+	if err != nil {
+		t.Fatalf("gcInstances() error = %v", err)
+	}
+	if !reflect.DeepEqual(removed, []string{"net1"}) {
+		t.Errorf("gcInstances() got = '%v', want '%v'", removed, []string{"net1"})
+	}
+	for network := range states {
+		_, err := os.Stat(makePath(network, ""))
+		if exists := err == nil; exists != (network != "net1") {
+			t.Errorf("network %s exists = %v", network, exists)
+		}
+	}
+}
+
+func TestRecordLifetime(t *testing.T) {
+	conf, _ := newTestDNSMasqFile(t)
+	conf.MaxInstanceLifetime = Duration{time.Hour}
+	if err := recordLifetime(conf, false, []string{"10.88.0.1"}); err != nil {
+		t.Fatalf("recordLifetime() error = %v", err)
+	}
+	state, err := readLifetimeState(conf.lifetimeFile())
+	if err != nil || state == nil {
+		t.Fatalf("readLifetimeState() got = '%v' '%v'", state, err)
+	}
+	// a later pod doesn't extend the lifetime
+	conf.MaxInstanceLifetime = Duration{2 * time.Hour}
+	if err := recordLifetime(conf, false, []string{"10.88.0.1"}); err != nil {
+		t.Fatalf("recordLifetime() error = %v", err)
+	}
+	updated, err := readLifetimeState(conf.lifetimeFile())
+	if err != nil || updated == nil {
+		t.Fatalf("readLifetimeState() got = '%v' '%v'", updated, err)
+	}
+	if !updated.Created.Equal(state.Created) || updated.Lifetime != conf.MaxInstanceLifetime {
+		t.Errorf("recordLifetime() got = '%v' '%v', want '%v' '%v'", updated.Created, updated.Lifetime,
+			state.Created, conf.MaxInstanceLifetime)
+	}
+	conf.MaxInstanceLifetime = Duration{}
+	if err := recordLifetime(conf, false, nil); err != nil {
+		t.Fatalf("recordLifetime() error = %v", err)
+	}
+	if _, err := os.Stat(conf.lifetimeFile()); !os.IsNotExist(err) {
+		t.Errorf("Lifetime file should be removed without a lifetime, got %v", err)
+	}
+}
@@ -0,0 +1,206 @@
+package dnsname
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// Lock hierarchy
+//
+// All plugin operations are synchronized with flocks placed in the .locks
+// subdirectory of the lock directory, the configuration directory unless
+// LockDir is set. There are two levels of locks which are always acquired in
+// this order and released in reverse order:
+//
+//  1. the global lock (<lock dir>/.locks/lock) guards the whole configuration directory;
+//  2. the network lock (<lock dir>/.locks/<network>.lock) guards the files of one network.
+//
+// Operations which only touch the files of their own network (adding or removing
+// a pod of a single-domain network) take the global lock shared and the network
+// lock exclusive, so they do not serialize with operations on other networks.
+// Operations which walk or modify other networks (propagating the servers of a
+// multi-domain network by addLocalServers and removeLocalServers) take the global
+// lock exclusive, which excludes every other operation, and need no network lock.
+//
+// The locks are polled until the deadline of the operation's context, so an
+// operation stuck with a lock fails the others with ErrTimeout instead of
+// blocking them until the runtime gives up.
+
+const (
+	// lockDirName is the subdirectory of the lock directory with the lock
+	// files. CNI network names can't start with a dot, so it is never the
+	// directory of an instance, and the lock files of the networks don't share
+	// a namespace with the instances.
+	lockDirName = ".locks"
+	// globalLockFileName is the name of the lock file guarding the whole configuration directory
+	globalLockFileName = "lock"
+	// networkLockFileSuffix is the suffix of the lock file guarding a single network
+	networkLockFileSuffix = ".lock"
+	// lockDirEnv is the environment variable giving the lock directory to the
+	// maintenance commands, which run without the network configuration
+	lockDirEnv = "DNSNAME_LOCK_DIR"
+)
+
+const (
+	// defaultLockTimeout is the default time limit for acquiring the locks
+	defaultLockTimeout = time.Minute
+	// defaultLockPollInterval is the default interval the locks are polled in
+	defaultLockPollInterval = 50 * time.Millisecond
+	// slowLockThreshold is the wait for the locks which gets logged
+	slowLockThreshold = time.Second
+)
+
+// dnsNameLock is a flock on a file in the configuration directory
+type dnsNameLock struct {
+	file *os.File
+}
+
+// release unlocks and closes the lock file.
+func (m *dnsNameLock) release() error {
+	if err := unix.Flock(int(m.file.Fd()), unix.LOCK_UN); err != nil {
+		m.file.Close()
+		return err
+	}
+	return m.file.Close()
+}
+
+// acquire takes the lock exclusively.
+func (m *dnsNameLock) acquire(ctx context.Context, pollInterval time.Duration) error {
+	return m.poll(ctx, unix.LOCK_EX, pollInterval)
+}
+
+// acquireShared takes the lock shared.
+func (m *dnsNameLock) acquireShared(ctx context.Context, pollInterval time.Duration) error {
+	return m.poll(ctx, unix.LOCK_SH, pollInterval)
+}
+
+// poll tries to take the lock every pollInterval until the context is done
+func (m *dnsNameLock) poll(ctx context.Context, how int, pollInterval time.Duration) error {
+	start := time.Now()
+	for {
+		err := flock(m.file, how|unix.LOCK_NB)
+		if err != unix.EWOULDBLOCK {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ErrTimeout, "failed to acquire lock %s within %s, likely another plugin instance is stuck",
+				m.file.Name(), time.Since(start).Round(time.Millisecond))
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// getLock returns the dnsNameLock for the given key in the lock directory, the
+// configuration directory if empty. An empty key returns the global lock,
+// otherwise the key is the name of the network to lock.
+func getLock(lockDir, key string) (*dnsNameLock, error) {
+	if lockDir == "" {
+		lockDir = dnsNameConfPath()
+	}
+	lockDir = filepath.Join(lockDir, lockDirName)
+	// the directory may not exist yet or anymore, e.g. on DEL
+	if err := os.MkdirAll(lockDir, 0o700); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(lockDir, globalLockFileName)
+	if key != "" {
+		path = filepath.Join(lockDir, key+networkLockFileSuffix)
+	}
+	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &dnsNameLock{f}, nil
+}
+
+// networkLock is the set of locks held by an operation on a network
+type networkLock struct {
+	locks []*dnsNameLock
+}
+
+// lockNetwork acquires the locks needed to operate on the given network according
+// to the lock hierarchy, in the lock directory if set. crossNetwork should be
+// set if the operation touches the files of other networks. The locks are
+// polled every pollInterval until the context is done.
+func lockNetwork(ctx context.Context, lockDir, networkName string, crossNetwork bool, pollInterval time.Duration) (*networkLock, error) {
+	start := time.Now()
+	defer func() {
+		if wait := time.Since(start); wait > slowLockThreshold {
+			logrus.Warnf("acquiring the lock for %q took %s", networkName, wait.Round(time.Millisecond))
+		}
+	}()
+	l := &networkLock{}
+	global, err := getLock(lockDir, "")
+	if err != nil {
+		return nil, err
+	}
+	if crossNetwork {
+		err = global.acquire(ctx, pollInterval)
+	} else {
+		err = global.acquireShared(ctx, pollInterval)
+	}
+	if err != nil {
+		global.file.Close()
+		return nil, err
+	}
+	l.locks = append(l.locks, global)
+	if crossNetwork {
+		return l, nil
+	}
+	network, err := getLock(lockDir, networkName)
+	if err == nil {
+		if err = network.acquire(ctx, pollInterval); err != nil {
+			network.file.Close()
+		}
+	}
+	if err != nil {
+		if releaseErr := l.release(); releaseErr != nil {
+			logrus.Errorf("unable to release lock for %q: %v", networkName, releaseErr)
+		}
+		return nil, err
+	}
+	l.locks = append(l.locks, network)
+	return l, nil
+}
+
+// lockNetwork acquires the locks of the instance of the network within the
+// lock timeout of the configuration
+func (c *DNSNameConf) lockNetwork() (*networkLock, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.lockTimeout())
+	defer cancel()
+	return lockNetwork(ctx, c.LockDir, c.instanceName(), c.MultiDomain, c.lockPollInterval())
+}
+
+// commandLockDir returns the lock directory of the maintenance commands
+func commandLockDir() string {
+	return os.Getenv(lockDirEnv)
+}
+
+// release releases the held locks in reverse order of acquisition
+func (l *networkLock) release() error {
+	var firstErr error
+	for i := len(l.locks) - 1; i >= 0; i-- {
+		if err := l.locks[i].release(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	l.locks = nil
+	return firstErr
+}
+
+// flock applies the lock operation to the file, retrying if interrupted
+func flock(f *os.File, how int) error {
+	for {
+		err := unix.Flock(int(f.Fd()), how)
+		if err != unix.EINTR {
+			return err
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package dnsname
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func lockInBackground(networkName string, crossNetwork bool) (<-chan *networkLock, <-chan error) {
+	locked := make(chan *networkLock, 1)
+	failed := make(chan error, 1)
+	go func() {
+		l, err := lockNetwork(context.Background(), "", networkName, crossNetwork, time.Millisecond)
+		if err != nil {
+			failed <- err
+			return
+		}
+		locked <- l
+	}()
+	return locked, failed
+}
+
+func TestLockNetwork(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	if err := os.MkdirAll(dnsNameConfPath(), 0o700); err != nil {
+		t.Fatalf("Can't create conf dir: %v", err)
+	}
+	net1, err := lockNetwork(context.Background(), "", "net1", false, time.Millisecond)
+	if err != nil {
+		t.Fatalf("Can't lock net1: %v", err)
+	}
+	// a different network is not blocked by net1
+	net2, err := lockNetwork(context.Background(), "", "net2", false, time.Millisecond)
+	if err != nil {
+		t.Fatalf("Can't lock net2: %v", err)
+	}
+	if err := net2.release(); err != nil {
+		t.Fatalf("Can't release net2: %v", err)
+	}
+	// the same network is blocked until net1 is released
+	locked, failed := lockInBackground("net1", false)
+	select {
+	case <-locked:
+		t.Fatal("net1 should not be locked twice")
+	case err := <-failed:
+		t.Fatalf("Can't lock net1: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := net1.release(); err != nil {
+		t.Fatalf("Can't release net1: %v", err)
+	}
+	select {
+	case l := <-locked:
+		net1 = l
+	case err := <-failed:
+		t.Fatalf("Can't lock net1: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("net1 should be locked after release")
+	}
+	// cross network operations wait for all network operations
+	locked, failed = lockInBackground("net3", true)
+	select {
+	case <-locked:
+		t.Fatal("cross network lock should wait for net1")
+	case err := <-failed:
+		t.Fatalf("Can't lock net3: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := net1.release(); err != nil {
+		t.Fatalf("Can't release net1: %v", err)
+	}
+	select {
+	case l := <-locked:
+		if err := l.release(); err != nil {
+			t.Fatalf("Can't release net3: %v", err)
+		}
+	case err := <-failed:
+		t.Fatalf("Can't lock net3: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("cross network lock should be acquired after release")
+	}
+}
+
+func TestLockNetworkTimeout(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	net1, err := lockNetwork(context.Background(), "", "net1", false, time.Millisecond)
+	if err != nil {
+		t.Fatalf("Can't lock net1: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := lockNetwork(ctx, "", "net1", false, time.Millisecond); !errors.Is(err, ErrTimeout) {
+		t.Errorf("lockNetwork() error = %v, want %v", err, ErrTimeout)
+	}
+	if err := net1.release(); err != nil {
+		t.Fatalf("Can't release net1: %v", err)
+	}
+	// the failed attempt gave up the global lock it took
+	cross, err := lockNetwork(context.Background(), "", "net2", true, time.Millisecond)
+	if err != nil {
+		t.Fatalf("Can't lock all networks: %v", err)
+	}
+	if err := cross.release(); err != nil {
+		t.Fatalf("Can't release all networks: %v", err)
+	}
+}
+
+func TestLockDir(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	lockDir := t.TempDir()
+	l, err := lockNetwork(context.Background(), lockDir, "net1", false, time.Millisecond)
+	if err != nil {
+		t.Fatalf("Can't lock net1: %v", err)
+	}
+	defer l.release()
+	for _, name := range []string{globalLockFileName, "net1" + networkLockFileSuffix} {
+		if _, err := os.Stat(filepath.Join(lockDir, lockDirName, name)); err != nil {
+			t.Errorf("Lock file %s should be in the lock dir: %v", name, err)
+		}
+	}
+	// the configuration directory is left alone
+	if _, err := os.Stat(dnsNameConfPath()); !os.IsNotExist(err) {
+		t.Errorf("Conf dir should not be created, got %v", err)
+	}
+}
+
+func TestLockNetworkNames(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	// the instance directories of networks named like lock files are created
+	// before their lock is taken
+	for _, name := range []string{globalLockFileName, "foo" + networkLockFileSuffix} {
+		if err := os.MkdirAll(makePath(name, ""), 0o700); err != nil {
+			t.Fatalf("Can't create instance dir: %v", err)
+		}
+	}
+	var locks []*networkLock
+	defer func() {
+		for _, l := range locks {
+			l.release()
+		}
+	}()
+	// none of them share a lock file
+	for _, name := range []string{globalLockFileName, "foo", "foo" + networkLockFileSuffix} {
+		l, err := lockNetwork(context.Background(), "", name, false, time.Millisecond)
+		if err != nil {
+			t.Fatalf("Can't lock %s: %v", name, err)
+		}
+		locks = append(locks, l)
+	}
+}
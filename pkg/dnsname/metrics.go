@@ -0,0 +1,281 @@
+package dnsname
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// countersFileName is the name of the file in the configuration directory
+// keeping the operation counters across invocations
+const countersFileName = "counters.json"
+
+// operationCounters are the cumulative counts of plugin operations by command
+type operationCounters struct {
+	Operations map[string]uint64 `json:"operations"`
+	Errors     map[string]uint64 `json:"errors"`
+}
+
+// WithMetrics counts the invocations and the failures of a command
+func WithMetrics(command string, cmd func(*skel.CmdArgs) error) func(*skel.CmdArgs) error {
+	return func(args *skel.CmdArgs) error {
+		err := cmd(args)
+		if recordErr := recordOperation(command, err); recordErr != nil {
+			logrus.Warnf("unable to record %s metrics: %v", command, recordErr)
+		}
+		return err
+	}
+}
+
+// phaseTimer logs the durations of the phases of an operation on a network
+// at debug level, e.g. to tell lock contention from slow reloads. It does
+// nothing unless debug logging is enabled.
+type phaseTimer struct {
+	command string
+	network string
+	enabled bool
+	start   time.Time
+	last    time.Time
+}
+
+// newPhaseTimer starts timing the first phase of the command
+func newPhaseTimer(command, network string) *phaseTimer {
+	now := time.Now()
+	return &phaseTimer{command: command, network: network, enabled: logrus.IsLevelEnabled(logrus.DebugLevel),
+		start: now, last: now}
+}
+
+// done logs the time since the end of the previous phase as the duration of
+// the phase
+func (p *phaseTimer) done(phase string) {
+	if !p.enabled {
+		return
+	}
+	now := time.Now()
+	logrus.Debugf("%s %s: %s took %s", p.command, p.network, phase, now.Sub(p.last).Round(time.Microsecond))
+	p.last = now
+}
+
+// finish logs the duration of the whole operation
+func (p *phaseTimer) finish() {
+	if p.enabled {
+		logrus.Debugf("%s %s: took %s", p.command, p.network, time.Since(p.start).Round(time.Microsecond))
+	}
+}
+
+// recordOperation increments the persisted counters of the command
+func recordOperation(command string, opErr error) error {
+	if err := os.MkdirAll(dnsNameConfPath(), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dnsNameConfPath(), countersFileName), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// the counters file has its own lock, operations on different networks
+	// update it concurrently
+	if err := flock(f, unix.LOCK_EX); err != nil {
+		return err
+	}
+	counters, err := readCounters(f)
+	if err != nil {
+		// start over rather than fail forever on a broken file
+		logrus.Warnf("resetting unreadable %s: %v", countersFileName, err)
+		counters = operationCounters{}
+	}
+	if counters.Operations == nil {
+		counters.Operations = make(map[string]uint64)
+	}
+	if counters.Errors == nil {
+		counters.Errors = make(map[string]uint64)
+	}
+	counters.Operations[command]++
+	if opErr != nil {
+		counters.Errors[command]++
+	}
+	data, err := json.Marshal(counters)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err = f.WriteAt(data, 0)
+	return err
+}
+
+// readCounters reads the operation counters, an empty file has no counts
+func readCounters(r io.Reader) (operationCounters, error) {
+	var counters operationCounters
+	data, err := ioutil.ReadAll(r)
+	if err != nil || len(data) == 0 {
+		return counters, err
+	}
+	err = json.Unmarshal(data, &counters)
+	return counters, err
+}
+
+// writeMetrics writes the metrics of all networks in the Prometheus text format
+func writeMetrics(w io.Writer) error {
+	var networks []string
+	items, err := ioutil.ReadDir(dnsNameConfPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, item := range items {
+		if isInstanceDir(item) {
+			networks = append(networks, item.Name())
+		}
+	}
+	sort.Strings(networks)
+
+	running := 0
+	hostEntries := make(map[string]int)
+	restarts := make(map[string]int)
+	for _, network := range networks {
+		d := dnsNameFile{InstanceDir: makePath(network, ""), PidFile: makePath(network, pidFileName), ConfigFile: makePath(network, confFileName)}
+		if isRunning, _ := d.isRunning(); isRunning {
+			running++
+		}
+		count, err := countHostEntries(addOnHostsFile(network))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		hostEntries[network] = count
+		if restarts[network], err = readCount(makePath(network, restartsFileName)); err != nil {
+			return err
+		}
+	}
+
+	var counters operationCounters
+	if f, err := os.Open(filepath.Join(dnsNameConfPath(), countersFileName)); err == nil {
+		counters, err = readCounters(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	var b strings.Builder
+	writeMetricHeader(&b, "dnsname_networks", "gauge", "Number of networks managed by the plugin.")
+	fmt.Fprintf(&b, "dnsname_networks %d\n", len(networks))
+	writeMetricHeader(&b, "dnsname_host_entries", "gauge", "Number of host entries of the network.")
+	for _, network := range networks {
+		fmt.Fprintf(&b, "dnsname_host_entries{network=%q} %d\n", network, hostEntries[network])
+	}
+	writeMetricHeader(&b, "dnsname_instances_expected", "gauge", "Number of dnsmasq instances which should be running.")
+	fmt.Fprintf(&b, "dnsname_instances_expected %d\n", len(networks))
+	writeMetricHeader(&b, "dnsname_instances_running", "gauge", "Number of running dnsmasq instances.")
+	fmt.Fprintf(&b, "dnsname_instances_running %d\n", running)
+	writeMetricHeader(&b, "dnsname_instance_restarts_total", "counter", "Number of restarts of the dnsmasq instance of the network by its watcher.")
+	for _, network := range networks {
+		fmt.Fprintf(&b, "dnsname_instance_restarts_total{network=%q} %d\n", network, restarts[network])
+	}
+	writeMetricHeader(&b, "dnsname_operations_total", "counter", "Number of plugin invocations by command.")
+	for _, command := range sortedKeys(counters.Operations) {
+		fmt.Fprintf(&b, "dnsname_operations_total{command=%q} %d\n", command, counters.Operations[command])
+	}
+	writeMetricHeader(&b, "dnsname_errors_total", "counter", "Number of failed plugin invocations by command.")
+	for _, command := range sortedKeys(counters.Errors) {
+		fmt.Fprintf(&b, "dnsname_errors_total{command=%q} %d\n", command, counters.Errors[command])
+	}
+	_, err = io.WriteString(w, b.String())
+	return err
+}
+
+// writeMetricHeader writes the HELP and TYPE lines of a metric
+func writeMetricHeader(b *strings.Builder, name, metricType, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// podsHostsMarker prefixes the comment keeping the hosts file with the pods in
+// the conf file of a forwardOnly instance, which does not serve it
+const podsHostsMarker = "# pods-hosts="
+
+// addOnHostsFile returns the hosts file with the pods of the network as set
+// in its conf file, which may have a custom hosts file prefix
+func addOnHostsFile(networkName string) string {
+	path := makePath(networkName, hostsFileName)
+	if isGroupInstance(networkName) {
+		// the group instance reads a directory of hosts files
+		return path
+	}
+	data, err := ioutil.ReadFile(makePath(networkName, confFileName))
+	if err != nil {
+		return path
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		for _, prefix := range []string{"addn-hosts=", podsHostsMarker} {
+			if value := strings.TrimPrefix(line, prefix); value != line {
+				return value
+			}
+		}
+	}
+	return path
+}
+
+// countHostEntries counts the records of a hosts file
+func countHostEntries(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	count := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if isHostEntry(strings.Fields(scanner.Text())) {
+			count++
+		}
+	}
+	return count, scanner.Err()
+}
+
+// sortedKeys returns the keys of the map in order
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// cmdMetrics prints the metrics or, if a file is given, atomically replaces
+// the file with them, e.g. for the node exporter textfile collector
+func cmdMetrics(args []string) error {
+	if len(args) == 0 {
+		return writeMetrics(os.Stdout)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(args[0]), ".dnsname-metrics-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := writeMetrics(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), args[0])
+}
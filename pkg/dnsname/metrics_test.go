@@ -0,0 +1,107 @@
+package dnsname
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	hosts := map[string]string{
+		"net1": "10.88.0.2\tpod1\n10.88.0.3\tpod2\taliasPod2\n\n",
+		"net2": "10.89.0.2\tpod3\n",
+	}
+	for network, content := range hosts {
+		if err := os.MkdirAll(filepath.Join(dnsNameConfPath(), network), 0o700); err != nil {
+			t.Fatalf("Can't create network dir: %v", err)
+		}
+		if err := ioutil.WriteFile(makePath(network, hostsFileName), []byte(content), 0o644); err != nil {
+			t.Fatalf("Can't write hosts: %v", err)
+		}
+	}
+	// the hosts file of net3 has a custom prefix, which is found in its conf file
+	if err := os.MkdirAll(filepath.Join(dnsNameConfPath(), "net3"), 0o700); err != nil {
+		t.Fatalf("Can't create network dir: %v", err)
+	}
+	prefixedHostsFile := makePath("net3", "p-"+hostsFileName)
+	if err := ioutil.WriteFile(prefixedHostsFile, []byte("10.90.0.2\tpod4\n10.90.0.3\tpod5\n"), 0o644); err != nil {
+		t.Fatalf("Can't write hosts: %v", err)
+	}
+	if err := ioutil.WriteFile(makePath("net3", confFileName), []byte("addn-hosts="+prefixedHostsFile+"\n"), 0o644); err != nil {
+		t.Fatalf("Can't write conf file: %v", err)
+	}
+	// the conf file of the forwardOnly net4 only keeps its pods hosts file in a
+	// comment, ahead of the static hosts file it serves
+	if err := os.MkdirAll(filepath.Join(dnsNameConfPath(), "net4"), 0o700); err != nil {
+		t.Fatalf("Can't create network dir: %v", err)
+	}
+	forwardHostsFile := makePath("net4", "p-"+hostsFileName)
+	if err := ioutil.WriteFile(forwardHostsFile, []byte("10.91.0.2\tpod6\n"), 0o644); err != nil {
+		t.Fatalf("Can't write hosts: %v", err)
+	}
+	forwardConf := podsHostsMarker + forwardHostsFile + "\naddn-hosts=" + makePath("net4", staticHostsFileName) + "\n"
+	if err := ioutil.WriteFile(makePath("net4", confFileName), []byte(forwardConf), 0o644); err != nil {
+		t.Fatalf("Can't write conf file: %v", err)
+	}
+	for _, op := range []struct {
+		command string
+		err     error
+	}{{"add", nil}, {"add", errors.New("failed")}, {"add", nil}, {"del", nil}} {
+		if err := recordOperation(op.command, op.err); err != nil {
+			t.Fatalf("Can't record operation: %v", err)
+		}
+	}
+	metricsFile := filepath.Join(t.TempDir(), "dnsname.prom")
+	if err := cmdMetrics([]string{metricsFile}); err != nil {
+		t.Fatalf("Can't write metrics: %v", err)
+	}
+	data, err := ioutil.ReadFile(metricsFile)
+	if err != nil {
+		t.Fatalf("Can't read metrics: %v", err)
+	}
+	for _, want := range []string{
+		"dnsname_networks 4\n",
+		"dnsname_host_entries{network=\"net1\"} 2\n",
+		"dnsname_host_entries{network=\"net2\"} 1\n",
+		"dnsname_host_entries{network=\"net3\"} 2\n",
+		"dnsname_host_entries{network=\"net4\"} 1\n",
+		"dnsname_instances_expected 4\n",
+		"dnsname_instances_running 0\n",
+		"dnsname_operations_total{command=\"add\"} 3\n",
+		"dnsname_operations_total{command=\"del\"} 1\n",
+		"dnsname_errors_total{command=\"add\"} 1\n",
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("Metrics should contain %q, got:\n%s", want, data)
+		}
+	}
+}
+
+func TestPhaseTimer(t *testing.T) {
+	var buf bytes.Buffer
+	logrus.SetOutput(&buf)
+	t.Cleanup(func() {
+		logrus.SetOutput(os.Stderr)
+		logrus.SetLevel(logrus.InfoLevel)
+	})
+	newPhaseTimer("ADD", "net1").done("lock")
+	if buf.Len() != 0 {
+		t.Errorf("Phases should not be logged without debug logging, got '%s'", buf.String())
+	}
+	logrus.SetLevel(logrus.DebugLevel)
+	timer := newPhaseTimer("ADD", "net1")
+	timer.done("lock")
+	timer.finish()
+	for _, want := range []string{"ADD net1: lock took", "ADD net1: took"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("phaseTimer got = '%v', want '%v'", buf.String(), want)
+		}
+	}
+}
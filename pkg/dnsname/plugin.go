@@ -0,0 +1,523 @@
+// Package dnsname manages the dnsmasq instances of the dnsname CNI plugin. Add,
+// Check and Del implement the CNI commands, so the plugin binary and agents
+// embedding the plugin share the same on-disk state. Agents managing the pods
+// themselves use the steps of the commands through Instance.
+package dnsname
+
+import (
+	"context"
+	"encoding/json"
+	stderrors "errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// cleanUp removes the pod from the instance of the network. A failing step
+// does not keep the following ones from running, the errors of all of them
+// are returned together.
+func cleanUp(ctx context.Context, podname, containerID string, dnsNameConf dnsNameFile, multiDomain bool, ips []*net.IPNet) error {
+	var errs []error
+	if !dnsNameConf.DisableRedirect {
+		if err := deleteIPTablesChain(ctx, dnsNameConf); err != nil {
+			errs = append(errs, errors.Wrap(err, "unable to delete iptables rule"))
+		}
+	}
+
+	// DEL must be idempotent: the network directory is removed along with the
+	// last pod, so a repeated or concurrent DEL has nothing left to do
+	if _, err := os.Stat(dnsNameConf.InstanceDir); os.IsNotExist(err) {
+		logrus.Debugf("%s does not exist, nothing to clean up", dnsNameConf.InstanceDir)
+		return stderrors.Join(errs...)
+	}
+
+	hostsFileModified, removed, err := removeFromFile(dnsNameConf.AddOnHostsFile, dnsNameConf.hostName(podname), containerID)
+	if err != nil {
+		// whether the instance still has pods is unknown, so it is left as is
+		return stderrors.Join(append(errs, err)...)
+	}
+	// a pod has an entry per address, more are left over from an earlier ADD
+	if len(ips) > 0 && removed > len(ips) {
+		logrus.Warnf("removed %d entries of %s from %s for %d addresses, it had duplicate entries",
+			removed, podname, dnsNameConf.AddOnHostsFile, len(ips))
+	}
+
+	// the CNAMEs of the pod go even if its hosts entries are gone already
+	cnamesModified, err := removeCNAMEs(dnsNameConf.CNAMEFile, qualifyHostName(podname, dnsNameConf.Domain))
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	if !hostsFileModified && dnsNameConf.Group != "" {
+		// the group instance keeps running for the other networks
+		return stderrors.Join(append(errs, leaveGroup(ctx, dnsNameConf))...)
+	}
+
+	if !hostsFileModified && dnsNameConf.KeepRunning {
+		// the instance waits for the next pod, gc removes it once idle for too long
+		if err := markIdle(ctx, dnsNameConf, multiDomain); err != nil {
+			errs = append(errs, err)
+		}
+
+		if err := syncSharedHosts(dnsNameConf); err != nil {
+			logrus.Warnf("unable to update shared hosts file: %v", err)
+		}
+
+		return stderrors.Join(errs...)
+	}
+
+	if !hostsFileModified {
+		// if there are no hosts, we should just stop the dnsmasq instance to not take
+		// system resources
+		return stderrors.Join(append(errs, teardownInstance(ctx, dnsNameConf, multiDomain))...)
+	}
+
+	addonHostsModified, err := removeHostLinesByIP(dnsNameConf.AddOnHostsFile, ips)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := syncSharedHosts(dnsNameConf); err != nil {
+		logrus.Warnf("unable to update shared hosts file: %v", err)
+	}
+
+	if hostsFileModified || addonHostsModified || cnamesModified {
+		if err := dnsNameConf.reload(ctx, false, cnamesModified); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return stderrors.Join(errs...)
+}
+
+// Add runs the CNI ADD command: it registers the pod with the dnsmasq instance
+// of its network and returns the previous result with the instance added as
+// nameserver, in the CNI version of the configuration.
+func Add(args *skel.CmdArgs) (_ types.Result, err error) {
+	netConf, result, pod, err := parseConfig(args.StdinData, args.Args, args.ContainerID)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse config")
+	}
+	timer := newPhaseTimer("ADD", netConf.Name)
+	defer timer.finish()
+	if netConf.PrevResult == nil {
+		return nil, errors.Wrap(ErrPrevResultMissing, "must be called as chained plugin")
+	}
+	if err := findDNSMasq(); err != nil {
+		if netConf.requireDNSMasq() {
+			return nil, ErrBinaryNotFound
+		}
+		// DNS is best effort for the network, the pod gets the previous result
+		logrus.Warnf("dnsmasq not found, %s is not served", pod.hostName())
+		return versionedResult(result, netConf.CNIVersion)
+	}
+	if err := netConf.checkIncludeConfFiles(); err != nil {
+		return nil, err
+	}
+	if err := netConf.checkDomainAllowed(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), netConf.commandTimeout())
+	defer cancel()
+	ips, err := getIPs(result)
+	if err != nil {
+		return nil, err
+	}
+	ips, err = applyIPVersionPreference(ips, netConf.IPVersionPreference, netConf.IPVersionOnly)
+	if err != nil {
+		return nil, err
+	}
+	// DEL removes the entries of all addresses, so the excluded ones are only
+	// dropped here; they were checked by parseConfig
+	excluded, _ := parseIPNets(netConf.ExcludeIPs)
+	if ips = excludeIPs(ips, excluded); len(ips) == 0 {
+		return nil, errors.Wrap(ErrNoIPAddressFound, "all addresses are excluded")
+	}
+	if !netConf.advertiseAllIPs() {
+		ips = primaryIPs(ips)
+	}
+	instance, err := NewInstance(netConf, result)
+	if err != nil {
+		return nil, err
+	}
+	dnsNameConf := instance.file
+	if err := instance.MakeDirs(); err != nil {
+		return nil, err
+	}
+	// multi-domain networks update the server files of their peers, so they need
+	// the whole configuration directory, see the lock hierarchy in lock.go
+	lock, err := netConf.lockNetwork()
+	if err != nil {
+		return nil, err
+	}
+	timer.done("lock")
+	// the instance must be left as is if it can't be migrated, so this is done
+	// before a failure cleans up
+	if err := migrateLayout(ctx, dnsNameConf); err != nil {
+		if err := lock.release(); err != nil {
+			logrus.Errorf("unable to release lock for %q: %v", netConf.Name, err)
+		}
+		return nil, err
+	}
+	var (
+		serverFiles       fileSnapshot
+		propagatedServers []string
+		serversModified   bool
+		cnamesModified    bool
+		confModified      bool
+	)
+	defer func() {
+		if err != nil {
+			// the ADD context may be already expired, so cleanup gets its own
+			cleanupCtx, cancel := context.WithTimeout(context.Background(), netConf.commandTimeout())
+			defer cancel()
+			if err := cleanUp(cleanupCtx, pod.hostName(), pod.containerID, dnsNameConf, netConf.MultiDomain, ips); err != nil {
+				logrus.Errorf("Can't cleanup: %v", err)
+			}
+			if err := rollbackServers(cleanupCtx, dnsNameConf, serverFiles, propagatedServers); err != nil {
+				logrus.Errorf("Can't roll back servers: %v", err)
+			}
+		}
+		if err := lock.release(); err != nil {
+			logrus.Errorf("unable to release lock for %q: %v", netConf.Name, err)
+		}
+	}()
+	// keep the server files as they were, so a failed ADD can be rolled back
+	if serverFiles, err = snapshotFiles(dnsNameConf.LocalServersConfFile, dnsNameConf.OwnServersConfFile); err != nil {
+		return nil, err
+	}
+	if netConf.Reconcile {
+		if err := reconcile(ctx, dnsNameConf, netConf.MultiDomain); err != nil {
+			return nil, errors.Wrap(err, "failed to reconcile dnsmasq instance")
+		}
+	}
+	if confModified, err = checkForDNSMasqConfFile(ctx, dnsNameConf); err != nil {
+		return nil, err
+	}
+	if err := clearIdle(dnsNameConf); err != nil {
+		return nil, err
+	}
+	timer.done("config")
+	if err := instance.AddRedirect(ctx); err != nil {
+		return nil, err
+	}
+	if !netConf.DisableRedirect {
+		timer.done("iptables")
+	}
+	aliases := mergeUnique(pod.extraNames(), netConf.RuntimeConfig.Aliases[netConf.Name])
+	if dnsNameConf.CNAMEAliases {
+		if cnamesModified, err = addCNAMEs(dnsNameConf.CNAMEFile, dnsNameConf.qualifiedNames(aliases),
+			qualifyHostName(pod.hostName(), dnsNameConf.Domain)); err != nil {
+			return nil, err
+		}
+		aliases = nil
+	}
+	// the service name is fully qualified already, it is the same on all networks
+	hostAliases := mergeUnique(dnsNameConf.hostAliases(pod.hostName(), dnsNameConf.hostNames(aliases)),
+		pod.serviceNames(netConf.ServiceDomain))
+	if err := instance.AddHost(pod.hostName(), pod.containerID, hostAliases, ips); err != nil {
+		return nil, err
+	}
+
+	// forward-only instances have the remote servers in their conf file
+	if len(netConf.RemoteServers) > 0 && !netConf.ForwardOnly {
+		if serversModified, err = addRemoteServers(dnsNameConf.LocalServersConfFile, netConf.RemoteServers); err != nil {
+			return nil, err
+		}
+	}
+
+	nameservers, err := getInterfaceAddresses(dnsNameConf)
+	if err != nil {
+		return nil, err
+	}
+	if isRunning, _ := dnsNameConf.isRunning(); !isRunning {
+		// report a resolver already listening on the addresses before dnsmasq
+		// fails to start because of it
+		if err := checkListenAddresses(nameservers, dnsNameConf.DNSPort); err != nil {
+			return nil, err
+		}
+	}
+	if netConf.MultiDomain {
+		if isRunning, _ := dnsNameConf.isRunning(); !isRunning {
+			propagatedServers = newOwnServers(dnsNameConf.Domain, dnsNameConf.DNSPort, nameservers, serverFiles[dnsNameConf.OwnServersConfFile])
+			if err := addLocalServers(ctx, dnsNameConf, nameservers); err != nil {
+				return nil, err
+			}
+			serversModified = true
+		}
+	}
+	if err := recordLifetime(dnsNameConf, netConf.MultiDomain, nameservers); err != nil {
+		return nil, err
+	}
+	if err := dnsNameConf.shareWithDNSMasq(); err != nil {
+		return nil, errors.Wrap(err, "unable to give the dnsmasq user access to its files")
+	}
+	timer.done("files")
+	// Now we need to HUP, or restart if the changed servers need it
+	if err := dnsNameConf.reload(ctx, serversModified, cnamesModified || confModified); err != nil {
+		return nil, err
+	}
+	timer.done("reload")
+	if netConf.ReloadTimeout.Duration > 0 {
+		if err := waitPodServed(ctx, dnsNameConf, pod.hostName(), nameservers, netConf.ReloadTimeout.Duration); err != nil {
+			return nil, err
+		}
+		timer.done("wait served")
+	}
+	if netConf.Critical {
+		// the pod is served, a missing watcher only delays a restart
+		if err := ensureWatcher(dnsNameConf, netConf.LockDir); err != nil {
+			logrus.Warnf("unable to start the watcher of %s: %v", netConf.Name, err)
+		}
+	}
+	// keep anything that was passed in already, the plugin may have been
+	// chained twice or the ADD repeated, so its own addresses are not repeated.
+	// The fallbacks follow the own addresses, the resolver tries them in order.
+	if !netConf.SuppressNameservers {
+		own := nameserverEndpoints(filterFamily(nameservers, netConf.NameserverFamily), dnsNameConf.DNSPort)
+		result.DNS.Nameservers = mergeNameservers(append(own, netConf.FallbackNameservers...), result.DNS.Nameservers)
+	}
+	setDNSSearch(&result.DNS, netConf)
+	result.DNS.Options = mergeDNSOptions(result.DNS.Options, pod.dnsOptions())
+	// Pass through the previous result
+	return versionedResult(result, netConf.CNIVersion)
+}
+
+// Del runs the CNI DEL command: it removes the pod from the dnsmasq instance of
+// its network and stops the instance along with the last pod.
+func Del(args *skel.CmdArgs) error {
+	netConf, result, pod, err := parseConfig(args.StdinData, args.Args, args.ContainerID)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse config")
+	}
+	if err := findDNSMasq(); err != nil {
+		if netConf.requireDNSMasq() {
+			return ErrBinaryNotFound
+		}
+		// without dnsmasq ADD registered nothing
+		logrus.Warnf("dnsmasq not found, nothing to clean up")
+		return nil
+	}
+	if result == nil {
+		// the rules of an earlier ADD would be left behind, the files are
+		// kept as the pod is unknown
+		return deleteOrphanedRules(netConf)
+	}
+	timer := newPhaseTimer("DEL", netConf.Name)
+	defer timer.finish()
+
+	ips, err := getIPs(result)
+	if err != nil {
+		return err
+	}
+
+	instance, err := NewInstance(netConf, result)
+	if err != nil {
+		return err
+	}
+	unlock, err := instance.Lock()
+	if err != nil {
+		return err
+	}
+	timer.done("lock")
+	defer func() {
+		// if the lock isn't given up by another process
+		if err := unlock(); err != nil {
+			logrus.Errorf("unable to release lock for %q: %v", netConf.Name, err)
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), netConf.commandTimeout())
+	defer cancel()
+	defer timer.done("cleanup")
+	return instance.RemovePod(ctx, pod.hostName(), pod.containerID, ips)
+}
+
+// deleteOrphanedRules deletes the iptables rules of the network on DEL
+// without a previous result. The members of a group share the comment of the
+// group instance, so their rules are only deleted along with the pods.
+func deleteOrphanedRules(netConf *DNSNameConf) error {
+	if netConf.DisableRedirect || netConf.InstanceGroup != "" {
+		return nil
+	}
+	dnsNameConf, err := newDNSMasqFile(netConf.DomainName, "", netConf.Name, netConf.MultiDomain)
+	if err != nil {
+		return err
+	}
+	dnsNameConf.setConfig(netConf)
+	lock, err := netConf.lockNetwork()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// if the lock isn't given up by another process
+		if err := lock.release(); err != nil {
+			logrus.Errorf("unable to release lock for %q: %v", netConf.Name, err)
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), netConf.commandTimeout())
+	defer cancel()
+	return errors.Wrap(deleteCommentedRules(ctx, dnsNameConf), "unable to delete iptables rules")
+}
+
+// Check runs the CNI CHECK command: it verifies that the dnsmasq instance of
+// the network is running.
+func Check(args *skel.CmdArgs) error {
+	netConf, result, _, err := parseConfig(args.StdinData, args.Args, args.ContainerID)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse config")
+	}
+	if err := findDNSMasq(); err != nil {
+		if netConf.requireDNSMasq() {
+			return ErrBinaryNotFound
+		}
+		logrus.Warnf("dnsmasq not found, the network is not served")
+		return nil
+	}
+
+	// Ensure we have previous result.
+	if result == nil {
+		return ErrPrevResultMissing
+	}
+	instance, err := NewInstance(netConf, result)
+	if err != nil {
+		return err
+	}
+	dnsNameConf := instance.file
+	unlock, err := instance.Lock()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// if the lock isn't given up by another process
+		if err := unlock(); err != nil {
+			logrus.Errorf("unable to release lock for %q: %v", netConf.Name, err)
+		}
+	}()
+	// Ensure the dnsmasq instance is running
+	if isRunning, _ := dnsNameConf.isRunning(); !isRunning {
+		return ErrDNSMasqNotRunning
+	}
+	// Above will make sure the pidfile exists, the files are the ones ADD
+	// and DEL use, including a custom hosts file prefix
+	for _, path := range []string{dnsNameConf.AddOnHostsFile, dnsNameConf.ConfigFile} {
+		if _, err := os.Stat(path); err != nil {
+			return errors.Wrap(ErrConfigFileMissing, filepath.Base(path))
+		}
+	}
+	return nil
+}
+
+// stringInSlice is simple util to check for the presence of a string
+// in a string slice
+func stringInSlice(s string, slice []string) bool {
+	for _, sl := range slice {
+		if s == sl {
+			return true
+		}
+	}
+	return false
+}
+
+type podname struct {
+	types.CommonArgs
+	K8S_POD_NAME      types.UnmarshallableString `json:"podname,omitempty"`
+	K8S_POD_NAMESPACE types.UnmarshallableString `json:"podnamespace,omitempty"`
+	// K8S_POD_HOSTNAME is the hostname of the pod if it differs from its name
+	K8S_POD_HOSTNAME types.UnmarshallableString `json:"podhostname,omitempty"`
+	// DNS_OPTIONS are resolver options of the pod separated by commas, e.g.
+	// "ndots:2,timeout:1"
+	DNS_OPTIONS types.UnmarshallableString `json:"dnsoptions,omitempty"`
+	// SERVICE_NAME is the name of the pod in the service domain, which is the
+	// same on all networks of the pod
+	SERVICE_NAME types.UnmarshallableString `json:"servicename,omitempty"`
+	// containerID is the CNI_CONTAINERID of the invocation, recorded with the
+	// entries of the pod so DEL removes exactly the entries of its ADD
+	containerID string
+}
+
+// hostName returns the name the pod is registered under in the hosts file.
+// Pods with the same name in different namespaces are told apart by
+// qualifying the name with the namespace, if the runtime provides it.
+func (p podname) hostName() string {
+	return p.qualify(string(p.K8S_POD_NAME))
+}
+
+// extraNames returns the names the pod is registered under besides its host
+// name: the hostname of the pod, if given and different from the pod name
+func (p podname) extraNames() []string {
+	if p.K8S_POD_HOSTNAME == "" || p.K8S_POD_HOSTNAME == p.K8S_POD_NAME {
+		return nil
+	}
+	return []string{p.qualify(string(p.K8S_POD_HOSTNAME))}
+}
+
+// serviceNames returns the fully qualified service name of the pod in the
+// service domain, none if either is not given
+func (p podname) serviceNames(serviceDomain string) []string {
+	if p.SERVICE_NAME == "" || serviceDomain == "" {
+		return nil
+	}
+	return []string{string(p.SERVICE_NAME) + "." + serviceDomain}
+}
+
+// dnsOptions returns the resolver options passed for the pod
+func (p podname) dnsOptions() []string {
+	var options []string
+	for _, option := range strings.Split(string(p.DNS_OPTIONS), ",") {
+		if option = strings.TrimSpace(option); option != "" {
+			options = append(options, option)
+		}
+	}
+	return options
+}
+
+// qualify qualifies the name with the namespace of the pod, if given
+func (p podname) qualify(name string) string {
+	if p.K8S_POD_NAMESPACE == "" {
+		return name
+	}
+	return name + "." + string(p.K8S_POD_NAMESPACE)
+}
+
+// parseConfig parses the supplied configuration (and prevResult) from stdin.
+func parseConfig(stdin []byte, args, containerID string) (*DNSNameConf, *current.Result, podname, error) {
+	conf := DNSNameConf{}
+	if err := json.Unmarshal(stdin, &conf); err != nil {
+		return nil, nil, podname{}, errors.Wrap(err, "failed to parse network configuration")
+	}
+	if err := checkUnknownFields(stdin); err != nil {
+		return nil, nil, podname{}, err
+	}
+	if err := conf.validate(); err != nil {
+		return nil, nil, podname{}, errors.Wrap(err, "invalid network configuration")
+	}
+
+	// Parse previous result.
+	var result *current.Result
+	if conf.RawPrevResult != nil {
+		var err error
+		if result, err = parsePrevResult(&conf.NetConf); err != nil {
+			return nil, nil, podname{}, errors.Wrap(err, "could not parse prevResult")
+		}
+		if err := checkPrevResult(result); err != nil {
+			return nil, nil, podname{}, err
+		}
+	}
+	e := podname{containerID: containerID}
+	if err := types.LoadArgs(args, &e); err != nil {
+		return nil, nil, podname{}, err
+	}
+	return &conf, result, e, nil
+}
+
+func findDNSMasq() error {
+	_, err := lookupDNSMasq()
+	return err
+}
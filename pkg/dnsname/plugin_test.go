@@ -0,0 +1,319 @@
+package dnsname
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+)
+
+func TestParseConfigPodName(t *testing.T) {
+	conf := []byte(`{"cniVersion": "0.4.0", "name": "test", "type": "dnsname", "domainName": "foobar.io"}`)
+	tests := []struct {
+		name      string
+		args      string
+		want      string
+		wantExtra []string
+	}{
+		{"no args", "", "", nil},
+		{"pod name", "K8S_POD_NAME=web", "web", nil},
+		{"pod namespace", "IgnoreUnknown=1;K8S_POD_NAME=web;K8S_POD_NAMESPACE=prod", "web.prod", nil},
+		{"hostname", "IgnoreUnknown=1;K8S_POD_NAME=web-0;K8S_POD_HOSTNAME=web", "web-0", []string{"web"}},
+		{"same hostname", "IgnoreUnknown=1;K8S_POD_NAME=web;K8S_POD_HOSTNAME=web", "web", nil},
+		{"hostname namespace", "IgnoreUnknown=1;K8S_POD_NAME=web-0;K8S_POD_NAMESPACE=prod;K8S_POD_HOSTNAME=web",
+			"web-0.prod", []string{"web.prod"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, pod, err := parseConfig(conf, tt.args, "")
+			if err != nil {
+				t.Fatalf("parseConfig() error = %v", err)
+			}
+			if pod.hostName() != tt.want {
+				t.Errorf("parseConfig() podname = %q, want %q", pod.hostName(), tt.want)
+			}
+			if !reflect.DeepEqual(pod.extraNames(), tt.wantExtra) {
+				t.Errorf("parseConfig() extra names = %v, want %v", pod.extraNames(), tt.wantExtra)
+			}
+		})
+	}
+}
+
+func TestParseConfigDNSOptions(t *testing.T) {
+	conf := []byte(`{"cniVersion": "0.4.0", "name": "test", "type": "dnsname", "domainName": "foobar.io"}`)
+	tests := []struct {
+		name string
+		args string
+		want []string
+	}{
+		{"no args", "K8S_POD_NAME=web", nil},
+		{"empty", "K8S_POD_NAME=web;DNS_OPTIONS=", nil},
+		{"options", "K8S_POD_NAME=web;DNS_OPTIONS=ndots:2, timeout:1,", []string{"ndots:2", "timeout:1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, pod, err := parseConfig(conf, tt.args, "")
+			if err != nil {
+				t.Fatalf("parseConfig() error = %v", err)
+			}
+			if !reflect.DeepEqual(pod.dnsOptions(), tt.want) {
+				t.Errorf("parseConfig() DNS options = %v, want %v", pod.dnsOptions(), tt.want)
+			}
+		})
+	}
+}
+
+func TestParseConfigServiceName(t *testing.T) {
+	conf := []byte(`{"cniVersion": "0.4.0", "name": "test", "type": "dnsname", "domainName": "foobar.io"}`)
+	_, _, pod, err := parseConfig(conf, "K8S_POD_NAME=web-0;SERVICE_NAME=web", "")
+	if err != nil {
+		t.Fatalf("parseConfig() error = %v", err)
+	}
+	if got := pod.serviceNames(""); got != nil {
+		t.Errorf("serviceNames() without domain got = '%v', want '%v'", got, nil)
+	}
+	want := []string{"web.svc.example"}
+	if got := pod.serviceNames("svc.example"); !reflect.DeepEqual(got, want) {
+		t.Errorf("serviceNames() got = '%v', want '%v'", got, want)
+	}
+}
+
+func TestParseConfigCNIVersion110(t *testing.T) {
+	conf := []byte(`{"cniVersion": "1.1.0", "name": "test", "type": "dnsname", "domainName": "foobar.io",
+		"prevResult": {"cniVersion": "1.1.0",
+			"interfaces": [{"name": "cni0", "mac": "aa:bb:cc:dd:ee:ff"}, {"name": "eth0", "sandbox": "/var/run/netns/test"}],
+			"ips": [{"address": "10.88.0.2/16", "gateway": "10.88.0.1", "interface": 1}],
+			"dns": {"nameservers": ["8.8.8.8"], "search": ["example.com"]}}}`)
+	if err := (&version.Reconciler{}).Check("1.1.0", SupportedVersions); err != nil {
+		t.Fatalf("1.1.0 should be supported: %v", err)
+	}
+	netConf, result, _, err := parseConfig(conf, "", "")
+	if err != nil {
+		t.Fatalf("parseConfig() error = %v", err)
+	}
+	if netConf.PrevResult == nil {
+		t.Fatal("parseConfig() prevResult not set")
+	}
+	if len(result.Interfaces) != 2 || result.Interfaces[0].Name != "cni0" || len(result.IPs) != 1 ||
+		len(result.DNS.Nameservers) != 1 || len(result.DNS.Search) != 1 {
+		t.Fatalf("parseConfig() lost prevResult fields: %+v", result)
+	}
+	versioned, err := versionedResult(result, netConf.CNIVersion)
+	if err != nil {
+		t.Fatalf("versionedResult() error = %v", err)
+	}
+	var out bytes.Buffer
+	if err := versioned.PrintTo(&out); err != nil {
+		t.Fatalf("Can't print result: %v", err)
+	}
+	var printed current.Result
+	if err := json.Unmarshal(out.Bytes(), &printed); err != nil {
+		t.Fatalf("Can't parse printed result: %v", err)
+	}
+	if printed.CNIVersion != "1.1.0" {
+		t.Errorf("versionedResult() cniVersion = %q, want %q", printed.CNIVersion, "1.1.0")
+	}
+	if !reflect.DeepEqual(printed.Interfaces, result.Interfaces) || !reflect.DeepEqual(printed.DNS, result.DNS) {
+		t.Errorf("versionedResult() got = '%+v', want '%+v'", printed, result)
+	}
+	if result.CNIVersion != current.ImplementedSpecVersion {
+		t.Errorf("versionedResult() modified the result version to %q", result.CNIVersion)
+	}
+}
+
+func TestCleanUpDisableRedirect(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	conf := dnsNameFile{
+		NetworkInterface: "cni0",
+		PidFile:          makePath("test", pidFileName),
+		DisableRedirect:  true,
+	}
+	// iptables is not touched, so the DEL of a removed network succeeds
+	// even where iptables is not available
+	if err := cleanUp(context.Background(), "pod1", "", conf, false, nil); err != nil {
+		t.Errorf("cleanUp() error = %v", err)
+	}
+}
+
+func TestCleanUpContinuesOnErrors(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	conf := dnsNameFile{
+		// the interface does not exist, so the servers of the instance are unknown
+		NetworkInterface: "dnsname-test0",
+		InstanceDir:      makePath("test", ""),
+		PidFile:          makePath("test", pidFileName),
+		AddOnHostsFile:   makePath("test", hostsFileName),
+	}
+	if err := os.MkdirAll(makePath("test", ""), 0o700); err != nil {
+		t.Fatalf("Can't create network dir: %v", err)
+	}
+	if err := ioutil.WriteFile(conf.AddOnHostsFile, []byte("10.88.0.2\tpod1\n"), 0o644); err != nil {
+		t.Fatalf("Can't write hosts: %v", err)
+	}
+	if err := cleanUp(context.Background(), "pod1", "", conf, false, nil); err == nil {
+		t.Error("cleanUp() should report the failed steps")
+	}
+	// the instance of the last pod is removed despite the failed steps
+	if _, err := os.Stat(makePath("test", "")); !os.IsNotExist(err) {
+		t.Errorf("Network dir should be removed, got %v", err)
+	}
+}
+
+// globalUnicastInterface returns an interface of the host with addresses
+// usable as nameservers
+func globalUnicastInterface(t *testing.T) string {
+	nics, err := net.Interfaces()
+	if err != nil {
+		t.Fatalf("Can't list interfaces: %v", err)
+	}
+	for _, nic := range nics {
+		addrs, err := nic.Addrs()
+		if err != nil {
+			continue
+		}
+		if nameservers, _ := filterNameserverAddresses(addrs, ""); len(nameservers) > 0 {
+			return nic.Name
+		}
+	}
+	t.Skip("No interface with global unicast addresses")
+	return ""
+}
+
+func TestCleanUpLastPodMultiDomain(t *testing.T) {
+	setupFakeDNSMasq(t)
+	conf := dnsNameFile{
+		Domain:               "net1.org",
+		NetworkInterface:     globalUnicastInterface(t),
+		InstanceDir:          makePath("net1", ""),
+		PidFile:              makePath("net1", pidFileName),
+		ConfigFile:           makePath("net1", confFileName),
+		AddOnHostsFile:       makePath("net1", hostsFileName),
+		LocalServersConfFile: makePath("net1", localServersConfFileName),
+		OwnServersConfFile:   makePath("net1", ownServersConfFileName),
+		DisableRedirect:      true,
+		procManager:          newFakeProcessManager(makePath("net1", pidFileName)),
+	}
+	nameservers, err := getInterfaceAddresses(conf)
+	if err != nil {
+		t.Fatalf("Can't get interface addresses: %v", err)
+	}
+	if err := createNetwork("net1", "server=/net2.org/192.168.2.1\n",
+		strings.Join(serversToServerItems(conf.Domain, 0, nameservers), "\n")+"\n"); err != nil {
+		t.Fatalf("Can't create network: %v", err)
+	}
+	peerServers := "server=/net3.org/192.168.3.1\n"
+	if err := createNetwork("net2", strings.Join(serversToServerItems(conf.Domain, 0, nameservers), "\n")+"\n"+peerServers,
+		"server=/net2.org/192.168.2.1\n"); err != nil {
+		t.Fatalf("Can't create network: %v", err)
+	}
+	if err := ioutil.WriteFile(conf.AddOnHostsFile, []byte("10.88.0.2\tpod1\n"), 0o644); err != nil {
+		t.Fatalf("Can't write hosts: %v", err)
+	}
+	if err := cleanUp(context.Background(), "pod1", "", conf, true, nil); err != nil {
+		t.Fatalf("cleanUp() error = %v", err)
+	}
+	got, err := ioutil.ReadFile(makePath("net2", localServersConfFileName))
+	if err != nil {
+		t.Fatalf("Can't read peer servers: %v", err)
+	}
+	if string(got) != peerServers {
+		t.Errorf("cleanUp() peer servers got = '%s', want '%s'", got, peerServers)
+	}
+	if _, err := os.Stat(makePath("net1", "")); !os.IsNotExist(err) {
+		t.Errorf("Network dir should be removed, got %v", err)
+	}
+	if _, err := os.Stat(makePath("net2", "")); err != nil {
+		t.Errorf("Peer network dir should be kept, got %v", err)
+	}
+}
+
+func TestAddDomainNotAllowed(t *testing.T) {
+	setupFakeDNSMasq(t)
+	args := &skel.CmdArgs{
+		ContainerID: "test",
+		StdinData: []byte(`{"cniVersion": "1.0.0", "name": "test", "type": "dnsname", "domainName": "foobar.io",
+			"allowedDomains": ["*.tenant1.org"], "prevResult": {"cniVersion": "1.0.0",
+			"interfaces": [{"name": "cni0"}], "ips": [{"address": "10.88.0.2/16", "interface": 0}]}}`),
+	}
+	if _, err := Add(args); !errors.Is(err, ErrDomainNotAllowed) {
+		t.Errorf("Add() error = %v, want %v", err, ErrDomainNotAllowed)
+	}
+	if _, err := os.Stat(makePath("test", "")); !os.IsNotExist(err) {
+		t.Errorf("Network dir should not be created, got %v", err)
+	}
+}
+
+func TestNoInterfaceInPrevResult(t *testing.T) {
+	setupFakeDNSMasq(t)
+	args := &skel.CmdArgs{
+		ContainerID: "test",
+		StdinData: []byte(`{"cniVersion": "1.0.0", "name": "test", "type": "dnsname", "domainName": "foobar.io",
+			"prevResult": {"cniVersion": "1.0.0", "ips": [{"address": "10.88.0.2/16"}]}}`),
+	}
+	if _, err := Add(args); !errors.Is(err, ErrNoInterfaceFound) {
+		t.Errorf("Add() error = %v, want %v", err, ErrNoInterfaceFound)
+	}
+	if err := Del(args); !errors.Is(err, ErrNoInterfaceFound) {
+		t.Errorf("Del() error = %v, want %v", err, ErrNoInterfaceFound)
+	}
+	if err := Check(args); !errors.Is(err, ErrNoInterfaceFound) {
+		t.Errorf("Check() error = %v, want %v", err, ErrNoInterfaceFound)
+	}
+}
+
+func TestEmptyPrevResult(t *testing.T) {
+	conf := `{"cniVersion": "1.0.0", "name": "test", "type": "dnsname", "domainName": "foobar.io", "prevResult": %s}`
+	tests := []struct {
+		name       string
+		prevResult string
+		want       error
+	}{
+		{"no interfaces", `{"cniVersion": "1.0.0", "ips": [{"address": "10.88.0.2/16"}]}`, ErrNoInterfaceFound},
+		{"no ips", `{"cniVersion": "1.0.0", "interfaces": [{"name": "cni0"}]}`, ErrNoIPAddressFound},
+		{"empty", `{"cniVersion": "1.0.0"}`, ErrNoInterfaceFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, _, err := parseConfig([]byte(fmt.Sprintf(conf, tt.prevResult)), "", ""); !errors.Is(err, tt.want) {
+				t.Errorf("parseConfig() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddWithoutDNSMasq(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	conf := `{"cniVersion": "1.0.0", "name": "test", "type": "dnsname", "domainName": "foobar.io", %s
+		"prevResult": {"cniVersion": "1.0.0", "interfaces": [{"name": "cni0"}], "ips": [{"address": "10.88.0.2/16"}]}}`
+	args := &skel.CmdArgs{ContainerID: "c1", StdinData: []byte(fmt.Sprintf(conf, ""))}
+	if _, err := Add(args); !errors.Is(err, ErrBinaryNotFound) {
+		t.Fatalf("Add() error = %v, want %v", err, ErrBinaryNotFound)
+	}
+	args.StdinData = []byte(fmt.Sprintf(conf, `"requireDNSMasq": false,`))
+	r, err := Add(args)
+	if err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	result, err := current.GetResult(r)
+	if err != nil {
+		t.Fatalf("Can't convert result: %v", err)
+	}
+	if len(result.IPs) != 1 || len(result.DNS.Nameservers) != 0 {
+		t.Errorf("Add() should pass the previous result through, got %+v", result)
+	}
+	if err := Del(args); err != nil {
+		t.Errorf("Del() error = %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+package dnsname
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// loadInstance returns the instance of the network as described by its conf
+// file, for the maintenance commands run without the network configuration.
+// It also reports if the network is a multi-domain one.
+func loadInstance(networkName string) (dnsNameFile, bool, error) {
+	confFile := makePath(networkName, confFileName)
+	if _, err := os.Stat(confFile); err != nil {
+		if os.IsNotExist(err) {
+			return dnsNameFile{}, false, errors.Errorf("no dnsmasq instance for network %s", networkName)
+		}
+		return dnsNameFile{}, false, err
+	}
+	target, err := readProbeTarget(confFile)
+	if err != nil {
+		return dnsNameFile{}, false, err
+	}
+	_, err = os.Stat(makePath(networkName, localServersConfFileName))
+	multiDomain := err == nil
+	conf, err := newDNSMasqFile(target.domain, target.iface, networkName, multiDomain)
+	if err != nil {
+		return dnsNameFile{}, false, err
+	}
+	conf.AddOnHostsFile = addOnHostsFile(networkName)
+	if target.port != defaultDNSPort {
+		conf.DNSPort = target.port
+	}
+	return conf, multiDomain, nil
+}
+
+// podAddresses returns the addresses of the pod in the hosts file
+func podAddresses(path, podname string) ([]*net.IPNet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var ips []*net.IPNet
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields, _ := splitHostLine(scanner.Text())
+		if len(fields) < 2 || fields[1] != podname {
+			continue
+		}
+		if ip := net.ParseIP(fields[0]); ip != nil {
+			ips = append(ips, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+		}
+	}
+	return ips, scanner.Err()
+}
+
+// removePod removes the records of a pod whose DEL never ran, e.g. as it was
+// force-deleted, the same way DEL does: the instance is reloaded, or torn down
+// if the pod was its last one.
+func removePod(ctx context.Context, conf dnsNameFile, multiDomain bool, podname string) error {
+	ips, err := podAddresses(conf.AddOnHostsFile, podname)
+	if err != nil {
+		return err
+	}
+	if len(ips) == 0 {
+		return errors.Errorf("pod %s not found in %s", podname, conf.AddOnHostsFile)
+	}
+	// unlike DEL, the redirect rule is only removed along with the instance,
+	// the remaining pods still need it
+	redirect := !conf.DisableRedirect
+	conf.DisableRedirect = true
+	if err := cleanUp(ctx, podname, "", conf, multiDomain, ips); err != nil {
+		return err
+	}
+	if _, err := os.Stat(conf.InstanceDir); redirect && os.IsNotExist(err) {
+		return deleteIPTablesChain(ctx, conf)
+	}
+	return nil
+}
+
+// cmdRemovePod removes the records of a pod from the instance of the network
+func cmdRemovePod(args []string) error {
+	if len(args) != 2 {
+		return errors.New("the network and the pod name are required")
+	}
+	networkName, podname := args[0], args[1]
+	conf, multiDomain, err := loadInstance(networkName)
+	if err != nil {
+		return err
+	}
+	lockCtx, cancel := context.WithTimeout(context.Background(), defaultLockTimeout)
+	defer cancel()
+	lock, err := lockNetwork(lockCtx, commandLockDir(), networkName, multiDomain, defaultLockPollInterval)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := lock.release(); err != nil {
+			logrus.Errorf("unable to release lock for %q: %v", networkName, err)
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), defaultCommandTimeout)
+	defer cancel()
+	if err := removePod(ctx, conf, multiDomain, podname); err != nil {
+		return err
+	}
+	fmt.Printf("removed pod %s from %s\n", podname, networkName)
+	return nil
+}
+
+// cmdListPods prints the records of the instance of the network
+func cmdListPods(args []string) error {
+	if len(args) != 1 {
+		return errors.New("the network name is required")
+	}
+	conf, _, err := loadInstance(args[0])
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(conf.AddOnHostsFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) > 1 {
+			fmt.Println(strings.Join(fields, " "))
+		}
+	}
+	return scanner.Err()
+}
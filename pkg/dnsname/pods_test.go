@@ -0,0 +1,70 @@
+package dnsname
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestLoadInstance(t *testing.T) {
+	setupFakeDNSMasq(t)
+	if err := os.MkdirAll(makePath("net1", ""), 0o700); err != nil {
+		t.Fatalf("Can't create network dir: %v", err)
+	}
+	hostsFile := makePath("net1", "app-"+hostsFileName)
+	confData := "interface=cni1\nport=5353\nlocal=/net1.org/\naddn-hosts=" + hostsFile + "\n"
+	if err := ioutil.WriteFile(makePath("net1", confFileName), []byte(confData), 0o644); err != nil {
+		t.Fatalf("Can't write conf: %v", err)
+	}
+	conf, multiDomain, err := loadInstance("net1")
+	if err != nil {
+		t.Fatalf("loadInstance() error = %v", err)
+	}
+	if conf.Domain != "net1.org" || conf.NetworkInterface != "cni1" || conf.DNSPort != 5353 ||
+		conf.AddOnHostsFile != hostsFile || multiDomain {
+		t.Errorf("loadInstance() got = '%+v' %v", conf, multiDomain)
+	}
+	if _, _, err := loadInstance("net2"); err == nil {
+		t.Error("loadInstance() should fail without instance")
+	}
+}
+
+func TestRemovePod(t *testing.T) {
+	setupFakeDNSMasq(t)
+	conf, procs := newTestDNSMasqFile(t)
+	conf.NetworkInterface = "lo"
+	conf.DisableRedirect = true
+	conf.AddOnHostsFile = filepath.Join(conf.InstanceDir, hostsFileName)
+	if err := ioutil.WriteFile(conf.AddOnHostsFile, []byte("10.88.0.2\tpod1\n10.88.0.3\tpod2\n"), 0o644); err != nil {
+		t.Fatalf("Can't write hosts: %v", err)
+	}
+	if err := conf.hup(context.Background()); err != nil {
+		t.Fatalf("Can't start: %v", err)
+	}
+	if err := removePod(context.Background(), conf, false, "pod3"); err == nil {
+		t.Error("removePod() should fail for an unknown pod")
+	}
+	if err := removePod(context.Background(), conf, false, "pod1"); err != nil {
+		t.Fatalf("removePod() error = %v", err)
+	}
+	got, err := ioutil.ReadFile(conf.AddOnHostsFile)
+	if err != nil {
+		t.Fatalf("Can't read hosts: %v", err)
+	}
+	if string(got) != "10.88.0.3\tpod2\n" {
+		t.Errorf("removePod() hosts got = '%s', want '%s'", got, "10.88.0.3\tpod2\n")
+	}
+	if len(procs.signals) != 1 || procs.signals[0] != syscall.SIGHUP {
+		t.Errorf("removePod() signals got = '%v', want '[hangup]'", procs.signals)
+	}
+	// the last pod takes the instance along
+	if err := removePod(context.Background(), conf, false, "pod2"); err != nil {
+		t.Fatalf("removePod() error = %v", err)
+	}
+	if _, err := os.Stat(conf.InstanceDir); !os.IsNotExist(err) {
+		t.Errorf("Network dir should be removed, got %v", err)
+	}
+}
@@ -0,0 +1,165 @@
+package dnsname
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// probeTimeout limits the time the probe query may take
+	probeTimeout = 2 * time.Second
+	// reloadPollInterval is the interval a reloaded instance is queried in
+	reloadPollInterval = 50 * time.Millisecond
+	// probeHostName is the sentinel name queried in the domain of the instance
+	probeHostName = "dnsname-probe"
+)
+
+// probeTarget is where the probe query of an instance is sent, as read from
+// its conf file
+type probeTarget struct {
+	domain    string
+	iface     string
+	addresses []string
+	port      int
+}
+
+// readProbeTarget reads the domain and the listen address of the instance from
+// its conf file, the first domain of group instances is probed
+func readProbeTarget(confFile string) (probeTarget, error) {
+	target := probeTarget{port: defaultDNSPort}
+	file, err := os.Open(confFile)
+	if err != nil {
+		return target, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "local":
+			if target.domain == "" {
+				target.domain = strings.Trim(value, "/")
+			}
+		case "server":
+			// forward-only instances forward their domain instead
+			if domain := strings.Split(value, "/"); target.domain == "" && len(domain) == 3 {
+				target.domain = domain[1]
+			}
+		case "interface":
+			if target.iface == "" {
+				target.iface = value
+			}
+		case "listen-address":
+			target.addresses = append(target.addresses, value)
+		case "port":
+			if target.port, err = strconv.Atoi(value); err != nil {
+				return target, errors.Wrapf(err, "invalid port in %s", confFile)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return target, err
+	}
+	if target.domain == "" {
+		return target, errors.Errorf("no domain found in %s", confFile)
+	}
+	return target, nil
+}
+
+// probeInstance checks that the dnsmasq instance of the network is running and
+// answers queries for its domain
+func probeInstance(ctx context.Context, networkName string) error {
+	d := dnsNameFile{InstanceDir: makePath(networkName, ""), PidFile: makePath(networkName, pidFileName), ConfigFile: makePath(networkName, confFileName)}
+	if isRunning, _ := d.isRunning(); !isRunning {
+		return errors.Errorf("dnsmasq instance of %s is not running", networkName)
+	}
+	target, err := readProbeTarget(d.ConfigFile)
+	if err != nil {
+		return err
+	}
+	server, err := instanceServer(networkName)
+	if err != nil {
+		return err
+	}
+	return resolveSentinel(ctx, server, probeHostName+"."+target.domain)
+}
+
+// resolveSentinel queries the name through the server. The name is not
+// expected to exist: a negative answer shows the server is serving its domain
+// as well as a positive one, only failing to get an answer is an error.
+func resolveSentinel(ctx context.Context, server, name string) error {
+	_, err := newResolver(server).LookupHost(ctx, name+".")
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return nil
+	}
+	return errors.Wrapf(err, "unable to resolve %s through %s", name, server)
+}
+
+// waitServed queries the name through the server until it is resolved, e.g.
+// after the hosts file of the instance was reloaded
+func waitServed(ctx context.Context, server, name string) error {
+	resolver := newResolver(server)
+	for {
+		if addrs, err := resolver.LookupHost(ctx, name+"."); err == nil && len(addrs) > 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ErrTimeout, "%s is not served by %s after reload", name, server)
+		case <-time.After(reloadPollInterval):
+		}
+	}
+}
+
+// waitPodServed waits until the instance serves the pod, the reload signalled
+// by hup takes effect asynchronously
+func waitPodServed(ctx context.Context, conf dnsNameFile, podName string, nameservers []string, timeout time.Duration) error {
+	if podName == "" || len(nameservers) == 0 {
+		logrus.Warnf("unable to check the reload of %s, no pod name or no address to query", conf.ConfigFile)
+		return nil
+	}
+	port := conf.DNSPort
+	if port == 0 {
+		port = defaultDNSPort
+	}
+	name := conf.hostName(podName)
+	if conf.Group == "" {
+		name += "." + conf.Domain
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return waitServed(ctx, net.JoinHostPort(nameservers[0], strconv.Itoa(port)), name)
+}
+
+// newResolver returns a resolver sending the queries to the server
+func newResolver(server string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// cmdProbe checks the health of the dnsmasq instance of the given network
+func cmdProbe(args []string) error {
+	if len(args) != 1 {
+		return errors.New("the network name is required")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	return probeInstance(ctx, args[0])
+}
@@ -0,0 +1,161 @@
+package dnsname
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReadProbeTarget(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    string
+		want    probeTarget
+		wantErr bool
+	}{
+		{"interface", "local=/foobar.org/\ndomain=foobar.org\ninterface=cni0\n",
+			probeTarget{domain: "foobar.org", iface: "cni0", port: defaultDNSPort}, false},
+		{"listen addresses and port", "local=/foobar.org/\nport=5353\nbind-interfaces\nlisten-address=10.88.0.1\n",
+			probeTarget{domain: "foobar.org", addresses: []string{"10.88.0.1"}, port: 5353}, false},
+		{"group", "local=/net1.org/\nlocal=/net2.org/\ninterface=cni1\ninterface=cni2\n",
+			probeTarget{domain: "net1.org", iface: "cni1", port: defaultDNSPort}, false},
+		{"forward only", "server=/foobar.org/10.10.0.1\ninterface=cni0\n",
+			probeTarget{domain: "foobar.org", iface: "cni0", port: defaultDNSPort}, false},
+		{"no domain", "interface=cni0\n", probeTarget{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			confFile := filepath.Join(t.TempDir(), confFileName)
+			if err := ioutil.WriteFile(confFile, []byte(tt.conf), 0o600); err != nil {
+				t.Fatalf("Can't write conf file: %v", err)
+			}
+			got, err := readProbeTarget(confFile)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readProbeTarget() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readProbeTarget() got = '%v', want '%v'", got, tt.want)
+			}
+		})
+	}
+}
+
+// serveNXDomain answers every query received on the connection with NXDOMAIN
+func serveNXDomain(conn net.PacketConn) {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		// the query is echoed as response with the QR, RA and NXDOMAIN bits set
+		buf[2] |= 0x80
+		buf[3] = 0x80 | 3
+		if _, err := conn.WriteTo(buf[:n], addr); err != nil {
+			return
+		}
+	}
+}
+
+// serveA answers the A queries received on the connection with the IP, the
+// other queries get an empty answer
+func serveA(conn net.PacketConn, ip net.IP) {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		// the reply repeats the header and the question, the additional
+		// records of the query (EDNS) are dropped
+		end := 12
+		for end < n && buf[end] != 0 {
+			end += int(buf[end]) + 1
+		}
+		end += 5
+		if end > n {
+			continue
+		}
+		reply := append([]byte{}, buf[:end]...)
+		reply[2] |= 0x80
+		reply[3] = 0x80
+		reply[11] = 0
+		// the question ends with the type and the class
+		if reply[end-3] == 1 {
+			reply[7] = 1
+			// name pointer to the question, type A, class IN, TTL, length, address
+			reply = append(reply, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+			reply = append(reply, ip.To4()...)
+		}
+		if _, err := conn.WriteTo(reply, addr); err != nil {
+			return
+		}
+	}
+}
+
+func TestWaitServed(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Can't listen: %v", err)
+	}
+	defer conn.Close()
+	go serveA(conn, net.IPv4(10, 88, 0, 2))
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	if err := waitServed(ctx, conn.LocalAddr().String(), "pod1.foobar.org"); err != nil {
+		t.Errorf("waitServed() error = %v", err)
+	}
+}
+
+func TestWaitServedTimeout(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Can't listen: %v", err)
+	}
+	defer conn.Close()
+	go serveNXDomain(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := waitServed(ctx, conn.LocalAddr().String(), "pod1.foobar.org"); !errors.Is(err, ErrTimeout) {
+		t.Errorf("waitServed() error = %v, want %v", err, ErrTimeout)
+	}
+}
+
+func TestResolveSentinel(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Can't listen: %v", err)
+	}
+	defer conn.Close()
+	go serveNXDomain(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	if err := resolveSentinel(ctx, conn.LocalAddr().String(), "dnsname-probe.foobar.org"); err != nil {
+		t.Errorf("resolveSentinel() error = %v", err)
+	}
+}
+
+func TestResolveSentinelNoAnswer(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Can't listen: %v", err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := resolveSentinel(ctx, conn.LocalAddr().String(), "dnsname-probe.foobar.org"); err == nil {
+		t.Error("resolveSentinel() should fail without answer")
+	}
+}
+
+func TestProbeInstanceNotRunning(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	if err := probeInstance(context.Background(), "net1"); err == nil {
+		t.Error("probeInstance() should fail without running instance")
+	}
+}
@@ -0,0 +1,169 @@
+package dnsname
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// processManager launches and signals dnsmasq processes. It lets the instance
+// lifecycle be tested without running a real dnsmasq.
+type processManager interface {
+	// run executes the binary and waits for it to exit, returning what it
+	// wrote to stdout and stderr. dnsmasq daemonizes itself, so run returns
+	// once the instance has been started. The process is killed and
+	// ErrTimeout returned if the context is done first.
+	run(ctx context.Context, binary string, args []string) (stdout, stderr []byte, err error)
+	// signal sends the signal to the process with the given PID. It returns
+	// os.ErrProcessDone if there is no such process.
+	signal(pid int, sig syscall.Signal) error
+	// cmdline returns the command line arguments of the process with the
+	// given PID. It returns an os.IsNotExist error if there is no such process.
+	cmdline(pid int) ([]string, error)
+	// find returns the PID of the process having the argument on its command
+	// line. It returns an os.IsNotExist error if there is no such process.
+	find(arg string) (int, error)
+	// schedule sets the nice value of the process with the given PID, unless
+	// it is 0, and restricts it to the given CPUs, unless there are none
+	schedule(pid int, nice int, cpus []int) error
+	// limitOpenFiles sets the limit of open files of the process with the
+	// given PID
+	limitOpenFiles(pid int, max uint64) error
+	// spawn starts the binary detached in its own session with the given
+	// environment and doesn't wait for it
+	spawn(binary string, args []string, env []string) error
+}
+
+// execProcessManager is the processManager of real processes
+type execProcessManager struct{}
+
+func (execProcessManager) run(ctx context.Context, binary string, args []string) ([]byte, []byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, binary, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil && ctx.Err() != nil {
+		return stdout.Bytes(), stderr.Bytes(), timeoutError(ctx, binary)
+	}
+	return stdout.Bytes(), stderr.Bytes(), err
+}
+
+func (execProcessManager) signal(pid int, sig syscall.Signal) error {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return process.Signal(sig)
+}
+
+func (execProcessManager) cmdline(pid int) ([]string, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimRight(string(data), "\x00"), "\x00"), nil
+}
+
+func (m execProcessManager) find(arg string) (int, error) {
+	items, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return 0, err
+	}
+	for _, item := range items {
+		pid, err := strconv.Atoi(item.Name())
+		if err != nil || !item.IsDir() {
+			continue
+		}
+		// processes may exit or be inaccessible while scanning
+		if cmdline, err := m.cmdline(pid); err == nil && stringInSlice(arg, cmdline) {
+			return pid, nil
+		}
+	}
+	return 0, &os.PathError{Op: "find process", Path: arg, Err: os.ErrNotExist}
+}
+
+func (execProcessManager) schedule(pid int, nice int, cpus []int) error {
+	if nice != 0 {
+		if err := unix.Setpriority(unix.PRIO_PROCESS, pid, nice); err != nil {
+			return errors.Wrap(err, "unable to set nice value")
+		}
+	}
+	if len(cpus) > 0 {
+		var set unix.CPUSet
+		for _, cpu := range cpus {
+			set.Set(cpu)
+		}
+		if err := unix.SchedSetaffinity(pid, &set); err != nil {
+			return errors.Wrap(err, "unable to set CPU affinity")
+		}
+	}
+	return nil
+}
+
+func (execProcessManager) limitOpenFiles(pid int, max uint64) error {
+	limit := unix.Rlimit{Cur: max, Max: max}
+	if err := unix.Prlimit(pid, unix.RLIMIT_NOFILE, &limit, nil); err != nil {
+		return errors.Wrap(err, "unable to set the open files limit")
+	}
+	return nil
+}
+
+func (execProcessManager) spawn(binary string, args []string, env []string) error {
+	cmd := exec.Command(binary, args...)
+	cmd.Env = env
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	return cmd.Process.Release()
+}
+
+// StartError describes a dnsmasq instance which failed to start, with the
+// output and exit code of dnsmasq kept apart, e.g. to check for a specific
+// stderr line. It matches ErrStartFailed and the underlying error.
+type StartError struct {
+	Stdout string
+	Stderr string
+	// ExitCode is the exit code of dnsmasq, -1 if it did not exit by itself
+	ExitCode int
+	Err      error
+}
+
+// newStartError returns the StartError of a dnsmasq run
+func newStartError(stdout, stderr []byte, err error) *StartError {
+	exitCode := 0
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		exitCode = exitErr.ExitCode()
+	} else if err != nil {
+		exitCode = -1
+	}
+	return &StartError{Stdout: string(stdout), Stderr: string(stderr), ExitCode: exitCode, Err: err}
+}
+
+func (e *StartError) Error() string {
+	msg := fmt.Sprintf("%v: %v, exit code %d", ErrStartFailed, e.Err, e.ExitCode)
+	if stderr := strings.TrimSpace(e.Stderr); stderr != "" {
+		msg += ", stderr: " + stderr
+	}
+	return msg
+}
+
+func (e *StartError) Unwrap() []error {
+	return []error{ErrStartFailed, e.Err}
+}
+
+// timeoutError returns ErrTimeout annotated with the operation and the context error
+func timeoutError(ctx context.Context, what string) error {
+	return errors.Wrapf(ErrTimeout, "%s: %v", what, ctx.Err())
+}
@@ -0,0 +1,20 @@
+package dnsname
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestExecProcessManagerTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, _, err := (execProcessManager{}).run(ctx, "sleep", []string{"10"}); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("Expected timeout error, got: %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("Command should be killed on timeout")
+	}
+}
@@ -0,0 +1,136 @@
+package dnsname
+
+import (
+	"context"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// reconcile verifies that the files of the network instance are consistent
+// with the running dnsmasq and with the peer networks, and repairs the drift
+// left behind by crashes and reboots. A stopped instance is started by the
+// following hup.
+func reconcile(ctx context.Context, conf dnsNameFile, multiDomain bool) (err error) {
+	if isRunning, _ := conf.isRunning(); !isRunning {
+		// removes the pidfile of a crashed instance or of a reused PID
+		if err := conf.stop(); err != nil {
+			return err
+		}
+	} else if _, err := os.Stat(conf.ConfigFile); os.IsNotExist(err) {
+		// the instance runs with a configuration which can't be reloaded, it
+		// is started again with a regenerated one
+		logrus.Warnf("conf file %s of the running instance is missing, restarting it", conf.ConfigFile)
+		if err := conf.stop(); err != nil {
+			return err
+		}
+	}
+	if !multiDomain {
+		return nil
+	}
+	batch := &reloadBatch{}
+	defer func() {
+		if flushErr := batch.flush(ctx); err == nil {
+			err = flushErr
+		}
+	}()
+	return reconcileServers(batch, conf)
+}
+
+// reconcileServers makes the local servers of the instance match the own
+// servers of the peer networks, and makes sure the peers know the own servers
+// of the instance. Remote servers are kept as they are.
+func reconcileServers(batch *reloadBatch, conf dnsNameFile) error {
+	ownServerItems, err := readServerItems(conf.OwnServersConfFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var peerServerItems []string
+	peerDomains := make(map[string]bool)
+	if err := forEachPeer(conf, func(networkName string) error {
+		peer, err := newDNSMasqFile("", "", networkName, true)
+		if err != nil {
+			return err
+		}
+		peerOwnServerItems, err := readServerItems(peer.OwnServersConfFile)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// not a multi-domain network
+				return nil
+			}
+			return err
+		}
+		for _, serverItem := range peerOwnServerItems {
+			peerDomains[serverItemDomain(serverItem)] = true
+		}
+		peerServerItems = append(peerServerItems, peerOwnServerItems...)
+		if len(ownServerItems) > 0 {
+			if _, err := addServersToInstance(batch, networkName, serverItemDomains(ownServerItems), ownServerItems); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	curServerItems, err := readServerItems(conf.LocalServersConfFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// the domains the network delegates are forwarded by the instance too
+	var delegatedItems []string
+	for _, serverItem := range ownServerItems {
+		if domain := serverItemDomain(serverItem); domain != "" && !isDomainInList(conf.Domain, []string{serverItem}) {
+			peerDomains[domain] = true
+			delegatedItems = append(delegatedItems, serverItem)
+		}
+	}
+	newServerItems := make([]string, 0, len(curServerItems))
+	for _, serverItem := range curServerItems {
+		domain := serverItemDomain(serverItem)
+		if domain != "" && !peerDomains[domain] {
+			logrus.Infof("removing server %q of a network which no longer exists", serverItem)
+			continue
+		}
+		newServerItems = append(newServerItems, serverItem)
+	}
+	newServerItems, _ = mergeServerItems(newServerItems, peerServerItems)
+	newServerItems, _ = mergeServerItems(newServerItems, delegatedItems)
+	if equalServerItems(curServerItems, newServerItems) {
+		return nil
+	}
+	if err := writeServerItems(conf.LocalServersConfFile, newServerItems); err != nil {
+		return err
+	}
+	batch.add(conf)
+	return nil
+}
+
+// serverItemDomain returns the domain of a server=/domain/ip item, or empty
+// string for a server of any domain
+func serverItemDomain(serverItem string) string {
+	fields := strings.Split(serverItem, "/")
+	if len(fields) < 3 {
+		return ""
+	}
+	return fields[1]
+}
+
+// equalServerItems checks if both slices have the same server items regardless of the order
+func equalServerItems(first, second []string) bool {
+	if len(first) != len(second) {
+		return false
+	}
+	first = append([]string(nil), first...)
+	second = append([]string(nil), second...)
+	sort.Strings(first)
+	sort.Strings(second)
+	for i := range first {
+		if first[i] != second[i] {
+			return false
+		}
+	}
+	return true
+}
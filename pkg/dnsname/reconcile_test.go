@@ -0,0 +1,76 @@
+package dnsname
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setupFakeDNSMasq makes newDNSMasqFile find a dnsmasq binary and keeps the
+// configuration of the test in a temporary directory
+func setupFakeDNSMasq(t *testing.T) {
+	binDir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(binDir, "dnsmasq"), []byte("#!/bin/sh\n"), 0o755); err != nil {
+		t.Fatalf("Can't write fake dnsmasq: %v", err)
+	}
+	t.Setenv("PATH", binDir)
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+}
+
+func TestReconcileServers(t *testing.T) {
+	setupFakeDNSMasq(t)
+	// net3 vanished without cleaning up, net2 is missing from the local servers
+	if err := createNetwork("net1", "server=10.10.1.1\nserver=/net3/192.168.3.1\n", "server=/net1/192.168.1.1\n"); err != nil {
+		t.Fatalf("Can't create network: %v", err)
+	}
+	if err := createNetwork("net2", "", "server=/net2/192.168.2.1\n"); err != nil {
+		t.Fatalf("Can't create network: %v", err)
+	}
+	conf, procs := newTestDNSMasqFile(t)
+	conf.Domain = "net1"
+	conf.LocalServersConfFile = makePath("net1", localServersConfFileName)
+	conf.OwnServersConfFile = makePath("net1", ownServersConfFileName)
+	if err := reconcile(context.Background(), conf, true); err != nil {
+		t.Fatalf("Can't reconcile: %v", err)
+	}
+	if procs.runs != 0 {
+		t.Errorf("Stopped instance should not be started, got %d starts", procs.runs)
+	}
+	tests := []struct {
+		file string
+		want string
+	}{
+		{conf.LocalServersConfFile, "server=/net2/192.168.2.1\nserver=10.10.1.1\n"},
+		{makePath("net2", localServersConfFileName), "server=/net1/192.168.1.1\n"},
+	}
+	for _, tt := range tests {
+		got, err := ioutil.ReadFile(tt.file)
+		if err != nil {
+			t.Fatalf("Can't read file: %v", err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("reconcile() %s got = '%v', want '%v'", tt.file, string(got), tt.want)
+		}
+	}
+}
+
+func TestReconcileMissingConfFile(t *testing.T) {
+	d, procs := newTestDNSMasqFile(t)
+	if err := d.start(context.Background()); err != nil {
+		t.Fatalf("Can't start: %v", err)
+	}
+	if _, err := os.Stat(d.ConfigFile); !os.IsNotExist(err) {
+		t.Fatalf("Conf file should be missing, got %v", err)
+	}
+	if err := reconcile(context.Background(), d, false); err != nil {
+		t.Fatalf("Can't reconcile: %v", err)
+	}
+	if isRunning, _ := d.isRunning(); isRunning {
+		t.Error("Instance without conf file should be stopped")
+	}
+	if len(procs.running) != 0 {
+		t.Errorf("Instance process should be killed, got %v", procs.running)
+	}
+}
@@ -0,0 +1,95 @@
+package dnsname
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// reloadBatch collects the instances whose server files changed during an
+// operation, so each of them is reloaded once at the end of the operation
+// instead of once per change
+type reloadBatch struct {
+	instances []dnsNameFile
+}
+
+// add schedules the reload of the instance, adding it twice has no effect
+func (b *reloadBatch) add(d dnsNameFile) {
+	for _, instance := range b.instances {
+		if instance.ConfigFile == d.ConfigFile {
+			return
+		}
+	}
+	b.instances = append(b.instances, d)
+}
+
+// flush reloads the scheduled instances. All of them are tried, the first
+// error is returned.
+func (b *reloadBatch) flush(ctx context.Context) error {
+	var firstErr error
+	for _, instance := range b.instances {
+		if err := instance.reloadServers(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	b.instances = nil
+	return firstErr
+}
+
+// reload applies the changed files of the instance, starting it if it is not
+// running. SIGHUP rereads the hosts files, and the server files of instances
+// reading them with servers-file, so the changed servers of older instances
+// and a changed conf file or CNAMEs, which are only read on start, are
+// applied by a restart. With ReloadWindow the SIGHUP of a running instance is
+// deferred.
+func (d dnsNameFile) reload(ctx context.Context, serversChanged, confChanged bool) error {
+	if isRunning, _ := d.isRunning(); isRunning && (confChanged || serversChanged && !usesServersFile(d.ConfigFile)) {
+		if err := d.stop(); err != nil {
+			return err
+		}
+		return d.start(ctx)
+	}
+	if d.ReloadWindow.Duration > 0 {
+		if isRunning, _ := d.isRunning(); isRunning {
+			return d.deferHup(ctx)
+		}
+	}
+	return d.hup(ctx)
+}
+
+// reloadServers applies changed server files to a running instance. Instances
+// reading their servers with servers-file reread them on SIGHUP, older ones
+// which include them with conf-file have to be restarted.
+func (d dnsNameFile) reloadServers(ctx context.Context) error {
+	isRunning, pid := d.isRunning()
+	if !isRunning {
+		// the servers are read when the instance starts
+		return nil
+	}
+	if usesServersFile(d.ConfigFile) {
+		return d.processes().signal(pid, unix.SIGHUP)
+	}
+	if err := d.stop(); err != nil {
+		return err
+	}
+	return d.start(ctx)
+}
+
+// usesServersFile checks if the dnsmasq conf reads the local servers with servers-file
+func usesServersFile(confFile string) bool {
+	f, err := os.Open(confFile)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "servers-file=") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package dnsname
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"syscall"
+	"testing"
+)
+
+func TestReloadBatchFlush(t *testing.T) {
+	d, procs := newTestDNSMasqFile(t)
+	if err := ioutil.WriteFile(d.ConfigFile, []byte("servers-file=/tmp/localservers.conf\n"), 0o600); err != nil {
+		t.Fatalf("Can't write config: %v", err)
+	}
+	if err := d.start(context.Background()); err != nil {
+		t.Fatalf("Can't start: %v", err)
+	}
+	batch := &reloadBatch{}
+	batch.add(d)
+	batch.add(d)
+	if err := batch.flush(context.Background()); err != nil {
+		t.Fatalf("Can't flush: %v", err)
+	}
+	if len(procs.signals) != 1 || procs.signals[0] != syscall.SIGHUP {
+		t.Errorf("Instance should get a single SIGHUP, got %v", procs.signals)
+	}
+	if procs.runs != 1 {
+		t.Errorf("Instance should not be restarted, got %d starts", procs.runs)
+	}
+}
+
+func TestReloadBatchRestartsOldConfig(t *testing.T) {
+	d, procs := newTestDNSMasqFile(t)
+	if err := ioutil.WriteFile(d.ConfigFile, []byte("conf-file=/tmp/localservers.conf\n"), 0o600); err != nil {
+		t.Fatalf("Can't write config: %v", err)
+	}
+	batch := &reloadBatch{}
+	batch.add(d)
+	// stopped instance is left alone
+	if err := batch.flush(context.Background()); err != nil {
+		t.Fatalf("Can't flush: %v", err)
+	}
+	if procs.runs != 0 {
+		t.Fatalf("Stopped instance should not be started, got %d starts", procs.runs)
+	}
+	if err := d.start(context.Background()); err != nil {
+		t.Fatalf("Can't start: %v", err)
+	}
+	batch.add(d)
+	if err := batch.flush(context.Background()); err != nil {
+		t.Fatalf("Can't flush: %v", err)
+	}
+	if procs.runs != 2 || len(procs.signals) != 1 || procs.signals[0] != syscall.SIGKILL {
+		t.Errorf("Instance should be restarted, got %d starts, signals %v", procs.runs, procs.signals)
+	}
+}
+
+func TestReloadChangedServers(t *testing.T) {
+	d, procs := newTestDNSMasqFile(t)
+	if err := ioutil.WriteFile(d.ConfigFile, []byte("conf-file=/tmp/localservers.conf\n"), 0o600); err != nil {
+		t.Fatalf("Can't write config: %v", err)
+	}
+	// a stopped instance is started either way
+	if err := d.reload(context.Background(), true, false); err != nil {
+		t.Fatalf("Can't reload: %v", err)
+	}
+	if procs.runs != 1 {
+		t.Fatalf("Stopped instance should be started, got %d starts", procs.runs)
+	}
+	// unchanged servers only need the hosts files reread
+	if err := d.reload(context.Background(), false, false); err != nil {
+		t.Fatalf("Can't reload: %v", err)
+	}
+	if procs.runs != 1 || len(procs.signals) != 1 || procs.signals[0] != syscall.SIGHUP {
+		t.Fatalf("Instance should get a SIGHUP, got %d starts, signals %v", procs.runs, procs.signals)
+	}
+	// the servers included with conf-file are only read on start
+	if err := d.reload(context.Background(), true, false); err != nil {
+		t.Fatalf("Can't reload: %v", err)
+	}
+	if procs.runs != 2 || len(procs.signals) != 2 || procs.signals[1] != syscall.SIGKILL {
+		t.Errorf("Instance should be restarted, got %d starts, signals %v", procs.runs, procs.signals)
+	}
+	// the new instance isn't started while the old one holds its addresses
+	procs.ignoreKill = true
+	if err := d.reload(context.Background(), true, false); !errors.Is(err, ErrStopFailed) {
+		t.Errorf("reload() error = %v, want %v", err, ErrStopFailed)
+	}
+	if procs.runs != 2 {
+		t.Errorf("Instance should not be started before the old one exited, got %d starts", procs.runs)
+	}
+}
@@ -0,0 +1,342 @@
+package dnsname
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// getIPs iterates a result and returns all the IP addresses
+// associated with it
+func getIPs(r *current.Result) ([]*net.IPNet, error) {
+	var (
+		ips []*net.IPNet
+	)
+	if len(r.IPs) < 1 {
+		return nil, ErrNoIPAddressFound
+	}
+	if len(r.IPs) == 1 {
+		return append(ips, &r.IPs[0].Address), nil
+	}
+	for _, ip := range r.IPs {
+		if ip.Address.IP != nil && ip.Interface != nil {
+			if isInterfaceIndexSandox(*ip.Interface, r) {
+				ips = append(ips, &ip.Address)
+			} else {
+				return nil, errors.Errorf("unable to check if interface has a sandbox due to index being out of range")
+			}
+		}
+	}
+	if len(ips) < 1 {
+		return nil, ErrNoIPAddressFound
+	}
+	return ips, nil
+}
+
+// redirectInterfaces returns the host interfaces of the result the DNS queries
+// are accepted on: the first interface by default, all host interfaces for
+// "*" or the configured ones. Configured interfaces missing from the result
+// are skipped.
+func redirectInterfaces(r *current.Result, configured []string) []string {
+	if len(configured) == 0 {
+		return []string{r.Interfaces[0].Name}
+	}
+	all := stringInSlice("*", configured)
+	var interfaces []string
+	for _, iface := range r.Interfaces {
+		// the interfaces of the pod sandbox are not seen by the host
+		if iface.Sandbox != "" || stringInSlice(iface.Name, interfaces) {
+			continue
+		}
+		if all || stringInSlice(iface.Name, configured) {
+			interfaces = append(interfaces, iface.Name)
+		}
+	}
+	for _, name := range configured {
+		if name != "*" && !stringInSlice(name, interfaces) {
+			logrus.Warnf("redirect interface %s not found in the previous result", name)
+		}
+	}
+	return interfaces
+}
+
+// checkPrevResult checks that the previous result has an interface and an
+// address, a result without them would only give the pod a useless record
+func checkPrevResult(r *current.Result) error {
+	if len(r.Interfaces) == 0 {
+		return errors.Wrap(ErrNoInterfaceFound, "the previous result has no interfaces")
+	}
+	for _, ip := range r.IPs {
+		if ip.Address.IP != nil {
+			return nil
+		}
+	}
+	return errors.Wrap(ErrNoIPAddressFound, "the previous result has no IP addresses")
+}
+
+// networkInterface returns the name of the first interface of the result, the
+// network interface dnsmasq listens on
+func networkInterface(r *current.Result) (string, error) {
+	if len(r.Interfaces) == 0 {
+		return "", errors.Wrap(ErrNoInterfaceFound, "the previous plugin must report the network interface")
+	}
+	return r.Interfaces[0].Name, nil
+}
+
+// parseIPNets parses IPs and CIDRs, an IP is a network of itself
+func parseIPNets(items []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(items))
+	for _, item := range items {
+		if _, ipNet, err := net.ParseCIDR(item); err == nil {
+			nets = append(nets, ipNet)
+			continue
+		}
+		ip := net.ParseIP(item)
+		if ip == nil {
+			return nil, errors.Errorf("invalid IP or CIDR %q", item)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return nets, nil
+}
+
+// excludeIPs drops the IPs contained in the excluded networks
+func excludeIPs(ips []*net.IPNet, excluded []*net.IPNet) []*net.IPNet {
+	var kept []*net.IPNet
+	for _, ip := range ips {
+		isExcluded := false
+		for _, ipNet := range excluded {
+			if ipNet.Contains(ip.IP) {
+				isExcluded = true
+				break
+			}
+		}
+		if !isExcluded {
+			kept = append(kept, ip)
+		}
+	}
+	return kept
+}
+
+// applyIPVersionPreference orders the IPs so the preferred family comes first,
+// keeping the order within each family, and drops the other family if only
+// the preferred one should be published
+func applyIPVersionPreference(ips []*net.IPNet, preference string, only bool) ([]*net.IPNet, error) {
+	if preference != ipFamilyV4 && preference != ipFamilyV6 {
+		return ips, nil
+	}
+	var preferred, others []*net.IPNet
+	for _, ip := range ips {
+		if ipInFamily(ip.IP, preference) {
+			preferred = append(preferred, ip)
+		} else {
+			others = append(others, ip)
+		}
+	}
+	if only {
+		if len(preferred) == 0 {
+			return nil, errors.Wrapf(ErrNoIPAddressFound, "no IPv%s address", preference)
+		}
+		return preferred, nil
+	}
+	return append(preferred, others...), nil
+}
+
+// primaryIPs returns the primary IP of each family, the first one in the
+// order of the result, keeping the order of the families
+func primaryIPs(ips []*net.IPNet) []*net.IPNet {
+	var primary []*net.IPNet
+	hasV4, hasV6 := false, false
+	for _, ip := range ips {
+		isV4 := ip.IP.To4() != nil
+		if isV4 && !hasV4 || !isV4 && !hasV6 {
+			primary = append(primary, ip)
+			hasV4, hasV6 = hasV4 || isV4, hasV6 || !isV4
+		}
+	}
+	return primary
+}
+
+// isInterfaceIndexSandox determines if the given interface index has the sandbox
+// attribute and the value is greater than 0
+func isInterfaceIndexSandox(idx int, r *current.Result) bool {
+	if idx >= 0 && idx < len(r.Interfaces) {
+		return len(r.Interfaces[idx].Sandbox) > 0
+	}
+	return false
+}
+
+// getInterfaceAddresses gets all globalunicast IP addresses for a given
+// interface
+func getInterfaceAddresses(nameConf dnsNameFile) ([]string, error) {
+	nic, err := net.InterfaceByName(nameConf.NetworkInterface)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := nic.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	return filterNameserverAddresses(addrs, nameConf.AddressFamily)
+}
+
+// filterNameserverAddresses returns the addresses usable as nameservers: global
+// unicast addresses of the requested family (both if empty). IPv4 addresses
+// come first and each family is sorted, so the result does not depend on the
+// order the kernel reports the addresses in.
+func filterNameserverAddresses(addrs []net.Addr, family string) ([]string, error) {
+	var ips []net.IP
+	for _, addr := range addrs {
+		ip, _, err := net.ParseCIDR(addr.String())
+		if err != nil {
+			return nil, err
+		}
+		// IsGlobalUnicast already excludes loopback and link-local addresses
+		if !ip.IsGlobalUnicast() || !ipInFamily(ip, family) {
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	sort.Slice(ips, func(i, j int) bool {
+		iIsV4, jIsV4 := ips[i].To4() != nil, ips[j].To4() != nil
+		if iIsV4 != jIsV4 {
+			return iIsV4
+		}
+		return bytes.Compare(ips[i].To16(), ips[j].To16()) < 0
+	})
+	nameservers := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		nameservers = append(nameservers, ip.String())
+	}
+	return nameservers, nil
+}
+
+// filterFamily returns the addresses of the family, all if family is empty
+func filterFamily(addresses []string, family string) []string {
+	var filtered []string
+	for _, address := range addresses {
+		if ip := net.ParseIP(address); ip != nil && ipInFamily(ip, family) {
+			filtered = append(filtered, address)
+		}
+	}
+	return filtered
+}
+
+// nameserverEndpoints returns the nameservers as the pod has to use them: a
+// custom port is given as address:port, the default one is left out as
+// resolvers assume it
+func nameserverEndpoints(nameservers []string, port int) []string {
+	if port == 0 {
+		return nameservers
+	}
+	endpoints := make([]string, 0, len(nameservers))
+	for _, nameserver := range nameservers {
+		endpoints = append(endpoints, net.JoinHostPort(nameserver, strconv.Itoa(port)))
+	}
+	return endpoints
+}
+
+// mergeNameservers returns the nameservers of the instance followed by the
+// ones already in the result, e.g. from dnsname chained on another network,
+// in their order. A nameserver is only kept once however it is written, so
+// "10.0.0.1" and "10.0.0.1:53" are the same, and the first occurrence wins:
+// the resulting order only depends on the inputs.
+func mergeNameservers(own, preserved []string) []string {
+	var merged []string
+	seen := make(map[string]bool)
+	for _, nameserver := range append(append([]string{}, own...), preserved...) {
+		key := nameserverKey(nameserver)
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		merged = append(merged, nameserver)
+	}
+	return merged
+}
+
+// nameserverKey returns the canonical form of the nameserver, given as an
+// address with or without a port
+func nameserverKey(nameserver string) string {
+	host, port, err := net.SplitHostPort(nameserver)
+	if err != nil {
+		host, port = nameserver, strconv.Itoa(defaultDNSPort)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return net.JoinHostPort(ip.String(), port)
+	}
+	return strings.TrimSpace(nameserver)
+}
+
+// ipInFamily checks if the IP belongs to the family, any IP belongs to the empty family
+func ipInFamily(ip net.IP, family string) bool {
+	switch family {
+	case ipFamilyV4:
+		return ip.To4() != nil
+	case ipFamilyV6:
+		return ip.To4() == nil
+	}
+	return true
+}
+
+// setDNSSearch makes short names resolvable in the pod: the search domains of
+// the configuration (the network domain by default) go first, followed by the
+// ones already present, and the domain is set unless already present.
+func setDNSSearch(dns *types.DNS, conf *DNSNameConf) {
+	search := conf.Search
+	if len(search) == 0 && conf.DomainName != "" {
+		search = []string{conf.DomainName}
+	}
+	dns.Search = mergeUnique(search, dns.Search)
+	if dns.Domain == "" {
+		dns.Domain = conf.DomainName
+	}
+}
+
+// mergeDNSOptions adds the resolver options of the pod to the ones already
+// present. An option of the pod replaces the one with the same name, e.g.
+// ndots:2 replaces ndots:5.
+func mergeDNSOptions(options, podOptions []string) []string {
+	podNames := make(map[string]bool, len(podOptions))
+	for _, option := range podOptions {
+		podNames[dnsOptionName(option)] = true
+	}
+	var kept []string
+	for _, option := range options {
+		if !podNames[dnsOptionName(option)] {
+			kept = append(kept, option)
+		}
+	}
+	return mergeUnique(kept, podOptions)
+}
+
+// dnsOptionName returns the name of a resolver option, i.e. without its value
+func dnsOptionName(option string) string {
+	return strings.SplitN(option, ":", 2)[0]
+}
+
+// mergeUnique appends the items of second missing in first to first,
+// keeping the order and dropping duplicates
+func mergeUnique(first, second []string) []string {
+	var merged []string
+	seen := make(map[string]bool)
+	for _, item := range append(append([]string{}, first...), second...) {
+		if seen[item] {
+			continue
+		}
+		seen[item] = true
+		merged = append(merged, item)
+	}
+	return merged
+}
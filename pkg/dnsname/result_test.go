@@ -0,0 +1,326 @@
+package dnsname
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/coreos/go-iptables/iptables"
+)
+
+func Test_filterNameserverAddresses(t *testing.T) {
+	var addrs []net.Addr
+	for _, cidr := range []string{
+		"fe80::a4a7:caff:fe6b:342e/64", "10.88.0.2/16", "fd00::1/64",
+		"127.0.0.1/8", "::1/128", "10.88.0.1/16", "169.254.1.1/16",
+	} {
+		ip, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatalf("Can't parse %s: %v", cidr, err)
+		}
+		ipNet.IP = ip
+		addrs = append(addrs, ipNet)
+	}
+	tests := []struct {
+		name   string
+		family string
+		want   []string
+	}{
+		{"both families", "", []string{"10.88.0.1", "10.88.0.2", "fd00::1"}},
+		{"ipv4 only", ipFamilyV4, []string{"10.88.0.1", "10.88.0.2"}},
+		{"ipv6 only", ipFamilyV6, []string{"fd00::1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := filterNameserverAddresses(addrs, tt.family)
+			if err != nil {
+				t.Fatalf("filterNameserverAddresses() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("filterNameserverAddresses() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_nameserverEndpoints(t *testing.T) {
+	tests := []struct {
+		name string
+		port int
+		want []string
+	}{
+		{"default port", 0, []string{"10.0.0.1", "fd00::1"}},
+		{"custom port", 5353, []string{"10.0.0.1:5353", "[fd00::1]:5353"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nameserverEndpoints([]string{"10.0.0.1", "fd00::1"}, tt.port); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("nameserverEndpoints() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_filterFamily(t *testing.T) {
+	addresses := []string{"10.88.0.1", "fd00::1"}
+	tests := []struct {
+		family string
+		want   []string
+	}{
+		{"", addresses},
+		{ipFamilyV4, []string{"10.88.0.1"}},
+		{ipFamilyV6, []string{"fd00::1"}},
+	}
+	for _, tt := range tests {
+		if got := filterFamily(addresses, tt.family); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("filterFamily(%q) got = %v, want %v", tt.family, got, tt.want)
+		}
+	}
+}
+
+func Test_chainArgs(t *testing.T) {
+	conf := dnsNameFile{InstanceDir: makePath("net1", ""), PidFile: makePath("net1", pidFileName), DNSPort: 5353}
+	want := []string{"-i", "cni0", "-p", "udp", "-m", "udp", "--dport", "5353",
+		"-m", "comment", "--comment", "dnsname:net1", "-j", "ACCEPT"}
+	if got := chainArgs("cni0", conf.DNSPort, conf.ruleComment()); !reflect.DeepEqual(got, want) {
+		t.Errorf("chainArgs() got = %v, want %v", got, want)
+	}
+}
+
+func Test_commentedRules(t *testing.T) {
+	rules := []string{
+		"-P INPUT ACCEPT",
+		"-A INPUT -i cni1 -p udp -m udp --dport 53 -m comment --comment dnsname:net10 -j ACCEPT",
+		"-A INPUT -i cni0 -p udp -m udp --dport 53 -m comment --comment dnsname:net1 -j ACCEPT",
+		"-A INPUT -i cni0 -p tcp -m tcp --dport 22 -j ACCEPT",
+		"-A INPUT -i cni2 -p udp -m udp --dport 5353 -m comment --comment dnsname:net1 -j ACCEPT",
+	}
+	want := [][]string{chainArgs("cni0", 0, "dnsname:net1"), chainArgs("cni2", 5353, "dnsname:net1")}
+	if got := commentedRules(rules, "dnsname:net1"); !reflect.DeepEqual(got, want) {
+		t.Errorf("commentedRules() got = %v, want %v", got, want)
+	}
+}
+
+func Test_redirectProtocols(t *testing.T) {
+	tests := []struct {
+		family string
+		want   []iptables.Protocol
+	}{
+		{"", []iptables.Protocol{iptables.ProtocolIPv4}},
+		{ipFamilyV4, []iptables.Protocol{iptables.ProtocolIPv4}},
+		{ipFamilyV6, []iptables.Protocol{iptables.ProtocolIPv6}},
+		{ipFamilyDual, []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6}},
+	}
+	for _, tt := range tests {
+		if got := (dnsNameFile{RedirectFamily: tt.family}).redirectProtocols(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("redirectProtocols(%q) got = %v, want %v", tt.family, got, tt.want)
+		}
+	}
+}
+
+func Test_mergeUnique(t *testing.T) {
+	tests := []struct {
+		name   string
+		first  []string
+		second []string
+		want   []string
+	}{
+		{"no duplicates", []string{"10.0.0.1"}, []string{"8.8.8.8"}, []string{"10.0.0.1", "8.8.8.8"}},
+		{"chained twice", []string{"10.0.0.1", "fd00::1"}, []string{"10.0.0.1", "fd00::1", "8.8.8.8"},
+			[]string{"10.0.0.1", "fd00::1", "8.8.8.8"}},
+		{"duplicates in second", []string{"10.0.0.1"}, []string{"8.8.8.8", "10.0.0.1", "8.8.8.8"},
+			[]string{"10.0.0.1", "8.8.8.8"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mergeUnique(tt.first, tt.second); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mergeUnique() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_mergeDNSOptions(t *testing.T) {
+	tests := []struct {
+		name       string
+		options    []string
+		podOptions []string
+		want       []string
+	}{
+		{"no pod options", []string{"ndots:5"}, nil, []string{"ndots:5"}},
+		{"no options", nil, []string{"ndots:2"}, []string{"ndots:2"}},
+		{"replaced", []string{"ndots:5", "edns0"}, []string{"ndots:2", "timeout:1"},
+			[]string{"edns0", "ndots:2", "timeout:1"}},
+		{"chained twice", []string{"edns0", "ndots:2"}, []string{"ndots:2", "edns0"}, []string{"ndots:2", "edns0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mergeDNSOptions(tt.options, tt.podOptions); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mergeDNSOptions() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_mergeNameservers(t *testing.T) {
+	tests := []struct {
+		name      string
+		own       []string
+		preserved []string
+		want      []string
+	}{
+		{"own first", []string{"10.0.0.1"}, []string{"10.1.0.1", "8.8.8.8"}, []string{"10.0.0.1", "10.1.0.1", "8.8.8.8"}},
+		{"repeated add", []string{"10.0.0.1", "fd00::1"}, []string{"10.0.0.1", "fd00::1", "10.1.0.1"},
+			[]string{"10.0.0.1", "fd00::1", "10.1.0.1"}},
+		{"default port", []string{"10.0.0.1"}, []string{"10.0.0.1:53", "10.1.0.1"}, []string{"10.0.0.1", "10.1.0.1"}},
+		{"custom port", []string{"10.0.0.1:5353"}, []string{"10.0.0.1", "10.0.0.1:5353"}, []string{"10.0.0.1:5353", "10.0.0.1"}},
+		{"ipv6 forms", []string{"fd00::1"}, []string{"fd00:0:0::1", "[fd00::1]:53"}, []string{"fd00::1"}},
+		{"empty entries", nil, []string{"", "10.1.0.1"}, []string{"10.1.0.1"}},
+		{"fallback passed in", []string{"10.0.0.1", "192.168.1.1"}, []string{"10.1.0.1", "192.168.1.1"},
+			[]string{"10.0.0.1", "192.168.1.1", "10.1.0.1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mergeNameservers(tt.own, tt.preserved); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mergeNameservers() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_redirectInterfaces(t *testing.T) {
+	result := &current.Result{Interfaces: []*current.Interface{
+		{Name: "cni0"},
+		{Name: "veth1"},
+		{Name: "eth0", Sandbox: "/var/run/netns/pod1"},
+		{Name: "net1"},
+	}}
+	tests := []struct {
+		name       string
+		configured []string
+		want       []string
+	}{
+		{"default", nil, []string{"cni0"}},
+		{"all", []string{"*"}, []string{"cni0", "veth1", "net1"}},
+		{"subset", []string{"net1", "cni0", "missing"}, []string{"cni0", "net1"}},
+		{"sandbox", []string{"eth0"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := redirectInterfaces(result, tt.configured); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("redirectInterfaces() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_excludeIPs(t *testing.T) {
+	excluded, err := parseIPNets([]string{"10.96.0.0/12", "10.88.0.5", "fd00::5"})
+	if err != nil {
+		t.Fatalf("Can't parse excluded IPs: %v", err)
+	}
+	ips := []*net.IPNet{
+		{IP: net.ParseIP("10.88.0.2")},
+		{IP: net.ParseIP("10.88.0.5")},
+		{IP: net.ParseIP("10.96.1.1")},
+		{IP: net.ParseIP("fd00::2")},
+		{IP: net.ParseIP("fd00::5")},
+	}
+	got := excludeIPs(ips, excluded)
+	want := []*net.IPNet{ips[0], ips[3]}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("excludeIPs() got = %v, want %v", got, want)
+	}
+	if _, err := parseIPNets([]string{"10.88.0.0/33"}); err == nil {
+		t.Error("parseIPNets() should fail for an invalid CIDR")
+	}
+}
+
+func Test_primaryIPs(t *testing.T) {
+	var ips []*net.IPNet
+	for _, ip := range []string{"fd00::3", "10.88.0.3", "fd00::2", "10.88.0.2"} {
+		ips = append(ips, &net.IPNet{IP: net.ParseIP(ip)})
+	}
+	got := primaryIPs(ips)
+	want := []*net.IPNet{ips[0], ips[1]}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("primaryIPs() got = %v, want %v", got, want)
+	}
+	// the primary of an excluded address is the next one of its family
+	excluded, _ := parseIPNets([]string{"10.88.0.3"})
+	got = primaryIPs(excludeIPs(ips, excluded))
+	want = []*net.IPNet{ips[0], ips[3]}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("primaryIPs() got = %v, want %v", got, want)
+	}
+}
+
+func Test_setDNSSearch(t *testing.T) {
+	tests := []struct {
+		name       string
+		conf       DNSNameConf
+		dns        types.DNS
+		wantSearch []string
+		wantDomain string
+	}{
+		{"network domain", DNSNameConf{DomainName: "foobar.io"}, types.DNS{},
+			[]string{"foobar.io"}, "foobar.io"},
+		{"keep existing", DNSNameConf{DomainName: "foobar.io"},
+			types.DNS{Search: []string{"cluster.local", "foobar.io"}, Domain: "cluster.local"},
+			[]string{"foobar.io", "cluster.local"}, "cluster.local"},
+		{"override", DNSNameConf{DomainName: "foobar.io", Search: []string{"a.io", "b.io"}},
+			types.DNS{Search: []string{"b.io", "c.io"}},
+			[]string{"a.io", "b.io", "c.io"}, "foobar.io"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setDNSSearch(&tt.dns, &tt.conf)
+			if !reflect.DeepEqual(tt.dns.Search, tt.wantSearch) {
+				t.Errorf("setDNSSearch() search = %v, want %v", tt.dns.Search, tt.wantSearch)
+			}
+			if tt.dns.Domain != tt.wantDomain {
+				t.Errorf("setDNSSearch() domain = %v, want %v", tt.dns.Domain, tt.wantDomain)
+			}
+		})
+	}
+}
+
+func Test_applyIPVersionPreference(t *testing.T) {
+	var ips []*net.IPNet
+	for _, ip := range []string{"fd00::2", "10.88.0.2", "fd00::3", "10.88.0.3"} {
+		ips = append(ips, &net.IPNet{IP: net.ParseIP(ip)})
+	}
+	tests := []struct {
+		name       string
+		preference string
+		only       bool
+		want       []string
+	}{
+		{"dual", ipFamilyDual, false, []string{"fd00::2", "10.88.0.2", "fd00::3", "10.88.0.3"}},
+		{"unset", "", true, []string{"fd00::2", "10.88.0.2", "fd00::3", "10.88.0.3"}},
+		{"ipv4 first", ipFamilyV4, false, []string{"10.88.0.2", "10.88.0.3", "fd00::2", "fd00::3"}},
+		{"ipv6 first", ipFamilyV6, false, []string{"fd00::2", "fd00::3", "10.88.0.2", "10.88.0.3"}},
+		{"ipv4 only", ipFamilyV4, true, []string{"10.88.0.2", "10.88.0.3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := applyIPVersionPreference(ips, tt.preference, tt.only)
+			if err != nil {
+				t.Fatalf("applyIPVersionPreference() error = %v", err)
+			}
+			var gotIPs []string
+			for _, ip := range got {
+				gotIPs = append(gotIPs, ip.IP.String())
+			}
+			if !reflect.DeepEqual(gotIPs, tt.want) {
+				t.Errorf("applyIPVersionPreference() got = %v, want %v", gotIPs, tt.want)
+			}
+		})
+	}
+	if _, err := applyIPVersionPreference(ips[:1], ipFamilyV4, true); !errors.Is(err, ErrNoIPAddressFound) {
+		t.Errorf("applyIPVersionPreference() without preferred addresses should fail, got %v", err)
+	}
+}
@@ -0,0 +1,421 @@
+package dnsname
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// adds remote servers to existing dnsmasq instance, reports whether the file
+// changed and so the instance has to be reloaded
+func addRemoteServers(fileConfig string, remoteServers []string) (bool, error) {
+	curServerItems, err := readServerItems(fileConfig)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	remoteServersItems := remoteServersToServerItems(remoteServers)
+	mergedServerItems, modified := mergeServerItems(curServerItems, remoteServersItems)
+
+	if !modified {
+		return false, nil
+	}
+
+	return true, writeServerItems(fileConfig, mergedServerItems)
+}
+
+// adds local servers to existing dnsmasq instances
+func addLocalServers(ctx context.Context, conf dnsNameFile, servers []string) (err error) {
+	// peers are reloaded once all of them are updated, even on failure as
+	// their files may have been changed already
+	batch := &reloadBatch{}
+	defer func() {
+		if flushErr := batch.flush(ctx); err == nil {
+			err = flushErr
+		}
+	}()
+	serverItems := serversToServerItems(conf.Domain, conf.DNSPort, servers)
+	// the delegated domains are propagated along with the domain of the network
+	delegatedItems := domainServerItems(conf.DomainServers)
+	ownServerItems := append(append([]string{}, serverItems...), delegatedItems...)
+	// write own servers to file
+	if err := writeServerItems(conf.OwnServersConfFile, ownServerItems); err != nil {
+		return err
+	}
+
+	// walk through existing dnsmasq and add new local servers
+	curServersItems, err := readServerItems(conf.LocalServersConfFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := forEachPeer(conf, func(networkName string) error {
+		instanceServers, err := addServersToInstance(batch, networkName, serverItemDomains(ownServerItems), ownServerItems)
+		if err != nil {
+			return err
+		}
+		curServersItems, _ = mergeServerItems(curServersItems, instanceServers)
+		return nil
+	}); err != nil {
+		return err
+	}
+	// the instance answers its domain itself and forwards the delegated ones
+	curServersItems, _ = removeServerItems(curServersItems, serverItems)
+	curServersItems, _ = mergeServerItems(curServersItems, delegatedItems)
+	return writeServerItems(conf.LocalServersConfFile, curServersItems)
+}
+
+// removes local servers from existing dnsmasq instances
+func removeLocalServers(ctx context.Context, conf dnsNameFile, servers []string) (err error) {
+	batch := &reloadBatch{}
+	defer func() {
+		if flushErr := batch.flush(ctx); err == nil {
+			err = flushErr
+		}
+	}()
+	serverItems := serversToServerItems(conf.Domain, conf.DNSPort, servers)
+	// the delegated domains are read back from the own servers, the
+	// maintenance commands tear instances down without their configuration
+	ownServerItems, err := readServerItems(conf.OwnServersConfFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, serverItem := range ownServerItems {
+		if !isDomainInList(conf.Domain, []string{serverItem}) {
+			serverItems, _ = mergeServerItems(serverItems, []string{serverItem})
+		}
+	}
+	// walk through existing dnsmasq and remove local servers
+	return forEachPeer(conf, func(networkName string) error {
+		return removeServersFromInstance(batch, networkName, serverItems)
+	})
+}
+
+// forEachPeer calls fn for the networks other than the one of conf. A network
+// may be removed concurrently, so its files vanishing is not an error and the
+// network is skipped.
+func forEachPeer(conf dnsNameFile, fn func(networkName string) error) error {
+	curDir := filepath.Base(filepath.Dir(conf.LocalServersConfFile))
+	items, err := ioutil.ReadDir(dnsNameConfPath())
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if !isInstanceDir(item) || item.Name() == curDir || isGroupInstance(item.Name()) {
+			continue
+		}
+		if err := fn(item.Name()); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				logrus.Debugf("skipping network %s being removed: %v", item.Name(), err)
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// fileSnapshot keeps the content of files by path, nil content means the file did not exist
+type fileSnapshot map[string][]byte
+
+// snapshotFiles reads the current content of the files, empty paths are skipped
+func snapshotFiles(paths ...string) (fileSnapshot, error) {
+	snapshot := make(fileSnapshot)
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		snapshot[path] = data
+	}
+	return snapshot, nil
+}
+
+// restore puts the files back to their snapshot content
+func (s fileSnapshot) restore() error {
+	for path, data := range s {
+		if data == nil {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		if err := ioutil.WriteFile(path, data, 0o700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newOwnServers returns the servers missing from the own servers file content,
+// i.e. the ones addLocalServers propagates to the peers for the first time
+func newOwnServers(domainName string, port int, servers []string, ownServersContent []byte) []string {
+	var newServers []string
+	ownServerItems := strings.Split(string(ownServersContent), "\n")
+	for _, server := range servers {
+		if !stringInSlice(serversToServerItems(domainName, port, []string{server})[0], ownServerItems) {
+			newServers = append(newServers, server)
+		}
+	}
+	return newServers
+}
+
+// rollbackServers undoes the server changes of a failed ADD: the servers it
+// propagated to the peers are removed from them and the server files of the
+// network are restored. Nothing is left to do if cleanUp already removed the
+// network along with its last pod.
+func rollbackServers(ctx context.Context, conf dnsNameFile, snapshot fileSnapshot, propagatedServers []string) error {
+	if _, err := os.Stat(conf.InstanceDir); os.IsNotExist(err) {
+		return nil
+	}
+	if len(propagatedServers) > 0 {
+		if err := removeLocalServers(ctx, conf, propagatedServers); err != nil {
+			return err
+		}
+	}
+	return snapshot.restore()
+}
+
+// adds server items to specific dnsmasq instance, unless it owns one of the domains already
+func addServersToInstance(batch *reloadBatch, networkName string, domainNames []string, serverItems []string) ([]string, error) {
+	// set multiDomain as true in newDNSMasqFile as this code is called only for multi domain
+	conf, err := newDNSMasqFile("", "", networkName, true)
+	if err != nil {
+		return nil, err
+	}
+	ownServerItems, err := readServerItems(conf.OwnServersConfFile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, domainName := range domainNames {
+		if isDomainInList(domainName, ownServerItems) {
+			return nil, errors.Wrap(ErrDomainExists, domainName)
+		}
+	}
+	curServerItems, err := readServerItems(conf.LocalServersConfFile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	mergedServerItems, modified := mergeServerItems(curServerItems, serverItems)
+	// if server items modified, write them to the file
+	if modified {
+		if err := writeServerItems(conf.LocalServersConfFile, mergedServerItems); err != nil {
+			return nil, err
+		}
+		// the running instance applies the new configuration once the
+		// operation is done with all instances
+		batch.add(conf)
+	}
+	// returns instance local servers + own servers
+	return append(curServerItems, ownServerItems...), nil
+}
+
+// checks if server items has the domain name, domain names are case
+// insensitive and may be given fully qualified
+func isDomainInList(domainName string, serverItems []string) bool {
+	domainName = normalizeDomain(domainName)
+	for _, item := range serverItems {
+		fields := strings.Split(item, "/")
+		if len(fields) < 3 {
+			continue
+		}
+		if domainName == normalizeDomain(fields[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// serverItemDomains returns the domains of the server items, once each
+func serverItemDomains(serverItems []string) []string {
+	var domains []string
+	for _, serverItem := range serverItems {
+		if domain := serverItemDomain(serverItem); domain != "" && !stringInSlice(domain, domains) {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// domainServerItems returns the server items of the delegated domains, in
+// the order of the domains so they don't depend on the map order
+func domainServerItems(domainServers map[string][]string) []string {
+	domains := make([]string, 0, len(domainServers))
+	for domain := range domainServers {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	var serverItems []string
+	for _, domain := range domains {
+		for _, server := range domainServers[domain] {
+			serverItems = append(serverItems, fmt.Sprintf("server=/%s/%s", domain, server))
+		}
+	}
+	return serverItems
+}
+
+// normalizeDomain returns the domain name in lower case without trailing dot
+func normalizeDomain(domainName string) string {
+	return strings.ToLower(strings.TrimSuffix(domainName, "."))
+}
+
+// isMDNSDomain checks if the domain is the mDNS domain or under it
+func isMDNSDomain(domainName string) bool {
+	domainName = normalizeDomain(domainName)
+	return domainName == mdnsDomain || strings.HasSuffix(domainName, "."+mdnsDomain)
+}
+
+// removes server items from specific dnsmasq instance
+func removeServersFromInstance(batch *reloadBatch, networkName string, serverItems []string) error {
+	// set multiDomain as true in newDNSMasqFile as this code is called only for multi domain
+	conf, err := newDNSMasqFile("", "", networkName, true)
+	if err != nil {
+		return err
+	}
+	curServerItems, err := readServerItems(conf.LocalServersConfFile)
+	if err != nil {
+		return err
+	}
+	newServerItems, modified := removeServerItems(curServerItems, serverItems)
+	// if server items modified, write them to the file
+	if modified {
+		if err := writeServerItems(conf.LocalServersConfFile, newServerItems); err != nil {
+			return err
+		}
+		// the running instance applies the new configuration once the
+		// operation is done with all instances
+		batch.add(conf)
+	}
+	return nil
+}
+
+// merge two service slices. Return result slice and true if result slice was changed
+func mergeServerItems(curServers []string, newServers []string) ([]string, bool) {
+	modified := false
+	for _, newServer := range newServers {
+		found := false
+		for _, curServer := range curServers {
+			if newServer == curServer {
+				found = true
+				break
+			}
+		}
+		if !found {
+			curServers = append(curServers, newServer)
+			modified = true
+		}
+	}
+	return curServers, modified
+}
+
+// remove service slices from another slice. Return result slice and true if result slice was changed
+func removeServerItems(curServers []string, removeServers []string) ([]string, bool) {
+	modified := false
+	for _, removeServer := range removeServers {
+		for i, curServer := range curServers {
+			if removeServer == curServer {
+				curServers = append(curServers[:i], curServers[i+1:]...)
+				modified = true
+				break
+			}
+		}
+	}
+	return curServers, modified
+}
+
+// isServerItem checks if the line is a server entry, which are the lines
+// dnsmasq takes from a servers-file besides comments
+func isServerItem(line string) bool {
+	return strings.HasPrefix(line, "server=") || strings.HasPrefix(line, "rev-server=")
+}
+
+// reads the server items of the file to servers slice
+func readServerItems(fileName string) ([]string, error) {
+	servers, _, err := readServerFile(fileName)
+	return servers, err
+}
+
+// readServerFile reads the server items of the file and the other non empty
+// lines separately
+func readServerFile(fileName string) (servers []string, others []string, err error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	servers = make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case isServerItem(line):
+			servers = append(servers, line)
+		case strings.TrimSpace(line) != "":
+			others = append(others, line)
+		}
+	}
+	return servers, others, scanner.Err()
+}
+
+// writes servers slice to file. The comments added by hand are kept at the top
+// of the file, the other lines are dropped, as dnsmasq only takes server and
+// rev-server lines from a servers-file.
+func writeServerItems(fileName string, servers []string) error {
+	_, others, err := readServerFile(fileName)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	comments := make([]string, 0, len(others))
+	for _, line := range others {
+		if !strings.HasPrefix(strings.TrimSpace(line), "#") {
+			logrus.Warnf("dropping %q from %s, a servers-file only takes server and rev-server lines", line, fileName)
+			continue
+		}
+		comments = append(comments, line)
+	}
+	sort.Strings(servers)
+	file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0700)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	writer := bufio.NewWriter(file)
+	for _, line := range append(comments, servers...) {
+		fmt.Fprintln(writer, line)
+	}
+	return writer.Flush()
+}
+
+// converts server IPs to dnsmasq
+// generate servers items in dnsmasq config format: server=ip
+// if resolution by domain name is required the format should be: server=/domain/ip
+// a custom port of the instance is added as server=/domain/ip#port
+func serversToServerItems(domainName string, port int, servers []string) []string {
+	serverItems := make([]string, 0, len(servers))
+	for _, server := range servers {
+		if port != 0 {
+			server = fmt.Sprintf("%s#%d", server, port)
+		}
+		serverItems = append(serverItems, fmt.Sprintf("server=/%s/%s", domainName, server))
+	}
+	return serverItems
+}
+
+func remoteServersToServerItems(remoteServer []string) []string {
+	serverItems := make([]string, len(remoteServer))
+	for i, server := range remoteServer {
+		serverItems[i] = fmt.Sprintf("server=%s", server)
+	}
+	return serverItems
+}
@@ -0,0 +1,516 @@
+package dnsname
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type testServerData struct {
+	networkName  string
+	localServers string
+	ownServers   string
+}
+
+func cleanupAll() error {
+	return os.RemoveAll(dnsNameConfPath())
+}
+
+func createNetwork(networkName string, localServers string, ownServers string) error {
+	networkDir := filepath.Join(dnsNameConfPath(), networkName)
+	if err := os.MkdirAll(networkDir, 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(networkDir,
+		localServersConfFileName), []byte(localServers), 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(networkDir,
+		ownServersConfFileName), []byte(ownServers), 0700); err != nil {
+		return err
+	}
+	return nil
+}
+
+func TestAddRemoteServers(t *testing.T) {
+	t.Cleanup(func() { cleanupAll() })
+	localServers := `server=/local1/192.168.2.1
+server=/local2/192.168.3.1
+`
+
+	if err := createNetwork("local3", localServers, ""); err != nil {
+		t.Fatalf("Can't create network: %v", err)
+	}
+
+	networkDir := filepath.Join(dnsNameConfPath(), "local3")
+	data, err := ioutil.ReadFile(filepath.Join(networkDir, localServersConfFileName))
+	if err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+
+	modified, err := addRemoteServers(filepath.Join(dnsNameConfPath(), "local3", localServersConfFileName),
+		[]string{"10.10.1.1", "10.10.2.1"})
+	if err != nil {
+		t.Fatalf("Can't add remote servers: %v", err)
+	}
+	if !modified {
+		t.Errorf("addRemoteServers() should report the file as modified")
+	}
+
+	networkDir = filepath.Join(dnsNameConfPath(), "local3")
+	data, err = ioutil.ReadFile(filepath.Join(networkDir, localServersConfFileName))
+	if err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+
+	expected := `server=/local1/192.168.2.1
+server=/local2/192.168.3.1
+server=10.10.1.1
+server=10.10.2.1
+`
+	if string(data) != expected {
+		t.Fatalf("Expected: %s got: %s", expected, string(data))
+	}
+}
+
+func TestAddRemoteServersKeepsOnlyComments(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	localServers := `# upstream of the lab
+server=/local1/192.168.2.1
+all-servers
+rev-server=192.168.2.0/24,192.168.2.1
+
+server=/local2/192.168.3.1
+`
+	if err := createNetwork("local3", localServers, ""); err != nil {
+		t.Fatalf("Can't create network: %v", err)
+	}
+	fileName := filepath.Join(dnsNameConfPath(), "local3", localServersConfFileName)
+	if _, err := addRemoteServers(fileName, []string{"10.10.1.1"}); err != nil {
+		t.Fatalf("Can't add remote servers: %v", err)
+	}
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	// dnsmasq doesn't take other directives from a servers-file
+	expected := `# upstream of the lab
+rev-server=192.168.2.0/24,192.168.2.1
+server=/local1/192.168.2.1
+server=/local2/192.168.3.1
+server=10.10.1.1
+`
+	if string(data) != expected {
+		t.Fatalf("Expected: %s got: %s", expected, string(data))
+	}
+}
+
+func TestAddLocalServers(t *testing.T) {
+	t.Cleanup(func() { cleanupAll() })
+	localServers := `server=/net2/192.168.2.1
+server=/net3/192.168.3.1
+`
+	ownServers := `server=/net1/192.168.1.1
+`
+	if err := createNetwork("net1", localServers, ownServers); err != nil {
+		t.Fatalf("Can't create network: %v", err)
+	}
+	localServers = `server=/net1/192.168.1.1
+server=/net3/192.168.3.1
+`
+	ownServers = `server=/net2/192.168.2.1
+`
+	if err := createNetwork("net2", localServers, ownServers); err != nil {
+		t.Fatalf("Can't create network: %v", err)
+	}
+	localServers = `server=/net1/192.168.1.1
+server=/net2/192.168.2.1
+`
+	ownServers = `server=/net3/192.168.3.1
+`
+	if err := createNetwork("net3", localServers, ownServers); err != nil {
+		t.Fatalf("Can't create network: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(dnsNameConfPath(), "net4"), 0700); err != nil {
+		t.Fatalf("Can't create network dir: %v", err)
+	}
+	conf, err := newDNSMasqFile("net4", "", "net4", true)
+	if err != nil {
+		t.Fatalf("Can't create conf: %v", err)
+	}
+	if err := addLocalServers(context.Background(), conf, []string{"192.168.4.1"}); err != nil {
+		t.Fatalf("Can't add local servers: %v", err)
+	}
+	testData := []testServerData{
+		{
+			networkName: "net1",
+			localServers: `server=/net2/192.168.2.1
+server=/net3/192.168.3.1
+server=/net4/192.168.4.1
+`,
+			ownServers: `server=/net1/192.168.1.1
+`,
+		},
+		{
+			networkName: "net2",
+			localServers: `server=/net1/192.168.1.1
+server=/net3/192.168.3.1
+server=/net4/192.168.4.1
+`,
+			ownServers: `server=/net2/192.168.2.1
+`,
+		},
+		{
+			networkName: "net3",
+			localServers: `server=/net1/192.168.1.1
+server=/net2/192.168.2.1
+server=/net4/192.168.4.1
+`,
+			ownServers: `server=/net3/192.168.3.1
+`,
+		},
+		{
+			networkName: "net4",
+			localServers: `server=/net1/192.168.1.1
+server=/net2/192.168.2.1
+server=/net3/192.168.3.1
+`,
+			ownServers: `server=/net4/192.168.4.1
+`,
+		},
+	}
+	for _, item := range testData {
+		networkDir := filepath.Join(dnsNameConfPath(), item.networkName)
+		data, err := ioutil.ReadFile(filepath.Join(networkDir, localServersConfFileName))
+		if err != nil {
+			t.Fatalf("Can't read file: %v", err)
+		}
+		if string(data) != item.localServers {
+			t.Errorf("Wrong local servers, got: %v, want: %v", string(data), item.localServers)
+		}
+		data, err = ioutil.ReadFile(filepath.Join(networkDir, ownServersConfFileName))
+		if err != nil {
+			t.Fatalf("Can't read file: %v", err)
+		}
+		if string(data) != item.ownServers {
+			t.Errorf("Wrong own servers, got: %v, want: %v", string(data), item.ownServers)
+		}
+	}
+}
+
+func TestAddSameDomain(t *testing.T) {
+	t.Cleanup(func() { cleanupAll() })
+	localServers := `server=/net2/192.168.2.1
+server=/net3/192.168.3.1
+`
+	ownServers := `server=/net1/192.168.1.1
+`
+	if err := createNetwork("net1", localServers, ownServers); err != nil {
+		t.Fatalf("Can't create network: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(dnsNameConfPath(), "net4"), 0700); err != nil {
+		t.Fatalf("Can't create network dir: %v", err)
+	}
+	conf, err := newDNSMasqFile("net1", "", "net4", true)
+	if err != nil {
+		t.Fatalf("Can't create conf: %v", err)
+	}
+	if err := addLocalServers(context.Background(), conf, []string{"192.168.4.1"}); !errors.Is(err, ErrDomainExists) {
+		t.Fatalf("Adding servers should fail due to duplicate domain, got: %v", err)
+	}
+}
+
+func Test_isDomainInList(t *testing.T) {
+	serverItems := []string{"server=10.10.1.1", "server=/Net1.org/192.168.1.1", "server=/net2.org./192.168.2.1"}
+	tests := []struct {
+		domain string
+		want   bool
+	}{
+		{"net1.org", true},
+		{"NET1.ORG", true},
+		{"net1.org.", true},
+		{"net2.org", true},
+		{"Net2.Org.", true},
+		{"net3.org", false},
+		{"net1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			if got := isDomainInList(tt.domain, serverItems); got != tt.want {
+				t.Errorf("isDomainInList() got = '%v', want '%v'", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_isMDNSDomain(t *testing.T) {
+	for domain, want := range map[string]bool{"local": true, "Pods.Local.": true, "a.b.local": true,
+		"local.org": false, "mylocal": false, "": false} {
+		if got := isMDNSDomain(domain); got != want {
+			t.Errorf("isMDNSDomain(%q) got = '%v', want '%v'", domain, got, want)
+		}
+	}
+}
+
+func TestRemoveLocalServers(t *testing.T) {
+	t.Cleanup(func() { cleanupAll() })
+	localServers := `server=/net2/192.168.2.1
+server=/net3/192.168.3.1
+server=/net4/192.168.4.1
+`
+	ownServers := `server=/net1/192.168.1.1
+`
+	if err := createNetwork("net1", localServers, ownServers); err != nil {
+		t.Fatalf("Can't create network: %v", err)
+	}
+	localServers = `server=/net1/192.168.1.1
+server=/net3/192.168.3.1
+server=/net4/192.168.4.1
+`
+	ownServers = `server=/net2/192.168.2.1
+`
+	if err := createNetwork("net2", localServers, ownServers); err != nil {
+		t.Fatalf("Can't create network: %v", err)
+	}
+	localServers = `server=/net1/192.168.1.1
+server=/net2/192.168.2.1
+server=/net4/192.168.4.1
+`
+	ownServers = `server=/net3/192.168.3.1
+`
+	if err := createNetwork("net3", localServers, ownServers); err != nil {
+		t.Fatalf("Can't create network: %v", err)
+	}
+	localServers = `server=/net1/192.168.1.1
+server=/net2/192.168.2.1
+server=/net3/192.168.3.1
+`
+	ownServers = `server=/net4/192.168.4.1
+`
+	if err := createNetwork("net4", localServers, ownServers); err != nil {
+		t.Fatalf("Can't create network: %v", err)
+	}
+	conf, err := newDNSMasqFile("net4", "", "net4", true)
+	if err != nil {
+		t.Fatalf("Can't create conf: %v", err)
+	}
+	if err := removeLocalServers(context.Background(), conf, []string{"192.168.4.1"}); err != nil {
+		t.Fatalf("Can't add local servers: %v", err)
+	}
+	testData := []testServerData{
+		{
+			networkName: "net1",
+			localServers: `server=/net2/192.168.2.1
+server=/net3/192.168.3.1
+`,
+			ownServers: `server=/net1/192.168.1.1
+`,
+		},
+		{
+			networkName: "net2",
+			localServers: `server=/net1/192.168.1.1
+server=/net3/192.168.3.1
+`,
+			ownServers: `server=/net2/192.168.2.1
+`,
+		},
+		{
+			networkName: "net3",
+			localServers: `server=/net1/192.168.1.1
+server=/net2/192.168.2.1
+`,
+			ownServers: `server=/net3/192.168.3.1
+`,
+		},
+		{
+			networkName: "net4",
+			localServers: `server=/net1/192.168.1.1
+server=/net2/192.168.2.1
+server=/net3/192.168.3.1
+`,
+			ownServers: `server=/net4/192.168.4.1
+`,
+		},
+	}
+	for _, item := range testData {
+		networkDir := filepath.Join(dnsNameConfPath(), item.networkName)
+		data, err := ioutil.ReadFile(filepath.Join(networkDir, localServersConfFileName))
+		if err != nil {
+			t.Fatalf("Can't read file: %v", err)
+		}
+		if string(data) != item.localServers {
+			t.Errorf("Wrong local servers, got: %v, want: %v", string(data), item.localServers)
+		}
+		data, err = ioutil.ReadFile(filepath.Join(networkDir, ownServersConfFileName))
+		if err != nil {
+			t.Fatalf("Can't read file: %v", err)
+		}
+		if string(data) != item.ownServers {
+			t.Errorf("Wrong own servers, got: %v, want: %v", string(data), item.ownServers)
+		}
+	}
+}
+
+func TestRollbackServers(t *testing.T) {
+	t.Cleanup(func() { cleanupAll() })
+	localServers := `server=/net2/192.168.2.1
+`
+	ownServers := `server=/net1/192.168.1.1
+`
+	if err := createNetwork("net1", localServers, ownServers); err != nil {
+		t.Fatalf("Can't create network: %v", err)
+	}
+	conf := dnsNameFile{
+		InstanceDir:          makePath("net1", ""),
+		PidFile:              makePath("net1", pidFileName),
+		LocalServersConfFile: makePath("net1", localServersConfFileName),
+		OwnServersConfFile:   makePath("net1", ownServersConfFileName),
+	}
+	snapshot, err := snapshotFiles(conf.LocalServersConfFile, conf.OwnServersConfFile)
+	if err != nil {
+		t.Fatalf("Can't snapshot files: %v", err)
+	}
+	if servers := newOwnServers("net1", 0, []string{"192.168.1.1", "192.168.1.2"}, snapshot[conf.OwnServersConfFile]); !reflect.DeepEqual(servers, []string{"192.168.1.2"}) {
+		t.Errorf("Wrong new own servers: %v", servers)
+	}
+	if _, err := addRemoteServers(conf.LocalServersConfFile, []string{"10.10.1.1"}); err != nil {
+		t.Fatalf("Can't add remote servers: %v", err)
+	}
+	if err := rollbackServers(context.Background(), conf, snapshot, nil); err != nil {
+		t.Fatalf("Can't roll back servers: %v", err)
+	}
+	data, err := ioutil.ReadFile(conf.LocalServersConfFile)
+	if err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	if string(data) != localServers {
+		t.Errorf("Wrong local servers after rollback, got: %v, want: %v", string(data), localServers)
+	}
+}
+
+func TestForEachPeerRemovedPeer(t *testing.T) {
+	setupFakeDNSMasq(t)
+	for _, network := range []string{"net1", "net2", "net3"} {
+		if err := createNetwork(network, "", "server=/"+network+"/192.168.0.1\n"); err != nil {
+			t.Fatalf("Can't create network: %v", err)
+		}
+	}
+	conf := dnsNameFile{
+		Domain:               "net1",
+		LocalServersConfFile: makePath("net1", localServersConfFileName),
+		OwnServersConfFile:   makePath("net1", ownServersConfFileName),
+	}
+	batch := &reloadBatch{}
+	var visited []string
+	if err := forEachPeer(conf, func(networkName string) error {
+		visited = append(visited, networkName)
+		if networkName == "net2" {
+			// net3 is deleted while the peers are walked
+			if err := os.RemoveAll(filepath.Join(dnsNameConfPath(), "net3")); err != nil {
+				t.Fatalf("Can't remove network: %v", err)
+			}
+		}
+		_, err := addServersToInstance(batch, networkName, []string{conf.Domain}, []string{"server=/net1/192.168.1.1"})
+		return err
+	}); err != nil {
+		t.Fatalf("Removed peer should be skipped: %v", err)
+	}
+	if !reflect.DeepEqual(visited, []string{"net2", "net3"}) {
+		t.Errorf("forEachPeer() visited = %v, want %v", visited, []string{"net2", "net3"})
+	}
+	if _, err := os.Stat(filepath.Join(dnsNameConfPath(), "net3")); !os.IsNotExist(err) {
+		t.Errorf("Removed peer should not be recreated, got %v", err)
+	}
+	// a peer whose files are already gone is skipped on removal too
+	if err := os.Remove(makePath("net2", localServersConfFileName)); err != nil {
+		t.Fatalf("Can't remove file: %v", err)
+	}
+	if err := removeLocalServers(context.Background(), conf, []string{"192.168.1.1"}); err != nil {
+		t.Errorf("removeLocalServers() error = %v", err)
+	}
+}
+
+func Test_mergeServerItems(t *testing.T) {
+	tests := []struct {
+		name         string
+		cur          []string
+		add          []string
+		want         []string
+		wantModified bool
+	}{
+		{"both empty", nil, nil, nil, false},
+		{"into empty", nil, []string{"server=/net1/10.0.1.1"}, []string{"server=/net1/10.0.1.1"}, true},
+		{"nothing new", []string{"server=/net1/10.0.1.1"}, nil, []string{"server=/net1/10.0.1.1"}, false},
+		{"new items appended in order", []string{"server=/net2/10.0.2.1", "server=/net1/10.0.1.1"},
+			[]string{"server=/net4/10.0.4.1", "server=/net3/10.0.3.1"},
+			[]string{"server=/net2/10.0.2.1", "server=/net1/10.0.1.1", "server=/net4/10.0.4.1", "server=/net3/10.0.3.1"}, true},
+		{"present items skipped", []string{"server=/net1/10.0.1.1", "server=10.10.1.1"},
+			[]string{"server=10.10.1.1", "server=/net1/10.0.1.1"},
+			[]string{"server=/net1/10.0.1.1", "server=10.10.1.1"}, false},
+		{"duplicates added once", []string{"server=/net1/10.0.1.1"},
+			[]string{"server=/net2/10.0.2.1", "server=/net2/10.0.2.1", "server=/net1/10.0.1.1"},
+			[]string{"server=/net1/10.0.1.1", "server=/net2/10.0.2.1"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, modified := mergeServerItems(append([]string(nil), tt.cur...), tt.add)
+			if !reflect.DeepEqual(got, tt.want) || modified != tt.wantModified {
+				t.Errorf("mergeServerItems() got = '%v' %v, want '%v' %v", got, modified, tt.want, tt.wantModified)
+			}
+		})
+	}
+}
+
+func Test_removeServerItems(t *testing.T) {
+	cur := []string{"server=/net1/10.0.1.1", "server=/net2/10.0.2.1", "server=10.10.1.1", "server=/net3/10.0.3.1"}
+	tests := []struct {
+		name         string
+		cur          []string
+		remove       []string
+		want         []string
+		wantModified bool
+	}{
+		{"from empty", nil, []string{"server=/net1/10.0.1.1"}, nil, false},
+		{"nothing to remove", cur, nil, cur, false},
+		{"absent item", cur, []string{"server=/net4/10.0.4.1"}, cur, false},
+		{"present item", cur, []string{"server=/net2/10.0.2.1"},
+			[]string{"server=/net1/10.0.1.1", "server=10.10.1.1", "server=/net3/10.0.3.1"}, true},
+		{"several items", cur, []string{"server=/net3/10.0.3.1", "server=/net4/10.0.4.1", "server=/net1/10.0.1.1"},
+			[]string{"server=/net2/10.0.2.1", "server=10.10.1.1"}, true},
+		{"all items", cur, cur, nil, true},
+		{"one occurrence per item", []string{"server=/net1/10.0.1.1", "server=/net1/10.0.1.1"},
+			[]string{"server=/net1/10.0.1.1"}, []string{"server=/net1/10.0.1.1"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the items are removed in place, the shared input must stay intact
+			got, modified := removeServerItems(append([]string(nil), tt.cur...), tt.remove)
+			if len(got) == 0 {
+				// an emptied slice is no items
+				got = nil
+			}
+			if !reflect.DeepEqual(got, tt.want) || modified != tt.wantModified {
+				t.Errorf("removeServerItems() got = '%v' %v, want '%v' %v", got, modified, tt.want, tt.wantModified)
+			}
+		})
+	}
+}
+
+func Test_domainServerItems(t *testing.T) {
+	serverItems := domainServerItems(map[string][]string{
+		"lab.example":  {"10.20.0.1"},
+		"corp.example": {"10.10.0.1", "10.10.0.2#5353"},
+	})
+	want := []string{"server=/corp.example/10.10.0.1", "server=/corp.example/10.10.0.2#5353", "server=/lab.example/10.20.0.1"}
+	if !reflect.DeepEqual(serverItems, want) {
+		t.Errorf("domainServerItems() got = '%v', want '%v'", serverItems, want)
+	}
+	domains := serverItemDomains(append([]string{"server=/net1/10.88.0.1"}, serverItems...))
+	if wantDomains := []string{"net1", "corp.example", "lab.example"}; !reflect.DeepEqual(domains, wantDomains) {
+		t.Errorf("serverItemDomains() got = '%v', want '%v'", domains, wantDomains)
+	}
+}
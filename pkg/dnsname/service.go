@@ -0,0 +1,477 @@
+package dnsname
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// newDNSMasqFile creates a new instance of a dnsNameFile
+func newDNSMasqFile(domainName, networkInterface, networkName string, multiDomain bool) (dnsNameFile, error) {
+	dnsMasqBinary, err := lookupDNSMasq()
+	if err != nil {
+		return dnsNameFile{}, errors.Wrap(ErrBinaryNotFound, "the dnsmasq cni plugin requires the dnsmasq binary be in PATH")
+	}
+	masqConf := dnsNameFile{
+		InstanceDir:      makePath(networkName, ""),
+		ConfigFile:       makePath(networkName, confFileName),
+		Domain:           domainName,
+		PidFile:          makePath(networkName, pidFileName),
+		NetworkInterface: networkInterface,
+		AddOnHostsFile:   makePath(networkName, hostsFileName),
+		StaticHostsFile:  makePath(networkName, staticHostsFileName),
+		CNAMEFile:        makePath(networkName, cnamesFileName),
+		Binary:           dnsMasqBinary,
+		// .local names belong to mDNS, they must not leak upstream
+		MDNSGuard: isMDNSDomain(domainName),
+	}
+	if multiDomain {
+		masqConf.LocalServersConfFile = makePath(networkName, localServersConfFileName)
+		masqConf.OwnServersConfFile = makePath(networkName, ownServersConfFileName)
+	}
+	return masqConf, nil
+}
+
+// setConfig applies the attributes of the network configuration to the instance
+func (d *dnsNameFile) setConfig(conf *DNSNameConf) {
+	d.HostAliases = conf.HostAliases
+	d.AddressFamily = conf.AddressFamily
+	d.RedirectFamily = conf.RedirectFamily
+	d.ForceUpstreamTCP = conf.ForceUpstreamTCP
+	d.Isolated = conf.Isolated
+	d.ExtraOptions = conf.ExtraDnsmasqOptions
+	d.IncludeConfFiles = conf.IncludeConfFiles
+	d.ValidateConfig = conf.ValidateConfig
+	d.DomainServers = conf.DomainServers
+	d.ReloadWindow = conf.ReloadWindow
+	d.ReloadMaxBatch = conf.ReloadMaxBatch
+	d.LockDir = conf.LockDir
+	d.CNAMEAliases = conf.AliasRecords == aliasRecordsCNAME
+	d.BindInterfaceOnly = conf.BindInterfaceOnly
+	d.InterfaceName = conf.InterfaceName
+	d.ServiceDomain = conf.ServiceDomain
+	if d.MDNSGuard {
+		if conf.AllowMDNSDomain {
+			d.MDNSGuard = false
+		} else {
+			logrus.Warnf("domain %s of network %s is reserved for mDNS and conflicts with mDNS responders on the node, "+
+				"the other .local names are answered by dnsmasq only", d.Domain, conf.Name)
+		}
+	}
+	d.NegTTL = conf.negTTL()
+	d.DNSPort = conf.dnsPort()
+	d.DNSForwardMax = conf.dnsForwardMax()
+	d.Nice = conf.Nice
+	d.CPUAffinity = conf.CPUAffinity
+	d.MaxOpenFiles = conf.MaxOpenFiles
+	d.ReverseZone = conf.ReverseZone
+	if conf.ForwardOnly {
+		d.ForwardOnly = true
+		d.ForwardServers = conf.RemoteServers
+	}
+	d.AddSubnet = conf.addSubnet()
+	d.StopDNSRebind = conf.StopDNSRebind
+	d.RebindDomainOK = conf.rebindDomainOK()
+	d.SharedHostsFile = conf.SharedHostsFile
+	d.AppendDomainToHosts = conf.AppendDomainToHosts
+	d.DisableRedirect = conf.DisableRedirect
+	d.KeepRunning = conf.KeepRunning
+	d.NoPidFile = conf.NoPidFile
+	d.RunAsUser = conf.RunAsUser
+	d.RunAsGroup = conf.RunAsGroup
+	d.MaxHosts = conf.MaxHosts
+	d.EvictOldestHosts = conf.EvictOldestHosts
+	d.IdleTimeout = conf.IdleTimeout
+	d.MaxInstanceLifetime = conf.MaxInstanceLifetime
+	if conf.InstanceGroup != "" {
+		d.setGroup(conf.InstanceGroup, conf.Name)
+	} else if conf.HostsFilePrefix != "" {
+		d.AddOnHostsFile = makePath(conf.Name, conf.HostsFilePrefix+hostsFileName)
+		d.StaticHostsFile = makePath(conf.Name, conf.HostsFilePrefix+staticHostsFileName)
+	}
+	if conf.HostsFile != "" {
+		d.AddOnHostsFile = conf.HostsFile
+	}
+	if conf.DNSSEC {
+		// the trust anchors were checked by parseConfig
+		d.TrustAnchorsFile, _ = conf.trustAnchorsFile()
+		d.DNSSEC = true
+		d.DNSSECCheckUnsigned = conf.DNSSECCheckUnsigned
+	}
+}
+
+// hup sends a sighup to a running dnsmasq to reload its hosts file. if
+// there is no instance of the dnsmasq, then it simply starts it.
+func (d dnsNameFile) hup(ctx context.Context) error {
+	// First check for pidfile; if it does not exist, we just
+	// start the service
+	isRunning, pid := d.isRunning()
+	if !isRunning {
+		// the instance may have crashed leaving its pidfile behind, clean
+		// it up before starting a new one
+		if err := d.stop(); err != nil {
+			return err
+		}
+		return d.start(ctx)
+	}
+	return d.processes().signal(pid, unix.SIGHUP)
+}
+
+// determines if selected dnsmasq instance is running
+// it sends a signal 0 to the pid to determine if it
+// responds or not and checks the process is the
+// dnsmasq of the instance
+func (d dnsNameFile) isRunning() (bool, int) {
+	pid, err := d.getPID()
+	if err != nil {
+		return false, 0
+	}
+	if err := d.processes().signal(pid, syscall.Signal(0)); err != nil {
+		return false, 0
+	}
+	if !d.ownsProcess(pid) {
+		return false, 0
+	}
+	return true, pid
+}
+
+// ownsProcess checks that the process is the dnsmasq of the instance and not
+// an unrelated process which got the PID of a crashed instance
+func (d dnsNameFile) ownsProcess(pid int) bool {
+	cmdline, err := d.processes().cmdline(pid)
+	if os.IsNotExist(err) {
+		return false
+	}
+	if err != nil {
+		// the command line can't be verified, e.g. /proc is restricted
+		logrus.Debugf("unable to check the command line of %d: %v", pid, err)
+		return true
+	}
+	return stringInSlice(confFileArg(d.ConfigFile), cmdline)
+}
+
+// confFileArg returns the dnsmasq argument passing the conf file
+func confFileArg(confFile string) string {
+	return fmt.Sprintf("--conf-file=%s", confFile)
+}
+
+// testConfig checks the conf file of the instance with dnsmasq --test, which
+// parses the configuration without starting an instance
+func (d dnsNameFile) testConfig(ctx context.Context) error {
+	stdout, stderr, err := d.processes().run(ctx, d.Binary, []string{"--test", confFileArg(d.ConfigFile)})
+	if errors.Is(err, ErrTimeout) {
+		return err
+	}
+	if err != nil {
+		output := strings.TrimSpace(string(stderr) + string(stdout))
+		return errors.Wrapf(ErrInvalidConfig, "%s: %v: %s", d.ConfigFile, err, output)
+	}
+	return nil
+}
+
+// checkListenAddresses checks that no other process, e.g. another resolver,
+// listens on the addresses the instance is going to listen on: dnsmasq only
+// fails with a terse bind error then. Other bind errors are left to dnsmasq.
+func checkListenAddresses(addresses []string, port int) error {
+	if port == 0 {
+		port = defaultDNSPort
+	}
+	for _, address := range addresses {
+		hostPort := net.JoinHostPort(address, strconv.Itoa(port))
+		for _, network := range []string{"udp", "tcp"} {
+			var (
+				listener io.Closer
+				err      error
+			)
+			if network == "udp" {
+				listener, err = net.ListenPacket(network, hostPort)
+			} else {
+				listener, err = net.Listen(network, hostPort)
+			}
+			if err == nil {
+				listener.Close()
+				continue
+			}
+			if errors.Is(err, unix.EADDRINUSE) {
+				return errors.Wrapf(ErrAddressInUse, "address already in use by another resolver on %s/%s", hostPort, network)
+			}
+			logrus.Debugf("unable to check listen address %s/%s: %v", hostPort, network, err)
+		}
+	}
+	return nil
+}
+
+// start starts the dnsmasq instance.
+func (d dnsNameFile) start(ctx context.Context) error {
+	runAsUser := d.RunAsUser
+	if runAsUser == "" {
+		runAsUser = defaultRunAsUser
+	}
+	args := []string{
+		"-u",
+		runAsUser,
+	}
+	if d.RunAsGroup != "" {
+		args = append(args, "-g", d.RunAsGroup)
+	}
+	args = append(args, confFileArg(d.ConfigFile))
+	stdout, stderr, err := d.processes().run(ctx, d.Binary, args)
+	if errors.Is(err, ErrTimeout) {
+		return err
+	}
+	if err != nil {
+		return newStartError(stdout, stderr, err)
+	}
+	// the command returns once dnsmasq forked its daemon, which may still die
+	// on its own, e.g. on errors found while setting up
+	if !d.waitRunning(ctx) {
+		return newStartError(stdout, stderr, errors.New("dnsmasq exited right after start"))
+	}
+	if d.Nice != 0 || len(d.CPUAffinity) > 0 || d.MaxOpenFiles > 0 {
+		// dnsmasq forks its daemon itself, so the daemon is adjusted once it runs
+		pid, err := d.getPID()
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrStartFailed, err)
+		}
+		if err := d.processes().schedule(pid, d.Nice, d.CPUAffinity); err != nil {
+			return fmt.Errorf("%w: unable to set the scheduling of %d: %w", ErrStartFailed, pid, err)
+		}
+		if d.MaxOpenFiles > 0 {
+			if err := d.processes().limitOpenFiles(pid, uint64(d.MaxOpenFiles)); err != nil {
+				return fmt.Errorf("%w: unable to limit the open files of %d: %w", ErrStartFailed, pid, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// waitRunning waits for the started instance to show up as running
+func (d dnsNameFile) waitRunning(ctx context.Context) bool {
+	deadline := time.Now().Add(startCheckTimeout)
+	for {
+		if isRunning, _ := d.isRunning(); isRunning {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(startCheckInterval):
+		}
+	}
+}
+
+// stop stops the dnsmasq instance. It returns once the process exited, so an
+// instance started next finds its addresses free.
+func (d dnsNameFile) stop() error {
+	pid, err := d.getPID()
+	if os.IsNotExist(err) {
+		// a pidfile left behind is corrupt, dnsmasq writes a new one on start
+		if err := os.Remove(d.PidFile); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("%w: %w", ErrStopFailed, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrStopFailed, err)
+	}
+	if !d.ownsProcess(pid) {
+		// the instance is gone and its PID may now belong to an unrelated
+		// process, which must not be killed; just drop the stale pidfile
+		if err := os.Remove(d.PidFile); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("%w: %w", ErrStopFailed, err)
+		}
+		return nil
+	}
+	if err = d.processes().signal(pid, unix.SIGKILL); err != nil {
+		if errors.Is(err, os.ErrProcessDone) {
+			return nil
+		}
+		return fmt.Errorf("%w: %w", ErrStopFailed, err)
+	}
+	return d.waitExited(pid)
+}
+
+// waitExited waits for the killed instance to exit. SIGKILL is delivered
+// asynchronously, the process may hold its sockets for a moment.
+func (d dnsNameFile) waitExited(pid int) error {
+	deadline := time.Now().Add(stopCheckTimeout)
+	for {
+		if err := d.processes().signal(pid, 0); err != nil {
+			if errors.Is(err, os.ErrProcessDone) {
+				return nil
+			}
+			return fmt.Errorf("%w: %w", ErrStopFailed, err)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w: dnsmasq %d did not exit after SIGKILL", ErrStopFailed, pid)
+		}
+		time.Sleep(stopCheckInterval)
+	}
+}
+
+// getPID reads the PID for the dnsmasq instance. Instances without pidfile,
+// see NoPidFile, are looked up by their conf file argument. Returns an
+// os.IsNotExist error if there is no instance.
+func (d dnsNameFile) getPID() (int, error) {
+	pidFileContents, err := ioutil.ReadFile(d.PidFile)
+	if os.IsNotExist(err) {
+		// scanning the processes is only worth it if no pidfile is expected
+		if !d.pidFileDisabled() {
+			return 0, err
+		}
+		return d.processes().find(confFileArg(d.ConfigFile))
+	}
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(pidFileContents)))
+	if err == nil && pid > 0 {
+		return pid, nil
+	}
+	// a crash may leave a partially written pidfile behind, the instance is
+	// looked up as one without pidfile then and the pidfile repaired
+	logrus.Warnf("invalid pidfile %s %q, looking up the instance by its conf file", d.PidFile, pidFileContents)
+	pid, err = d.processes().find(confFileArg(d.ConfigFile))
+	if err != nil {
+		return 0, err
+	}
+	if err := ioutil.WriteFile(d.PidFile, []byte(strconv.Itoa(pid)+"\n"), 0o644); err != nil {
+		logrus.Warnf("unable to repair pidfile %s: %v", d.PidFile, err)
+	}
+	return pid, nil
+}
+
+// pidFileDisabled checks if the instance runs without pidfile. The commands
+// without the CNI config don't know NoPidFile, the conf file of the instance
+// tells then.
+func (d dnsNameFile) pidFileDisabled() bool {
+	if d.NoPidFile {
+		return true
+	}
+	data, err := ioutil.ReadFile(d.ConfigFile)
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "pid-file=" {
+			return true
+		}
+	}
+	return false
+}
+
+// processes returns the process manager of the instance
+func (d dnsNameFile) processes() processManager {
+	if d.procManager == nil {
+		return execProcessManager{}
+	}
+	return d.procManager
+}
+
+// shareWithDNSMasq gives the directory of the instance and the files dnsmasq
+// reads on reload to RunAsUser, and read access to them to RunAsGroup, so
+// dnsmasq can still read them after it dropped its privileges. The files are
+// rewritten in place, so they keep their owner. Nothing changes for a
+// dnsmasq running as root.
+func (d dnsNameFile) shareWithDNSMasq() error {
+	uid, gid, err := d.owner()
+	if err != nil {
+		return err
+	}
+	if uid == -1 && gid == -1 {
+		return nil
+	}
+	// the owner has access already, the modes only open them to the group
+	var dirMode, fileMode os.FileMode
+	if gid != -1 {
+		dirMode, fileMode = 0o750, 0o640
+	}
+	dirs := []string{d.InstanceDir}
+	if d.HostsDir != "" {
+		dirs = append(dirs, d.HostsDir)
+	}
+	for _, dir := range dirs {
+		if err := shareFile(dir, uid, gid, dirMode); err != nil {
+			return err
+		}
+	}
+	for _, file := range []string{d.AddOnHostsFile, d.StaticHostsFile, d.LocalServersConfFile} {
+		if file == "" {
+			continue
+		}
+		if err := shareFile(file, uid, gid, fileMode); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// owner returns the uid of RunAsUser and the gid of RunAsGroup, -1 for the
+// unset ones and for root, who owns the files the plugin creates already
+func (d dnsNameFile) owner() (int, int, error) {
+	uid, gid := -1, -1
+	if d.RunAsUser != "" && d.RunAsUser != defaultRunAsUser {
+		runAsUser, err := user.Lookup(d.RunAsUser)
+		if err != nil {
+			return -1, -1, err
+		}
+		if uid, err = strconv.Atoi(runAsUser.Uid); err != nil {
+			return -1, -1, errors.Wrapf(err, "invalid uid of user %s", d.RunAsUser)
+		}
+	}
+	if d.RunAsGroup != "" {
+		group, err := user.LookupGroup(d.RunAsGroup)
+		if err != nil {
+			return -1, -1, err
+		}
+		if gid, err = strconv.Atoi(group.Gid); err != nil {
+			return -1, -1, errors.Wrapf(err, "invalid gid of group %s", d.RunAsGroup)
+		}
+	}
+	if uid == 0 {
+		uid = -1
+	}
+	return uid, gid, nil
+}
+
+// shareFile sets the owner and the group of the file, and its mode unless it
+// is 0
+func shareFile(path string, uid, gid int, mode os.FileMode) error {
+	if err := os.Chown(path, uid, gid); err != nil {
+		return err
+	}
+	if mode == 0 {
+		return nil
+	}
+	return os.Chmod(path, mode)
+}
+
+// makePath formats a path name given a domain and suffix
+// isInstanceDir checks if the item of the configuration directory is the
+// directory of an instance rather than the one of the lock files
+func isInstanceDir(item os.FileInfo) bool {
+	return item.IsDir() && item.Name() != lockDirName
+}
+
+func makePath(networkName, fileName string) string {
+	// the generic path for where conf, host, pid files are kept is:
+	// /run/containers/cni/dnsmasq/<network-name>/
+	return filepath.Join(dnsNameConfPath(), networkName, fileName)
+}
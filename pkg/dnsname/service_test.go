@@ -0,0 +1,522 @@
+package dnsname
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// fakeProcessManager emulates dnsmasq instances writing their pidfile on start
+type fakeProcessManager struct {
+	pidFile string
+	nextPID int
+	running map[int][]string
+	runs    int
+	signals []syscall.Signal
+	// exitOnStart makes the started instances die right away
+	exitOnStart bool
+	// noPidFile makes the started instances not write the pidfile
+	noPidFile bool
+	// ignoreKill keeps the instances running after SIGKILL
+	ignoreKill bool
+	// nice and cpus are the scheduling set for the instances by PID
+	nice map[int]int
+	cpus map[int][]int
+	// openFiles are the open files limits set for the instances by PID
+	openFiles map[int]uint64
+	// tests are the conf files checked with --test, which fail with testErr
+	// and testStderr
+	tests      []string
+	testErr    error
+	testStderr string
+	// spawns are the command lines of the detached processes
+	spawns [][]string
+	// version is the output of --version, counted in versionRuns
+	version     string
+	versionRuns int
+}
+
+func newFakeProcessManager(pidFile string) *fakeProcessManager {
+	return &fakeProcessManager{pidFile: pidFile, nextPID: 1000, running: make(map[int][]string),
+		nice: make(map[int]int), cpus: make(map[int][]int), openFiles: make(map[int]uint64),
+		version: "Dnsmasq version 2.90  Copyright (c) 2000-2024 Simon Kelley\nCompile time options: IPv6 GNU-getopt DNSSEC\n"}
+}
+
+func (f *fakeProcessManager) run(ctx context.Context, binary string, args []string) ([]byte, []byte, error) {
+	if len(args) > 0 && args[0] == "--version" {
+		f.versionRuns++
+		return []byte(f.version), nil, nil
+	}
+	if len(args) > 0 && args[0] == "--test" {
+		f.tests = append(f.tests, args[len(args)-1])
+		return nil, []byte(f.testStderr), f.testErr
+	}
+	f.runs++
+	f.nextPID++
+	if !f.exitOnStart {
+		f.running[f.nextPID] = append([]string{binary}, args...)
+	}
+	if f.noPidFile {
+		return nil, nil, nil
+	}
+	return nil, nil, ioutil.WriteFile(f.pidFile, []byte(strconv.Itoa(f.nextPID)+"\n"), 0o644)
+}
+
+func (f *fakeProcessManager) find(arg string) (int, error) {
+	for pid, cmdline := range f.running {
+		if stringInSlice(arg, cmdline) {
+			return pid, nil
+		}
+	}
+	return 0, os.ErrNotExist
+}
+
+func (f *fakeProcessManager) signal(pid int, sig syscall.Signal) error {
+	if _, ok := f.running[pid]; !ok {
+		return os.ErrProcessDone
+	}
+	if sig == 0 {
+		return nil
+	}
+	f.signals = append(f.signals, sig)
+	if sig == syscall.SIGKILL && !f.ignoreKill {
+		delete(f.running, pid)
+	}
+	return nil
+}
+
+func (f *fakeProcessManager) schedule(pid int, nice int, cpus []int) error {
+	f.nice[pid] = nice
+	f.cpus[pid] = cpus
+	return nil
+}
+
+func (f *fakeProcessManager) limitOpenFiles(pid int, max uint64) error {
+	f.openFiles[pid] = max
+	return nil
+}
+
+func (f *fakeProcessManager) spawn(binary string, args []string, env []string) error {
+	f.spawns = append(f.spawns, append([]string{binary}, args...))
+	return nil
+}
+
+func (f *fakeProcessManager) cmdline(pid int) ([]string, error) {
+	cmdline, ok := f.running[pid]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return cmdline, nil
+}
+
+func newTestDNSMasqFile(t *testing.T) (dnsNameFile, *fakeProcessManager) {
+	pidFile := filepath.Join(t.TempDir(), pidFileName)
+	procs := newFakeProcessManager(pidFile)
+	return dnsNameFile{
+		InstanceDir: filepath.Dir(pidFile),
+		Binary:      "/usr/sbin/dnsmasq",
+		ConfigFile:  filepath.Join(filepath.Dir(pidFile), confFileName),
+		PidFile:     pidFile,
+		procManager: procs,
+	}, procs
+}
+
+func TestHupStartsIfNotRunning(t *testing.T) {
+	d, procs := newTestDNSMasqFile(t)
+	if err := d.hup(context.Background()); err != nil {
+		t.Fatalf("Can't hup: %v", err)
+	}
+	if procs.runs != 1 {
+		t.Fatalf("Instance should be started once, got %d starts", procs.runs)
+	}
+	isRunning, pid := d.isRunning()
+	if !isRunning || pid != procs.nextPID {
+		t.Fatalf("Instance should be running with PID %d, got %v %d", procs.nextPID, isRunning, pid)
+	}
+	if err := d.hup(context.Background()); err != nil {
+		t.Fatalf("Can't hup: %v", err)
+	}
+	if procs.runs != 1 {
+		t.Errorf("Running instance should not be restarted, got %d starts", procs.runs)
+	}
+	if len(procs.signals) != 1 || procs.signals[0] != syscall.SIGHUP {
+		t.Errorf("Running instance should get SIGHUP, got %v", procs.signals)
+	}
+}
+
+func TestHupStartsOnStalePidFile(t *testing.T) {
+	d, procs := newTestDNSMasqFile(t)
+	if err := ioutil.WriteFile(d.PidFile, []byte("4242\n"), 0o644); err != nil {
+		t.Fatalf("Can't write pidfile: %v", err)
+	}
+	if isRunning, _ := d.isRunning(); isRunning {
+		t.Fatal("Instance with stale pidfile should not be running")
+	}
+	if err := d.hup(context.Background()); err != nil {
+		t.Fatalf("Can't hup: %v", err)
+	}
+	if procs.runs != 1 || len(procs.signals) != 0 {
+		t.Errorf("Instance should be started without signals, got %d starts, signals %v", procs.runs, procs.signals)
+	}
+}
+
+func TestStopIdempotent(t *testing.T) {
+	d, procs := newTestDNSMasqFile(t)
+	// no pidfile
+	if err := d.stop(); err != nil {
+		t.Fatalf("Stop without instance should succeed: %v", err)
+	}
+	if err := d.start(context.Background()); err != nil {
+		t.Fatalf("Can't start: %v", err)
+	}
+	if err := d.stop(); err != nil {
+		t.Fatalf("Can't stop: %v", err)
+	}
+	if isRunning, _ := d.isRunning(); isRunning {
+		t.Fatal("Instance should be stopped")
+	}
+	// process already finished
+	if err := d.stop(); err != nil {
+		t.Fatalf("Stop of a finished instance should succeed: %v", err)
+	}
+	if len(procs.signals) != 1 || procs.signals[0] != syscall.SIGKILL {
+		t.Errorf("Instance should be killed once, got signals %v", procs.signals)
+	}
+}
+
+func TestStopErrorKeepsCause(t *testing.T) {
+	d, _ := newTestDNSMasqFile(t)
+	// a pidfile that can't be read
+	if err := os.Mkdir(d.PidFile, 0o700); err != nil {
+		t.Fatalf("Can't create pidfile dir: %v", err)
+	}
+	err := d.stop()
+	if !errors.Is(err, ErrStopFailed) || !errors.Is(err, syscall.EISDIR) {
+		t.Errorf("stop() error = %v, want %v and %v", err, ErrStopFailed, syscall.EISDIR)
+	}
+}
+
+func TestHupRestartsOnReusedPID(t *testing.T) {
+	d, procs := newTestDNSMasqFile(t)
+	// the instance crashed and its PID got reused by an unrelated process
+	foreignPID := 4242
+	procs.running[foreignPID] = []string{"/usr/bin/sleep", "infinity"}
+	if err := ioutil.WriteFile(d.PidFile, []byte(strconv.Itoa(foreignPID)+"\n"), 0o644); err != nil {
+		t.Fatalf("Can't write pidfile: %v", err)
+	}
+	if isRunning, _ := d.isRunning(); isRunning {
+		t.Fatal("Instance with reused PID should not be running")
+	}
+	if err := d.hup(context.Background()); err != nil {
+		t.Fatalf("Can't hup: %v", err)
+	}
+	if procs.runs != 1 {
+		t.Errorf("Instance should be restarted, got %d starts", procs.runs)
+	}
+	if len(procs.signals) != 0 {
+		t.Errorf("Unrelated process should not be signaled, got %v", procs.signals)
+	}
+	if _, ok := procs.running[foreignPID]; !ok {
+		t.Error("Unrelated process should not be killed")
+	}
+	if isRunning, pid := d.isRunning(); !isRunning || pid != procs.nextPID {
+		t.Errorf("Restarted instance should be running with PID %d, got %v %d", procs.nextPID, isRunning, pid)
+	}
+}
+
+func TestStartFailsIfInstanceDies(t *testing.T) {
+	d, procs := newTestDNSMasqFile(t)
+	procs.exitOnStart = true
+	err := d.hup(context.Background())
+	if !errors.Is(err, ErrStartFailed) {
+		t.Fatalf("hup() error = %v, want %v", err, ErrStartFailed)
+	}
+	if procs.runs != 1 {
+		t.Errorf("Instance should be started once, got %d starts", procs.runs)
+	}
+}
+
+func TestStartError(t *testing.T) {
+	d, _ := newTestDNSMasqFile(t)
+	d.procManager = nil
+	d.Binary = filepath.Join(t.TempDir(), "dnsmasq")
+	script := "#!/bin/sh\necho 'dnsmasq: syntax check OK.'\n" +
+		"echo 'dnsmasq: failed to create listening socket for port 53: Address in use' >&2\nexit 2\n"
+	if err := ioutil.WriteFile(d.Binary, []byte(script), 0o755); err != nil {
+		t.Fatalf("Can't write fake dnsmasq: %v", err)
+	}
+	err := d.start(context.Background())
+	var startErr *StartError
+	if !errors.As(err, &startErr) || !errors.Is(err, ErrStartFailed) {
+		t.Fatalf("start() error = %v, want a StartError", err)
+	}
+	if startErr.ExitCode != 2 {
+		t.Errorf("start() exit code got = '%v', want '2'", startErr.ExitCode)
+	}
+	if want := "dnsmasq: failed to create listening socket for port 53: Address in use\n"; startErr.Stderr != want {
+		t.Errorf("start() stderr got = '%v', want '%v'", startErr.Stderr, want)
+	}
+	if want := "dnsmasq: syntax check OK.\n"; startErr.Stdout != want {
+		t.Errorf("start() stdout got = '%v', want '%v'", startErr.Stdout, want)
+	}
+}
+
+func TestNoPidFile(t *testing.T) {
+	d, procs := newTestDNSMasqFile(t)
+	d.NoPidFile = true
+	procs.noPidFile = true
+	if err := d.hup(context.Background()); err != nil {
+		t.Fatalf("Can't hup: %v", err)
+	}
+	if _, err := os.Stat(d.PidFile); !os.IsNotExist(err) {
+		t.Fatalf("Pidfile should not be written, got %v", err)
+	}
+	if isRunning, pid := d.isRunning(); !isRunning || pid != procs.nextPID {
+		t.Fatalf("Instance should be found running with PID %d, got %v %d", procs.nextPID, isRunning, pid)
+	}
+	// the running instance is reloaded rather than started again
+	if err := d.hup(context.Background()); err != nil {
+		t.Fatalf("Can't hup: %v", err)
+	}
+	if procs.runs != 1 || len(procs.signals) != 1 || procs.signals[0] != syscall.SIGHUP {
+		t.Errorf("hup() got %d starts and signals '%v', want 1 start and '[hangup]'", procs.runs, procs.signals)
+	}
+	if err := d.stop(); err != nil {
+		t.Fatalf("Can't stop: %v", err)
+	}
+	if isRunning, _ := d.isRunning(); isRunning {
+		t.Error("Instance should be stopped")
+	}
+}
+
+func TestGetPIDWithoutPidFile(t *testing.T) {
+	d, procs := newTestDNSMasqFile(t)
+	procs.running[42] = []string{d.Binary, confFileArg(d.ConfigFile)}
+	// a missing pidfile means the instance is not running, unless it runs
+	// without pidfile
+	if isRunning, pid := d.isRunning(); isRunning {
+		t.Errorf("Instance should not be looked up without NoPidFile, got %d", pid)
+	}
+	if err := ioutil.WriteFile(d.ConfigFile, []byte("pid-file=\n"), 0o644); err != nil {
+		t.Fatalf("Can't write conf file: %v", err)
+	}
+	if isRunning, pid := d.isRunning(); !isRunning || pid != 42 {
+		t.Errorf("Instance of the conf file without pidfile should be found, got %v %d", isRunning, pid)
+	}
+}
+
+func TestRunAsGroup(t *testing.T) {
+	d, procs := newTestDNSMasqFile(t)
+	d.RunAsUser = "nobody"
+	d.RunAsGroup = "nogroup"
+	if err := d.start(context.Background()); err != nil {
+		t.Fatalf("Can't start: %v", err)
+	}
+	want := []string{d.Binary, "-u", "nobody", "-g", "nogroup", confFileArg(d.ConfigFile)}
+	if got := procs.running[procs.nextPID]; !reflect.DeepEqual(got, want) {
+		t.Errorf("start() args got = '%v', want '%v'", got, want)
+	}
+
+	group, err := user.LookupGroupId(strconv.Itoa(os.Getgid()))
+	if err != nil {
+		t.Skipf("Can't look up own group: %v", err)
+	}
+	d.RunAsUser = ""
+	d.RunAsGroup = group.Name
+	d.AddOnHostsFile = filepath.Join(d.InstanceDir, hostsFileName)
+	if err := ioutil.WriteFile(d.AddOnHostsFile, nil, 0o600); err != nil {
+		t.Fatalf("Can't write hosts: %v", err)
+	}
+	if err := d.shareWithDNSMasq(); err != nil {
+		t.Fatalf("shareWithDNSMasq() error = %v", err)
+	}
+	for path, want := range map[string]os.FileMode{d.InstanceDir: 0o750, d.AddOnHostsFile: 0o640} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("Can't stat: %v", err)
+		}
+		if info.Mode().Perm() != want {
+			t.Errorf("shareWithDNSMasq() mode of %s got = '%v', want '%v'", path, info.Mode().Perm(), want)
+		}
+	}
+}
+
+func TestRunAsUserOwner(t *testing.T) {
+	d, _ := newTestDNSMasqFile(t)
+	d.RunAsUser = defaultRunAsUser
+	if uid, gid, err := d.owner(); err != nil || uid != -1 || gid != -1 {
+		t.Errorf("owner() got = '%v' '%v' '%v', want root to keep the files as they are", uid, gid, err)
+	}
+	self, err := user.Current()
+	if err != nil {
+		t.Skipf("Can't look up own user: %v", err)
+	}
+	d.RunAsUser = self.Username
+	uid, _, err := d.owner()
+	if err != nil {
+		t.Fatalf("owner() error = %v", err)
+	}
+	if want := os.Getuid(); want != 0 && uid != want {
+		t.Errorf("owner() uid got = '%v', want '%v'", uid, want)
+	}
+	if err := os.Chmod(d.InstanceDir, 0o700); err != nil {
+		t.Fatalf("Can't chmod: %v", err)
+	}
+	if err := d.shareWithDNSMasq(); err != nil {
+		t.Fatalf("shareWithDNSMasq() error = %v", err)
+	}
+	// the owner has access already, the mode of the directory is kept
+	info, err := os.Stat(d.InstanceDir)
+	if err != nil {
+		t.Fatalf("Can't stat: %v", err)
+	}
+	if info.Mode().Perm() != 0o700 {
+		t.Errorf("shareWithDNSMasq() mode of %s got = '%v', want '%v'", d.InstanceDir, info.Mode().Perm(), os.FileMode(0o700))
+	}
+}
+
+func TestCheckListenAddresses(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Can't listen: %v", err)
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	if err := checkListenAddresses([]string{"127.0.0.1"}, port); !errors.Is(err, ErrAddressInUse) {
+		t.Errorf("checkListenAddresses() error = %v, want %v", err, ErrAddressInUse)
+	}
+	conn.Close()
+	if err := checkListenAddresses([]string{"127.0.0.1"}, port); err != nil {
+		t.Errorf("checkListenAddresses() error = %v", err)
+	}
+}
+
+func TestStartSetsScheduling(t *testing.T) {
+	d, procs := newTestDNSMasqFile(t)
+	if err := d.start(context.Background()); err != nil {
+		t.Fatalf("Can't start: %v", err)
+	}
+	if _, ok := procs.nice[procs.nextPID]; ok {
+		t.Error("Scheduling should not be set if unset")
+	}
+	d.Nice = 10
+	d.CPUAffinity = []int{0, 1}
+	if err := d.start(context.Background()); err != nil {
+		t.Fatalf("Can't start: %v", err)
+	}
+	if procs.nice[procs.nextPID] != 10 || !reflect.DeepEqual(procs.cpus[procs.nextPID], []int{0, 1}) {
+		t.Errorf("start() scheduling got = '%v' '%v', want '10' '[0 1]'", procs.nice[procs.nextPID], procs.cpus[procs.nextPID])
+	}
+	if _, ok := procs.openFiles[procs.nextPID]; ok {
+		t.Error("Open files limit should not be set if unset")
+	}
+	d.MaxOpenFiles = 256
+	if err := d.start(context.Background()); err != nil {
+		t.Fatalf("Can't start: %v", err)
+	}
+	if procs.openFiles[procs.nextPID] != 256 {
+		t.Errorf("start() open files limit got = '%v', want '256'", procs.openFiles[procs.nextPID])
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	d, procs := newTestDNSMasqFile(t)
+	d.StaticHostsFile = filepath.Join(d.InstanceDir, staticHostsFileName)
+	d.ValidateConfig = true
+	procs.testErr = errors.New("exit status 1")
+	procs.testStderr = "dnsmasq: bad option at line 12 of " + d.ConfigFile
+	_, err := checkForDNSMasqConfFile(context.Background(), d)
+	if !errors.Is(err, ErrInvalidConfig) || !strings.Contains(err.Error(), "bad option") {
+		t.Fatalf("checkForDNSMasqConfFile() got = '%v', want '%v'", err, ErrInvalidConfig)
+	}
+	tmpConf := filepath.Join(d.InstanceDir, "."+confFileName+".tmp")
+	for _, path := range []string{d.ConfigFile, tmpConf} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("Rejected %s should be removed, got %v", path, err)
+		}
+	}
+	if want := []string{confFileArg(tmpConf)}; !reflect.DeepEqual(procs.tests, want) {
+		t.Errorf("Checked conf files got = '%v', want '%v'", procs.tests, want)
+	}
+
+	procs.testErr = nil
+	if _, err := checkForDNSMasqConfFile(context.Background(), d); err != nil {
+		t.Fatalf("Can't write config: %v", err)
+	}
+	if _, err := os.Stat(d.ConfigFile); err != nil {
+		t.Errorf("Valid %s should be kept: %v", d.ConfigFile, err)
+	}
+	if procs.runs != 0 {
+		t.Errorf("Instance should not be started by the check, got %d starts", procs.runs)
+	}
+}
+
+func TestRegenerateConfFile(t *testing.T) {
+	d, procs := newTestDNSMasqFile(t)
+	d.StaticHostsFile = filepath.Join(d.InstanceDir, staticHostsFileName)
+	ctx := context.Background()
+	if modified, err := checkForDNSMasqConfFile(ctx, d); err != nil || modified {
+		t.Fatalf("checkForDNSMasqConfFile() got = '%v' '%v', want a new conf file", modified, err)
+	}
+	if modified, err := checkForDNSMasqConfFile(ctx, d); err != nil || modified {
+		t.Errorf("checkForDNSMasqConfFile() got = '%v' '%v', want an unchanged conf file", modified, err)
+	}
+	d.DNSPort = 5353
+	modified, err := checkForDNSMasqConfFile(ctx, d)
+	if err != nil || !modified {
+		t.Fatalf("checkForDNSMasqConfFile() got = '%v' '%v', want a changed conf file", modified, err)
+	}
+	if data, _ := ioutil.ReadFile(d.ConfigFile); !strings.Contains(string(data), "port=5353\n") {
+		t.Errorf("Changed conf file should be rewritten, got:\n%s", data)
+	}
+	// the running instance only reads the changed conf file on start
+	if err := d.start(ctx); err != nil {
+		t.Fatalf("Can't start: %v", err)
+	}
+	if err := d.reload(ctx, false, modified); err != nil {
+		t.Fatalf("reload() error = %v", err)
+	}
+	if procs.runs != 2 || len(procs.running) != 1 {
+		t.Errorf("Instance should be restarted, got %d starts, %d running", procs.runs, len(procs.running))
+	}
+}
+
+func TestCorruptPidFile(t *testing.T) {
+	d, procs := newTestDNSMasqFile(t)
+	// the instance crashed while writing its pidfile
+	if err := ioutil.WriteFile(d.PidFile, []byte("\x00\x00"), 0o644); err != nil {
+		t.Fatalf("Can't write pidfile: %v", err)
+	}
+	if isRunning, _ := d.isRunning(); isRunning {
+		t.Fatal("Instance with a corrupt pidfile should not be running")
+	}
+	if err := d.hup(context.Background()); err != nil {
+		t.Fatalf("Can't hup: %v", err)
+	}
+	if isRunning, pid := d.isRunning(); !isRunning || pid != procs.nextPID {
+		t.Fatalf("Instance should be running with PID %d, got %v %d", procs.nextPID, isRunning, pid)
+	}
+
+	// the running instance is found by its conf file and the pidfile repaired
+	if err := ioutil.WriteFile(d.PidFile, []byte("garbage"), 0o644); err != nil {
+		t.Fatalf("Can't write pidfile: %v", err)
+	}
+	if isRunning, pid := d.isRunning(); !isRunning || pid != procs.nextPID {
+		t.Fatalf("Instance should be running with PID %d, got %v %d", procs.nextPID, isRunning, pid)
+	}
+	want := strconv.Itoa(procs.nextPID) + "\n"
+	if data, err := ioutil.ReadFile(d.PidFile); err != nil || string(data) != want {
+		t.Errorf("Repaired pidfile got = '%v', want '%v'", string(data), want)
+	}
+	if procs.runs != 1 {
+		t.Errorf("Running instance should not be restarted, got %d starts", procs.runs)
+	}
+}
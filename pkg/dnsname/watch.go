@@ -0,0 +1,203 @@
+package dnsname
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// watchCommand is the maintenance command running the watcher of a network
+	watchCommand = "watch"
+	// watcherLockFileName is the lock file in the directory of the instance
+	// held by its watcher, so there is one watcher per instance
+	watcherLockFileName = "watcher.lock"
+	// restartsFileName is the file in the directory of the instance counting
+	// the restarts by its watcher
+	restartsFileName = "restarts"
+	// watchInterval is the interval the watcher checks the instance in
+	watchInterval = 5 * time.Second
+	// maxWatchBackoff bounds the wait between the restarts of an instance
+	// which keeps dying
+	maxWatchBackoff = 5 * time.Minute
+)
+
+// watchState is the state of the watcher kept between the checks
+type watchState struct {
+	// restarts are the restarts since the instance was last seen running
+	restarts int
+	// next is the earliest time of the next restart
+	next time.Time
+}
+
+// ensureWatcher spawns the watcher of the instance of a critical network
+// unless it has one already. The watcher is a detached process of the plugin
+// binary, the plugin itself exits right after ADD.
+func ensureWatcher(conf dnsNameFile, lockDir string) error {
+	if watcherRunning(conf) {
+		return nil
+	}
+	binary, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	env := os.Environ()
+	if lockDir != "" {
+		env = append(env, lockDirEnv+"="+lockDir)
+	}
+	return conf.processes().spawn(binary, []string{watchCommand, filepath.Base(conf.InstanceDir)}, env)
+}
+
+// watcherRunning checks if the watcher of the instance holds its lock
+func watcherRunning(conf dnsNameFile) bool {
+	return lockHeld(filepath.Join(conf.InstanceDir, watcherLockFileName))
+}
+
+// lockHeld checks if another process holds the lock file
+func lockHeld(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		return err == unix.EWOULDBLOCK
+	}
+	return false
+}
+
+// superviseInstance restarts the instance if it is not running. An instance
+// which keeps dying is restarted with an exponential backoff, which is reset
+// once the instance is seen running.
+func superviseInstance(ctx context.Context, conf dnsNameFile, state *watchState, now time.Time) error {
+	if isRunning, _ := conf.isRunning(); isRunning {
+		state.restarts = 0
+		return nil
+	}
+	if now.Before(state.next) {
+		return nil
+	}
+	state.restarts++
+	state.next = now.Add(watchBackoff(state.restarts))
+	if err := recordRestart(conf); err != nil {
+		logrus.Warnf("unable to record the restart of %s: %v", conf.InstanceDir, err)
+	}
+	// the instance may have left its pidfile behind
+	if err := conf.stop(); err != nil {
+		return err
+	}
+	return conf.start(ctx)
+}
+
+// watchBackoff returns the wait after the given number of restarts
+func watchBackoff(restarts int) time.Duration {
+	backoff := watchInterval
+	for i := 1; i < restarts && backoff < maxWatchBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxWatchBackoff {
+		return maxWatchBackoff
+	}
+	return backoff
+}
+
+// recordRestart increments the restart count of the instance
+func recordRestart(conf dnsNameFile) error {
+	path := filepath.Join(conf.InstanceDir, restartsFileName)
+	count, err := readCount(path)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(strconv.Itoa(count+1)+"\n"), 0o644)
+}
+
+// readCount returns the count of the file, 0 if it doesn't exist
+func readCount(path string) (int, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// superviseNetwork checks the instance of the network under the network lock,
+// so it doesn't race with ADD and DEL. It reports false once the instance is
+// gone.
+func superviseNetwork(networkName string, state *watchState, now time.Time) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultCommandTimeout)
+	defer cancel()
+	lock, err := lockNetwork(ctx, commandLockDir(), networkName, false, defaultLockPollInterval)
+	if err != nil {
+		return true, err
+	}
+	defer func() {
+		if err := lock.release(); err != nil {
+			logrus.Errorf("unable to release lock for %q: %v", networkName, err)
+		}
+	}()
+	if _, err := os.Stat(makePath(networkName, confFileName)); os.IsNotExist(err) {
+		return false, nil
+	}
+	conf, _, err := loadInstance(networkName)
+	if err != nil {
+		return true, err
+	}
+	return true, superviseInstance(ctx, conf, state, now)
+}
+
+// ownsLock checks that the lock file is still the one locked, the teardown of
+// the instance removes it along with the directory
+func ownsLock(f *os.File, path string) bool {
+	locked, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	current, err := os.Stat(path)
+	return err == nil && os.SameFile(locked, current)
+}
+
+// cmdWatch keeps the instance of the network running until it is torn down
+func cmdWatch(args []string) error {
+	if len(args) != 1 {
+		return errors.New("the network name is required")
+	}
+	networkName := args[0]
+	path := makePath(networkName, watcherLockFileName)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		if err == unix.EWOULDBLOCK {
+			// the instance has a watcher already
+			return nil
+		}
+		return err
+	}
+	state := &watchState{}
+	for {
+		time.Sleep(watchInterval)
+		if !ownsLock(f, path) {
+			return nil
+		}
+		exists, err := superviseNetwork(networkName, state, time.Now())
+		if err != nil {
+			logrus.Warnf("unable to supervise the instance of %s: %v", networkName, err)
+		}
+		if !exists {
+			return nil
+		}
+	}
+}
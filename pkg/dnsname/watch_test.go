@@ -0,0 +1,105 @@
+package dnsname
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSuperviseInstance(t *testing.T) {
+	d, procs := newTestDNSMasqFile(t)
+	ctx := context.Background()
+	state := &watchState{}
+	now := time.Now()
+	restarts := func() int {
+		count, err := readCount(filepath.Join(d.InstanceDir, restartsFileName))
+		if err != nil {
+			t.Fatalf("Can't read restarts: %v", err)
+		}
+		return count
+	}
+
+	if err := superviseInstance(ctx, d, state, now); err != nil {
+		t.Fatalf("superviseInstance() error = %v", err)
+	}
+	if procs.runs != 1 || restarts() != 1 {
+		t.Fatalf("Instance should be restarted once, got %d starts, %d restarts", procs.runs, restarts())
+	}
+	// the instance dies right away, the backoff delays the next restart
+	delete(procs.running, procs.nextPID)
+	if err := superviseInstance(ctx, d, state, now.Add(time.Second)); err != nil {
+		t.Fatalf("superviseInstance() error = %v", err)
+	}
+	if procs.runs != 1 {
+		t.Errorf("Instance should not be restarted during the backoff, got %d starts", procs.runs)
+	}
+	if err := superviseInstance(ctx, d, state, now.Add(watchInterval)); err != nil {
+		t.Fatalf("superviseInstance() error = %v", err)
+	}
+	if procs.runs != 2 || restarts() != 2 || !state.next.Equal(now.Add(3*watchInterval)) {
+		t.Errorf("Instance should be restarted with a doubled backoff, got %d starts, %d restarts, next %v",
+			procs.runs, restarts(), state.next.Sub(now))
+	}
+	// a running instance resets the backoff
+	if err := superviseInstance(ctx, d, state, now.Add(3*watchInterval)); err != nil {
+		t.Fatalf("superviseInstance() error = %v", err)
+	}
+	if procs.runs != 2 || state.restarts != 0 {
+		t.Errorf("Running instance should be left alone, got %d starts, %d restarts", procs.runs, state.restarts)
+	}
+}
+
+func Test_watchBackoff(t *testing.T) {
+	for restarts, want := range map[int]time.Duration{1: watchInterval, 2: 2 * watchInterval, 3: 4 * watchInterval,
+		20: maxWatchBackoff} {
+		if got := watchBackoff(restarts); got != want {
+			t.Errorf("watchBackoff(%d) got = '%v', want '%v'", restarts, got, want)
+		}
+	}
+}
+
+func TestEnsureWatcher(t *testing.T) {
+	d, procs := newTestDNSMasqFile(t)
+	if err := ensureWatcher(d, ""); err != nil {
+		t.Fatalf("ensureWatcher() error = %v", err)
+	}
+	binary, _ := os.Executable()
+	want := [][]string{{binary, watchCommand, filepath.Base(d.InstanceDir)}}
+	if !reflect.DeepEqual(procs.spawns, want) {
+		t.Errorf("ensureWatcher() spawns got = '%v', want '%v'", procs.spawns, want)
+	}
+	// the running watcher holds its lock
+	path := filepath.Join(d.InstanceDir, watcherLockFileName)
+	if err := ioutil.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatalf("Can't write lock: %v", err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Can't open lock: %v", err)
+	}
+	defer f.Close()
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		t.Fatalf("Can't lock: %v", err)
+	}
+	if err := ensureWatcher(d, ""); err != nil {
+		t.Fatalf("ensureWatcher() error = %v", err)
+	}
+	if len(procs.spawns) != 1 {
+		t.Errorf("Running watcher should not be duplicated, got %v", procs.spawns)
+	}
+	if !ownsLock(f, path) {
+		t.Error("ownsLock() should hold for the locked file")
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("Can't remove lock: %v", err)
+	}
+	if ownsLock(f, path) {
+		t.Error("ownsLock() should not hold once the instance is torn down")
+	}
+}